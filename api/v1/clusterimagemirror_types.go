@@ -0,0 +1,66 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterImageMirrorSpec defines the desired state of ClusterImageMirror. It
+// is the same as ImageMirrorSpec, except that the Secrets it references live
+// in SecretNamespace.
+type ClusterImageMirrorSpec struct {
+	ImageMirrorSpec `json:",inline"`
+
+	// SecretNamespace is the namespace of the Secrets named by
+	// SourceSecretName, DestSecretName and Destinations. It is required if
+	// any of them are specified.
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Image",type="string",JSONPath=".spec.imageName"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason"
+// +kubebuilder:printcolumn:name="Suspend",type="boolean",JSONPath=".spec.suspend"
+// +kubebuilder:printcolumn:name="Last Success",type="date",JSONPath=".status.lastSuccessfulSyncTime"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// ClusterImageMirror is the Schema for the clusterimagemirrors API. It
+// mirrors images for the whole cluster, and is managed by cluster admins.
+type ClusterImageMirror struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterImageMirrorSpec `json:"spec,omitempty"`
+	Status ImageMirrorStatus      `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterImageMirrorList contains a list of ClusterImageMirror
+type ClusterImageMirrorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterImageMirror `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterImageMirror{}, &ClusterImageMirrorList{})
+}
@@ -0,0 +1,115 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ConditionStatus is the status of a condition, one of True, False or Unknown.
+type ConditionStatus string
+
+const (
+	ConditionTrue    ConditionStatus = "True"
+	ConditionFalse   ConditionStatus = "False"
+	ConditionUnknown ConditionStatus = "Unknown"
+)
+
+// These are the condition types set on an ImageMirror.
+const (
+	// ConditionReady is True when the last sync mirrored every selected tag.
+	ConditionReady = "Ready"
+	// ConditionSyncing is True while tags are being listed and copied.
+	ConditionSyncing = "Syncing"
+	// ConditionSourceReachable is True when the source repository could be listed.
+	ConditionSourceReachable = "SourceReachable"
+	// ConditionDestinationReachable is True when the destination repository could be listed.
+	ConditionDestinationReachable = "DestinationReachable"
+	// ConditionCredentialsValid is True when the referenced Secrets were
+	// found and accepted by the registries.
+	ConditionCredentialsValid = "CredentialsValid"
+	// ConditionDeleting is True while the mirror is being deleted, and
+	// explains what is blocking its removal.
+	ConditionDeleting = "Deleting"
+)
+
+// Condition contains details for one aspect of the current state of a
+// resource. It has the same shape as metav1.Condition, which is not available
+// in the version of apimachinery this operator is built against.
+type Condition struct {
+	// Type of condition in CamelCase, e.g. Ready.
+	Type string `json:"type"`
+
+	// Status of the condition, one of True, False, Unknown.
+	// +kubebuilder:validation:Enum=True;False;Unknown
+	Status ConditionStatus `json:"status"`
+
+	// ObservedGeneration is the .metadata.generation that the condition was
+	// set based upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// LastTransitionTime is the last time the condition transitioned from
+	// one status to another.
+	LastTransitionTime metav1.Time `json:"lastTransitionTime"`
+
+	// Reason is a programmatic identifier in CamelCase indicating the
+	// reason for the condition's last transition.
+	Reason string `json:"reason"`
+
+	// Message is a human readable message indicating details about the
+	// transition.
+	Message string `json:"message"`
+}
+
+// FindCondition returns the condition of type conditionType, or nil if it is
+// not present.
+func FindCondition(conditions []Condition, conditionType string) *Condition {
+	for i := range conditions {
+		if conditions[i].Type == conditionType {
+			return &conditions[i]
+		}
+	}
+	return nil
+}
+
+// SetCondition adds condition to conditions, or replaces an existing
+// condition of the same type. LastTransitionTime is only changed when the
+// status changes, and is set to now if it is not already set.
+func SetCondition(conditions *[]Condition, condition Condition) {
+	if condition.LastTransitionTime.IsZero() {
+		condition.LastTransitionTime = metav1.Now()
+	}
+
+	existing := FindCondition(*conditions, condition.Type)
+	if existing == nil {
+		*conditions = append(*conditions, condition)
+		return
+	}
+
+	if existing.Status == condition.Status {
+		condition.LastTransitionTime = existing.LastTransitionTime
+	}
+	*existing = condition
+}
+
+// IsConditionTrue returns true if the condition of type conditionType is
+// present and has status True.
+func IsConditionTrue(conditions []Condition, conditionType string) bool {
+	condition := FindCondition(conditions, conditionType)
+	return condition != nil && condition.Status == ConditionTrue
+}
@@ -22,6 +22,104 @@ import (
 
 // Important: Run "make" to regenerate code after modifying this file
 
+// SyncRequestedAnnotation requests an immediate sync of an ImageMirror or
+// ClusterImageMirror when it is set to a new value, conventionally the
+// current time in RFC 3339 format. The value of the last request handled is
+// recorded in status.lastHandledSyncRequest.
+const SyncRequestedAnnotation = "slipway.k8s.facebook.com/sync-requested"
+
+// ForceDeleteAnnotation, when set to "true" on an ImageMirror or
+// ClusterImageMirror which is being deleted, removes it without deleting
+// anything from its destinations, even if its DeletionPolicy is Delete and
+// the registries cannot be reached.
+const ForceDeleteAnnotation = "slipway.k8s.facebook.com/force-delete"
+
+// DestinationImagesFinalizer is set on every ImageMirror and
+// ClusterImageMirror, so that the DeletionPolicy is applied to the images
+// it created before it is removed.
+const DestinationImagesFinalizer = "slipway.k8s.facebook.com/destination-images"
+
+// DriftPolicy describes how to handle a tag which exists in the destination,
+// but whose digest differs from the same tag in the source (e.g. because
+// upstream moved latest to a new image).
+// +kubebuilder:validation:Enum=Resync;Ignore;Report
+type DriftPolicy string
+
+const (
+	// DriftPolicyResync always follows upstream, overwriting drifted tags.
+	DriftPolicyResync DriftPolicy = "Resync"
+	// DriftPolicyIgnore never overwrites a tag once it has been mirrored,
+	// and does not compare digests.
+	DriftPolicyIgnore DriftPolicy = "Ignore"
+	// DriftPolicyReport compares digests and reports drifted tags in
+	// status, without overwriting them.
+	DriftPolicyReport DriftPolicy = "Report"
+)
+
+// RetentionPolicy describes which tags slipway created in a destination are
+// deleted.
+// +kubebuilder:validation:Enum=KeepAll;DeleteUnmatched;KeepLatest
+type RetentionPolicy string
+
+const (
+	// RetentionKeepAll never deletes tags.
+	RetentionKeepAll RetentionPolicy = "KeepAll"
+	// RetentionDeleteUnmatched deletes tags which no longer match the
+	// pattern, or which were deleted from the source.
+	RetentionDeleteUnmatched RetentionPolicy = "DeleteUnmatched"
+	// RetentionKeepLatest keeps only the newest matching tags, ordered by
+	// the pattern, and deletes the rest.
+	RetentionKeepLatest RetentionPolicy = "KeepLatest"
+)
+
+// DeletionPolicy describes what happens to the images in the destinations
+// when a mirror is deleted.
+// +kubebuilder:validation:Enum=Retain;Delete
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyRetain leaves every image in the destinations.
+	DeletionPolicyRetain DeletionPolicy = "Retain"
+	// DeletionPolicyDelete deletes the tags slipway created in the
+	// destinations, and the manifests which no other tag refers to.
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+)
+
+// Retention describes how tags are deleted from the destinations. Only tags
+// which slipway created are ever deleted.
+type Retention struct {
+	// Policy is one of KeepAll (the default), DeleteUnmatched or KeepLatest.
+	Policy RetentionPolicy `json:"policy,omitempty"`
+
+	// Keep is the number of matching tags kept by KeepLatest. Older tags
+	// are neither mirrored nor kept.
+	// +kubebuilder:validation:Minimum=1
+	Keep int32 `json:"keep,omitempty"`
+
+	// DryRun lists the tags which would be deleted in status, without
+	// deleting them.
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// TagTemplate describes how the name of a source tag is rewritten to give
+// the name of the tag in the destinations. The substitution is applied
+// first, then Prefix and Suffix are added.
+type TagTemplate struct {
+	// Prefix is prepended to every tag (e.g. upstream-).
+	Prefix string `json:"prefix,omitempty"`
+
+	// Suffix is appended to every tag (e.g. -mirror).
+	Suffix string `json:"suffix,omitempty"`
+
+	// Regex is a regular expression which is replaced by Replacement in
+	// every tag (e.g. ^v(.*)$). Tags which do not match are left alone.
+	Regex string `json:"regex,omitempty"`
+
+	// Replacement replaces each match of Regex, and may refer to capture
+	// groups as $1 or ${name} (e.g. ${1}).
+	Replacement string `json:"replacement,omitempty"`
+}
+
 // ImageMirrorSpec defines the desired state of ImageMirror
 type ImageMirrorSpec struct {
 	// SourceRepo is a URL resource, including scheme (optional),
@@ -31,19 +129,60 @@ type ImageMirrorSpec struct {
 	SourceRepo string `json:"sourceRepo,requred"`
 
 	// DestRepos is a URL resource as above, which is used to
-	// push mirrored container images.
-	DestRepo string `json:"destRepo,required"`
+	// push mirrored container images. Either DestRepo or Destinations
+	// must be specified.
+	DestRepo string `json:"destRepo,omitempty"`
 
-	// ImageName is the name of the image without tag (e.g. cuda).
-	ImageName string `json:"imageName,required"`
+	// Destinations are further repositories to which the image is mirrored.
+	// Each tag is read from the source once, and pushed to every
+	// destination.
+	Destinations []Destination `json:"destinations,omitempty"`
+
+	// ImageName is the name of the image without tag (e.g. cuda). At
+	// least one of ImageName, ImageNames or ImageNamePattern must be
+	// specified.
+	ImageName string `json:"imageName,omitempty"`
+
+	// ImageNames lists further images in SourceRepo which are mirrored in
+	// the same way as ImageName.
+	ImageNames []string `json:"imageNames,omitempty"`
+
+	// ImageNamePattern selects the images to mirror, in any of the formats
+	// of Pattern (e.g. glob:cuda-*). It is matched against ImageName and
+	// ImageNames if any are specified, and otherwise against the images in
+	// SourceRepo listed by the registry catalog.
+	ImageNamePattern string `json:"imageNamePattern,omitempty"`
+
+	// DestImageName is the name of the image in the destinations, if it
+	// differs from ImageName (e.g. mirrors/cuda). It may only be used
+	// when a single ImageName is mirrored.
+	DestImageName string `json:"destImageName,omitempty"`
+
+	// TagTemplate rewrites the name of each tag in the destinations. If
+	// omitted, tags keep the same name as in the source.
+	TagTemplate *TagTemplate `json:"tagTemplate,omitempty"`
 
 	// Pattern matches the tags which should be mirrored, and supports
 	// serveral formats (semver:, glob:, regex:, etc.). Note these were
 	// copied from Flux for better interopability and ease of use. Cf.
 	// https://github.com/fluxcd/flux/blob/v1.19.0/pkg/policy/pattern.go
-	// If pattern is omitted then the operator will stop mirroring.
+	// If pattern, include and tags are all omitted then the operator will
+	// stop mirroring.
 	Pattern string `json:"pattern,omitempty"`
 
+	// Include lists further patterns, in any of the formats of Pattern. A
+	// tag is selected if it matches Pattern or any of Include, and none of
+	// Exclude.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude lists patterns, in any of the formats of Pattern, for tags
+	// which should not be mirrored even though they are included.
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Tags lists literal tags which are always selected, regardless of
+	// Exclude.
+	Tags []string `json:"tags,omitempty"`
+
 	// SourceSecretName is name of the secret in the same namespace,
 	// containing a token to authenticate with the source repository.
 	SourceSecretName string `json:"sourceSecretName,omitempty"`
@@ -51,16 +190,397 @@ type ImageMirrorSpec struct {
 	// DestSecretName is name of the secret in the same namespace,
 	// containing a token to authenticate with the destination repository.
 	DestSecretName string `json:"destSecretName,omitempty"`
+
+	// Platforms restricts which children of a multi-arch manifest list or
+	// OCI image index are mirrored, in the form os/arch[/variant] (e.g.
+	// linux/arm64/v8). If omitted, the whole index is mirrored intact and
+	// keeps the same digest. If set, only the matching child manifests are
+	// copied into a new, filtered index (which will have a new digest).
+	Platforms []string `json:"platforms,omitempty"`
+
+	// DriftPolicy determines what happens when a mirrored tag no longer
+	// has the same digest as the source. One of Resync (the default),
+	// Ignore or Report.
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// Latest limits mirroring to the given number of newest matching tags,
+	// ordered by the pattern: by version for semver patterns, and by image
+	// creation time otherwise. If omitted, every matching tag is mirrored.
+	// +kubebuilder:validation:Minimum=1
+	Latest *int32 `json:"latest,omitempty"`
+
+	// MinAge is how old a tag must be before it is mirrored (e.g. 168h), so
+	// that upstream images can "bake" before they reach the destinations.
+	MinAge *metav1.Duration `json:"minAge,omitempty"`
+
+	// MaxAge is how old a tag may be and still be mirrored (e.g. 8760h).
+	// The age of a tag is taken from the org.opencontainers.image.created
+	// or org.label-schema.build-date label of the image, or else from the
+	// created time in its config. Tags without a timestamp are not mirrored
+	// when MinAge or MaxAge is set.
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+
+	// Retention determines which tags slipway created in the destinations
+	// are deleted. By default, tags are never deleted.
+	Retention *Retention `json:"retention,omitempty"`
+
+	// Interval is how often the source repository is checked for new
+	// tags (e.g. 30m). If neither interval nor schedule is specified, the
+	// source is checked every hour.
+	Interval *metav1.Duration `json:"interval,omitempty"`
+
+	// Schedule is a cron expression (e.g. "0 */6 * * *") describing when
+	// the source repository is checked for new tags. If specified, it takes
+	// precedence over Interval.
+	Schedule string `json:"schedule,omitempty"`
+
+	// TimeZone is the IANA name of the time zone (e.g. Europe/Dublin) in
+	// which Schedule is interpreted. Defaults to UTC.
+	TimeZone string `json:"timeZone,omitempty"`
+
+	// Suspend stops mirroring, without losing the rest of the spec or the
+	// status, until it is cleared.
+	Suspend bool `json:"suspend,omitempty"`
+
+	// DryRun lists and selects tags as usual, and records the tags which
+	// would be copied in the plannedTags of each destination, without
+	// writing to or deleting from any destination.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// DeletionPolicy is what happens to the images slipway created in the
+	// destinations when the mirror is deleted, either Retain (the default)
+	// or Delete. Only tags which slipway created are ever deleted.
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// Destination is a repository to which the source image is mirrored.
+type Destination struct {
+	// Repo is a URL resource as DestRepo above, which is used to push
+	// mirrored container images.
+	Repo string `json:"repo"`
+
+	// SecretName is name of the secret in the same namespace, containing a
+	// token to authenticate with Repo.
+	SecretName string `json:"secretName,omitempty"`
+
+	// DriftPolicy overrides the DriftPolicy of the ImageMirror for this
+	// destination.
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+}
+
+// DestinationImageName returns the name of the source image imageName in
+// the destinations.
+func (s ImageMirrorSpec) DestinationImageName(imageName string) string {
+	if s.DestImageName != "" {
+		return s.DestImageName
+	}
+	return imageName
+}
+
+// AllImageNames returns ImageName, if specified, followed by ImageNames,
+// without duplicates.
+func (s ImageMirrorSpec) AllImageNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append([]string{s.ImageName}, s.ImageNames...) {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// AllDestinations returns DestRepo, if specified, followed by Destinations,
+// with the DriftPolicy of each filled in.
+func (s ImageMirrorSpec) AllDestinations() []Destination {
+	destinations := make([]Destination, 0, len(s.Destinations)+1)
+	if s.DestRepo != "" {
+		destinations = append(destinations, Destination{
+			Repo:       s.DestRepo,
+			SecretName: s.DestSecretName,
+		})
+	}
+	destinations = append(destinations, s.Destinations...)
+
+	for i := range destinations {
+		if destinations[i].DriftPolicy == "" {
+			destinations[i].DriftPolicy = s.DriftPolicy
+		}
+	}
+	return destinations
+}
+
+// SecretNames returns the names of the Secrets referenced by the spec,
+// without duplicates.
+func (s ImageMirrorSpec) SecretNames() []string {
+	var names []string
+	seen := make(map[string]bool)
+	candidates := []string{s.SourceSecretName, s.DestSecretName}
+	for _, destination := range s.Destinations {
+		candidates = append(candidates, destination.SecretName)
+	}
+	for _, name := range candidates {
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// TagStatus records the digests of a mirrored tag.
+type TagStatus struct {
+	// Tag is the name of the tag in the source.
+	Tag string `json:"tag"`
+
+	// DestTag is the name of the tag in the destination, if the TagTemplate
+	// renamed it.
+	DestTag string `json:"destTag,omitempty"`
+
+	// SourceDigest is the digest of the tag in the source repository.
+	SourceDigest string `json:"sourceDigest,omitempty"`
+
+	// DestDigest is the digest of the tag in the destination repository.
+	DestDigest string `json:"destDigest,omitempty"`
+
+	// CopyTime is when the tag was last copied to the destination by
+	// slipway. It is empty for tags which were already present.
+	CopyTime *metav1.Time `json:"copyTime,omitempty"`
+}
+
+// FailureReason classifies why a tag could not be mirrored.
+type FailureReason string
+
+const (
+	// FailureUnauthorized means a registry rejected our credentials.
+	FailureUnauthorized FailureReason = "Unauthorized"
+	// FailureNotFound means the manifest or one of its blobs does not exist.
+	FailureNotFound FailureReason = "NotFound"
+	// FailureRateLimited means a registry asked us to slow down.
+	FailureRateLimited FailureReason = "RateLimited"
+	// FailureManifestUnsupported means the manifest format cannot be mirrored
+	// (e.g. Docker schema 1).
+	FailureManifestUnsupported FailureReason = "ManifestUnsupported"
+	// FailureNetwork means a registry could not be reached, or failed.
+	FailureNetwork FailureReason = "Network"
+	// FailureUnknown is used for all other errors.
+	FailureUnknown FailureReason = "Unknown"
+)
+
+// FailedTag records a tag which could not be mirrored.
+type FailedTag struct {
+	// Tag is the name of the tag.
+	Tag string `json:"tag"`
+
+	// Reason classifies the last failure.
+	Reason FailureReason `json:"reason"`
+
+	// Message is the last error.
+	Message string `json:"message,omitempty"`
+
+	// Attempts is the number of consecutive failed attempts.
+	Attempts int32 `json:"attempts"`
+
+	// LastFailureTime is when the tag last failed.
+	LastFailureTime metav1.Time `json:"lastFailureTime"`
+
+	// NextRetryTime is when the tag will next be retried. The delay between
+	// attempts grows exponentially.
+	NextRetryTime metav1.Time `json:"nextRetryTime"`
+}
+
+// DestinationStatus defines the observed state of one destination.
+type DestinationStatus struct {
+	// Repo is the repository of the destination.
+	Repo string `json:"repo"`
+
+	// Conditions describe the current state of the destination. Known
+	// condition types are Ready, DestinationReachable and CredentialsValid.
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// LastSuccessfulSyncTime is when the destination last synced without
+	// error.
+	LastSuccessfulSyncTime *metav1.Time `json:"lastSuccessfulSyncTime,omitempty"`
+
+	// MirroredTagCount is the number of tags which have already been
+	// mirrored.
+	MirroredTagCount int32 `json:"mirroredTagCount"`
+
+	// CreatedTagCount is the number of tags which slipway created in the
+	// destination.
+	CreatedTagCount int32 `json:"createdTagCount"`
+
+	// RecentTags are the tags which were most recently copied, newest
+	// first. Every mirrored tag is listed in the MirrorInventory.
+	RecentTags []TagStatus `json:"recentTags,omitempty"`
+
+	// Tags is no longer written. It is read from the status of mirrors
+	// synced by earlier releases, and moved to the MirrorInventory.
+	Tags []TagStatus `json:"tags,omitempty"`
+
+	// DriftedTags are mirrored tags whose digest differs from the source,
+	// and which were not resynced because of the DriftPolicy.
+	DriftedTags []string `json:"driftedTags,omitempty"`
+
+	// FailedTags are selected tags which could not be mirrored.
+	FailedTags []FailedTag `json:"failedTags,omitempty"`
+
+	// CreatedTags is no longer written. It is read from the status of
+	// mirrors synced by earlier releases, and moved to the MirrorInventory.
+	CreatedTags []string `json:"createdTags,omitempty"`
+
+	// PrunedTags are the tags which were deleted by the last sync.
+	PrunedTags []string `json:"prunedTags,omitempty"`
+
+	// PrunableTags are the tags which would have been deleted by the last
+	// sync, if the Retention policy was not a dry run.
+	PrunableTags []string `json:"prunableTags,omitempty"`
+
+	// FailedPrunes are tags which could not be deleted.
+	FailedPrunes []FailedTag `json:"failedPrunes,omitempty"`
+
+	// PlannedTags are the tags which would have been copied, or resynced,
+	// by the last sync if it was not a dry run.
+	PlannedTags []string `json:"plannedTags,omitempty"`
+
+	// PushCheckedSecretVersion identifies the destination Secret, as
+	// <name>@<resourceVersion>, whose credentials were last found to allow
+	// pushing, or is "default" if the destination has no Secret. Pushing is
+	// checked again whenever it changes.
+	PushCheckedSecretVersion string `json:"pushCheckedSecretVersion,omitempty"`
+}
+
+// ImageStatus defines the observed state of one source image.
+type ImageStatus struct {
+	// Name is the name of the image in the source.
+	Name string `json:"name"`
+
+	// Conditions describe the current state of the image. Known condition
+	// types are Ready, SourceReachable and CredentialsValid.
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// MirroredTagCount is the number of tags which have already been
+	// mirrored to every destination.
+	MirroredTagCount int32 `json:"mirroredTagCount"`
+
+	// SelectedTagCount is the number of source tags which were selected
+	// for mirroring.
+	SelectedTagCount int32 `json:"selectedTagCount"`
+
+	// SkippedTagCount is the number of other source tags. The rule which
+	// excluded each of them is recorded in the MirrorInventory.
+	SkippedTagCount int32 `json:"skippedTagCount"`
+
+	// Destinations records the state of each destination.
+	Destinations []DestinationStatus `json:"destinations,omitempty" patchStrategy:"merge" patchMergeKey:"repo"`
+}
+
+// FindImage returns the status of the image with name, or nil if there is
+// none.
+func (s *ImageMirrorStatus) FindImage(name string) *ImageStatus {
+	for i := range s.Images {
+		if s.Images[i].Name == name {
+			return &s.Images[i]
+		}
+	}
+	return nil
+}
+
+// FindDestination returns the status of the destination with repo, or nil
+// if there is none.
+func (s *ImageStatus) FindDestination(repo string) *DestinationStatus {
+	for i := range s.Destinations {
+		if s.Destinations[i].Repo == repo {
+			return &s.Destinations[i]
+		}
+	}
+	return nil
+}
+
+// SkipReason explains why a source tag was not mirrored.
+type SkipReason string
+
+const (
+	// SkipReasonNotIncluded means the tag matches none of Pattern, Include
+	// or Tags.
+	SkipReasonNotIncluded SkipReason = "NotIncluded"
+	// SkipReasonExcluded means the tag matches one of Exclude.
+	SkipReasonExcluded SkipReason = "Excluded"
+	// SkipReasonNotLatest means the tag is not one of the Latest tags.
+	SkipReasonNotLatest SkipReason = "NotLatest"
+	// SkipReasonNotRetained means the tag would be deleted by the Retention
+	// policy.
+	SkipReasonNotRetained SkipReason = "NotRetained"
+	// SkipReasonTooNew means the tag is younger than MinAge.
+	SkipReasonTooNew SkipReason = "TooNew"
+	// SkipReasonTooOld means the tag is older than MaxAge.
+	SkipReasonTooOld SkipReason = "TooOld"
+	// SkipReasonMissingTimestamp means the age of the tag could not be
+	// determined, because the image has no creation time.
+	SkipReasonMissingTimestamp SkipReason = "MissingTimestamp"
+	// SkipReasonMalformedTimestamp means the age of the tag could not be
+	// determined, because its timestamp labels are not RFC 3339.
+	SkipReasonMalformedTimestamp SkipReason = "MalformedTimestamp"
+	// SkipReasonInvalidDestTag means the TagTemplate rewrote the tag to an
+	// invalid name, or to the same name as another tag.
+	SkipReasonInvalidDestTag SkipReason = "InvalidDestTag"
+)
+
+// SkippedTag records a source tag which was not mirrored.
+type SkippedTag struct {
+	// Tag is the name of the tag.
+	Tag string `json:"tag"`
+
+	// Reason is why the tag was skipped.
+	Reason SkipReason `json:"reason"`
+
+	// Message gives details, e.g. the rule which excluded the tag, or when
+	// the image was created.
+	Message string `json:"message,omitempty"`
 }
 
 // ImageMirrorStatus defines the observed state of ImageMirror
 type ImageMirrorStatus struct {
-	// MirroredTags is a slice of tags which have already been mirrored.
-	MirroredTags []string `json:"mirroredTags"`
+	// ObservedGeneration is the most recent generation observed by the
+	// controller.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describe the current state of the mirror. Known condition
+	// types are Ready, Syncing, SourceReachable, DestinationReachable,
+	// CredentialsValid and Deleting.
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// LastSyncTime is when the controller last started to sync the mirror.
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// LastSuccessfulSyncTime is when the mirror last synced without error.
+	LastSuccessfulSyncTime *metav1.Time `json:"lastSuccessfulSyncTime,omitempty"`
+
+	// Images records the state of each source image.
+	Images []ImageStatus `json:"images,omitempty" patchStrategy:"merge" patchMergeKey:"name"`
+
+	// NextSyncTime is when the source repository will next be checked.
+	NextSyncTime *metav1.Time `json:"nextSyncTime,omitempty"`
+
+	// InventoryNamespace is the namespace of the MirrorInventories which
+	// list every tag of the mirror. They are labelled with the name of the
+	// mirror.
+	InventoryNamespace string `json:"inventoryNamespace,omitempty"`
+
+	// LastHandledSyncRequest is the value of the sync-requested annotation
+	// when the controller last started to sync the mirror.
+	LastHandledSyncRequest string `json:"lastHandledSyncRequest,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Image",type="string",JSONPath=".spec.imageName"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Reason",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].reason"
+// +kubebuilder:printcolumn:name="Suspend",type="boolean",JSONPath=".spec.suspend"
+// +kubebuilder:printcolumn:name="Last Success",type="date",JSONPath=".status.lastSuccessfulSyncTime"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // ImageMirror is the Schema for the imagemirrors API
 type ImageMirror struct {
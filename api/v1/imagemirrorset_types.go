@@ -0,0 +1,145 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageMirrorSetLabel is set on every ImageMirror created by an
+// ImageMirrorSet, to the UID of the set. Unlike its name, which may be
+// longer, the UID is always a valid label value.
+const ImageMirrorSetLabel = "slipway.k8s.facebook.com/imagemirrorset"
+
+// ImageMirrorTemplate describes the ImageMirrors created by an
+// ImageMirrorSet. Any string in it may refer to a parameter as $(key), which
+// is replaced by the value of the parameter. References to parameters which
+// are not defined are left alone.
+type ImageMirrorTemplate struct {
+	// Labels are added to every ImageMirror.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Spec is the spec of every ImageMirror.
+	Spec ImageMirrorSpec `json:"spec"`
+}
+
+// ImageMirrorSetParameters are the parameters of one ImageMirror.
+type ImageMirrorSetParameters struct {
+	// Name identifies the ImageMirror, which is named <set>-<name>. It is
+	// also available to the template as $(name).
+	Name string `json:"name"`
+
+	// Values are the other parameters, by key.
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// ConfigMapGenerator reads the parameters of ImageMirrors from a ConfigMap.
+type ConfigMapGenerator struct {
+	// Name is the name of the ConfigMap in the same namespace. Each of its
+	// keys is the name of an ImageMirror, and each value holds the other
+	// parameters as key=value lines, as in an env file.
+	Name string `json:"name"`
+}
+
+// ImageMirrorSetSpec defines the desired state of ImageMirrorSet
+type ImageMirrorSetSpec struct {
+	// Template describes each ImageMirror.
+	Template ImageMirrorTemplate `json:"template"`
+
+	// Parameters lists the parameters of each ImageMirror.
+	Parameters []ImageMirrorSetParameters `json:"parameters,omitempty"`
+
+	// ConfigMapGenerator reads the parameters of further ImageMirrors from
+	// a ConfigMap.
+	ConfigMapGenerator *ConfigMapGenerator `json:"configMapGenerator,omitempty"`
+}
+
+// ImageMirrorSetMirrorStatus summarizes the state of one ImageMirror in a
+// set.
+type ImageMirrorSetMirrorStatus struct {
+	// Name is the name of the ImageMirror.
+	Name string `json:"name"`
+
+	// Ready is the status of the Ready condition of the ImageMirror.
+	Ready ConditionStatus `json:"ready"`
+
+	// Reason is the reason of the Ready condition of the ImageMirror, or
+	// why it could not be created or updated.
+	Reason string `json:"reason,omitempty"`
+
+	// Message gives details of Reason.
+	Message string `json:"message,omitempty"`
+
+	// MirroredTags is the number of tags mirrored to every destination,
+	// summed over all images of the ImageMirror.
+	MirroredTags int32 `json:"mirroredTags"`
+}
+
+// ImageMirrorSetStatus defines the observed state of ImageMirrorSet
+type ImageMirrorSetStatus struct {
+	// ObservedGeneration is the most recent generation observed by the
+	// controller.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions describe the current state of the set. The only known
+	// condition type is Ready, which is true if every ImageMirror is.
+	Conditions []Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// ImageMirrors is the number of ImageMirrors in the set.
+	ImageMirrors int32 `json:"imageMirrors"`
+
+	// ReadyImageMirrors is the number of ImageMirrors which are ready.
+	ReadyImageMirrors int32 `json:"readyImageMirrors"`
+
+	// MirroredTags is the number of tags mirrored, summed over all
+	// ImageMirrors.
+	MirroredTags int32 `json:"mirroredTags"`
+
+	// Mirrors summarizes the state of each ImageMirror.
+	Mirrors []ImageMirrorSetMirrorStatus `json:"mirrors,omitempty" patchStrategy:"merge" patchMergeKey:"name"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type==\"Ready\")].status"
+// +kubebuilder:printcolumn:name="Mirrors",type="integer",JSONPath=".status.imageMirrors"
+// +kubebuilder:printcolumn:name="Ready Mirrors",type="integer",JSONPath=".status.readyImageMirrors"
+// +kubebuilder:printcolumn:name="Tags",type="integer",JSONPath=".status.mirroredTags"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// ImageMirrorSet is the Schema for the imagemirrorsets API. It creates an
+// ImageMirror from a template for each set of parameters.
+type ImageMirrorSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageMirrorSetSpec   `json:"spec,omitempty"`
+	Status ImageMirrorSetStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ImageMirrorSetList contains a list of ImageMirrorSet
+type ImageMirrorSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageMirrorSet `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ImageMirrorSet{}, &ImageMirrorSetList{})
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ImageMirrorLabel and ClusterImageMirrorLabel are set on every
+// MirrorInventory to the UID of the ImageMirror or ClusterImageMirror it
+// belongs to.
+const (
+	ImageMirrorLabel        = "slipway.k8s.facebook.com/imagemirror"
+	ClusterImageMirrorLabel = "slipway.k8s.facebook.com/clusterimagemirror"
+)
+
+// DestinationInventory lists the tags of an image in one destination.
+type DestinationInventory struct {
+	// Repo is the repository of the destination.
+	Repo string `json:"repo"`
+
+	// MirroredTags are the tags which have already been mirrored.
+	MirroredTags []string `json:"mirroredTags,omitempty"`
+
+	// Tags records the source and destination digests of each mirrored tag.
+	Tags []TagStatus `json:"tags,omitempty"`
+
+	// CreatedTags are the tags which slipway created in the destination,
+	// and which may therefore be deleted by the Retention policy. Unlike
+	// the other lists of tags, these are named as in the destination.
+	CreatedTags []string `json:"createdTags,omitempty"`
+}
+
+// ImageInventory lists the tags of one source image, and of its copies.
+type ImageInventory struct {
+	// MirroredTags are the tags which have already been mirrored to every
+	// destination.
+	MirroredTags []string `json:"mirroredTags,omitempty"`
+
+	// SelectedTags are the source tags which were selected for mirroring.
+	SelectedTags []string `json:"selectedTags,omitempty"`
+
+	// SkippedTags are the other source tags, and the rule which excluded
+	// each of them.
+	SkippedTags []SkippedTag `json:"skippedTags,omitempty"`
+
+	// Destinations lists the tags in each destination.
+	Destinations []DestinationInventory `json:"destinations,omitempty"`
+}
+
+// FindDestination returns the inventory of the destination with repo, or
+// nil if there is none.
+func (i *ImageInventory) FindDestination(repo string) *DestinationInventory {
+	for j := range i.Destinations {
+		if i.Destinations[j].Repo == repo {
+			return &i.Destinations[j]
+		}
+	}
+	return nil
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:printcolumn:name="Image",type="string",JSONPath=".image"
+// +kubebuilder:printcolumn:name="Shard",type="integer",JSONPath=".shard"
+// +kubebuilder:printcolumn:name="Mirror",type="string",JSONPath=".metadata.ownerReferences[0].name"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// MirrorInventory is the Schema for the mirrorinventories API. It holds the
+// full inventory of the tags of one image of an ImageMirror or
+// ClusterImageMirror, which is too large to keep in their status. An image
+// with many tags is split across several MirrorInventories, numbered by
+// Shard, whose lists are concatenated in order. MirrorInventories are
+// written by the controller, and deleted along with their mirror.
+type MirrorInventory struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// Image is the name of the image in the source.
+	Image string `json:"image"`
+
+	// Shard is the position of this MirrorInventory among those of the same
+	// image, starting from zero.
+	Shard int32 `json:"shard"`
+
+	ImageInventory `json:",inline"`
+}
+
+// +kubebuilder:object:root=true
+
+// MirrorInventoryList contains a list of MirrorInventory
+type MirrorInventoryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MirrorInventory `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&MirrorInventory{}, &MirrorInventoryList{})
+}
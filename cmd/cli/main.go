@@ -25,5 +25,7 @@ func main() {
 		DestRepo:   *dest,
 		ImageName:  "centos",
 		Pattern:    "glob: 8*",
-	}}, controllers.SecretData{}, controllers.SecretData{})
+	}}, nil, controllers.SecretData{}, func(string) (controllers.SecretData, error) {
+		return controllers.SecretData{}, nil
+	})
 }
@@ -0,0 +1,96 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// FilterByAge returns the tags whose age is between minAge and maxAge at
+// now, either of which may be nil, and the tags which were skipped. The age
+// of each tag is taken from the Info returned by infoFor. Tags whose age
+// cannot be determined are skipped, as are tags with malformed timestamp
+// labels, even if their config has a creation time, so that the labels are
+// reported rather than silently overridden.
+func FilterByAge(tags []string, minAge, maxAge *metav1.Duration, now time.Time,
+	infoFor func(tag string) (Info, error)) (passed []string, skipped []slipwayk8sfacebookcomv1.SkippedTag) {
+	if minAge == nil && maxAge == nil {
+		return tags, nil
+	}
+
+	for _, tag := range tags {
+		info, err := infoFor(tag)
+		var labelErr *LabelTimestampFormatError
+		if info.CreatedAt.IsZero() || errors.As(err, &labelErr) {
+			skipped = append(skipped, missingTimestamp(tag, err))
+			continue
+		}
+
+		age := now.Sub(info.CreatedAt)
+		created := info.CreatedAt.UTC().Format(time.RFC3339)
+		switch {
+		case minAge != nil && age < minAge.Duration:
+			skipped = append(skipped, slipwayk8sfacebookcomv1.SkippedTag{
+				Tag:     tag,
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonTooNew,
+				Message: fmt.Sprintf("created at %s, younger than minAge %s", created, minAge.Duration),
+			})
+		case maxAge != nil && age > maxAge.Duration:
+			skipped = append(skipped, slipwayk8sfacebookcomv1.SkippedTag{
+				Tag:     tag,
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonTooOld,
+				Message: fmt.Sprintf("created at %s, older than maxAge %s", created, maxAge.Duration),
+			})
+		default:
+			passed = append(passed, tag)
+		}
+	}
+
+	return passed, skipped
+}
+
+// missingTimestamp records that the age of tag could not be determined
+// because of err, which may be nil if the image simply has no timestamp.
+func missingTimestamp(tag string, err error) slipwayk8sfacebookcomv1.SkippedTag {
+	var labelErr *LabelTimestampFormatError
+	switch {
+	case errors.As(err, &labelErr):
+		return slipwayk8sfacebookcomv1.SkippedTag{
+			Tag:     tag,
+			Reason:  slipwayk8sfacebookcomv1.SkipReasonMalformedTimestamp,
+			Message: labelErr.Error(),
+		}
+	case err != nil:
+		return slipwayk8sfacebookcomv1.SkippedTag{
+			Tag:     tag,
+			Reason:  slipwayk8sfacebookcomv1.SkipReasonMissingTimestamp,
+			Message: err.Error(),
+		}
+	default:
+		return slipwayk8sfacebookcomv1.SkippedTag{
+			Tag:     tag,
+			Reason:  slipwayk8sfacebookcomv1.SkipReasonMissingTimestamp,
+			Message: "the image has neither a created time nor timestamp labels",
+		}
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestFilterByAge(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	malformed := &LabelTimestampFormatError{Labels: []string{"org.opencontainers.image.created"}}
+	infos := map[string]struct {
+		info Info
+		err  error
+	}{
+		"new":       {Info{CreatedAt: now.Add(-time.Hour)}, nil},
+		"week":      {Info{CreatedAt: now.Add(-8 * 24 * time.Hour)}, nil},
+		"old":       {Info{CreatedAt: now.Add(-400 * 24 * time.Hour)}, nil},
+		"none":      {Info{}, nil},
+		"malformed": {Info{}, malformed},
+		"fallback":  {Info{CreatedAt: now.Add(-8 * 24 * time.Hour)}, malformed},
+		"error":     {Info{}, errors.New("unable to Get")},
+	}
+	infoFor := func(tag string) (Info, error) {
+		return infos[tag].info, infos[tag].err
+	}
+	week := &metav1.Duration{Duration: 7 * 24 * time.Hour}
+	year := &metav1.Duration{Duration: 365 * 24 * time.Hour}
+
+	tests := []struct {
+		name        string
+		tags        []string
+		minAge      *metav1.Duration
+		maxAge      *metav1.Duration
+		wantPassed  []string
+		wantSkipped map[string]slipwayk8sfacebookcomv1.SkipReason
+	}{
+		{
+			name:       "no ages",
+			tags:       []string{"new", "none", "error"},
+			wantPassed: []string{"new", "none", "error"},
+		},
+		{
+			name:        "minAge",
+			tags:        []string{"new", "week", "old"},
+			minAge:      week,
+			wantPassed:  []string{"week", "old"},
+			wantSkipped: map[string]slipwayk8sfacebookcomv1.SkipReason{"new": slipwayk8sfacebookcomv1.SkipReasonTooNew},
+		},
+		{
+			name:        "maxAge",
+			tags:        []string{"new", "week", "old"},
+			maxAge:      year,
+			wantPassed:  []string{"new", "week"},
+			wantSkipped: map[string]slipwayk8sfacebookcomv1.SkipReason{"old": slipwayk8sfacebookcomv1.SkipReasonTooOld},
+		},
+		{
+			name:       "minAge and maxAge",
+			tags:       []string{"new", "week", "old"},
+			minAge:     week,
+			maxAge:     year,
+			wantPassed: []string{"week"},
+			wantSkipped: map[string]slipwayk8sfacebookcomv1.SkipReason{
+				"new": slipwayk8sfacebookcomv1.SkipReasonTooNew,
+				"old": slipwayk8sfacebookcomv1.SkipReasonTooOld,
+			},
+		},
+		{
+			name:   "unknown ages",
+			tags:   []string{"none", "malformed", "error"},
+			minAge: week,
+			wantSkipped: map[string]slipwayk8sfacebookcomv1.SkipReason{
+				"none":      slipwayk8sfacebookcomv1.SkipReasonMissingTimestamp,
+				"malformed": slipwayk8sfacebookcomv1.SkipReasonMalformedTimestamp,
+				"error":     slipwayk8sfacebookcomv1.SkipReasonMissingTimestamp,
+			},
+		},
+		{
+			name:        "malformed label with a created time",
+			tags:        []string{"fallback", "week"},
+			minAge:      week,
+			wantPassed:  []string{"week"},
+			wantSkipped: map[string]slipwayk8sfacebookcomv1.SkipReason{"fallback": slipwayk8sfacebookcomv1.SkipReasonMalformedTimestamp},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passed, skipped := FilterByAge(tt.tags, tt.minAge, tt.maxAge, now, infoFor)
+			if !reflect.DeepEqual(passed, tt.wantPassed) {
+				t.Errorf("FilterByAge() passed %v, want %v", passed, tt.wantPassed)
+			}
+			if len(skipped) != len(tt.wantSkipped) {
+				t.Errorf("FilterByAge() skipped %+v, want %v", skipped, tt.wantSkipped)
+			}
+			for _, s := range skipped {
+				if want, ok := tt.wantSkipped[s.Tag]; !ok || s.Reason != want {
+					t.Errorf("FilterByAge() skipped %s with %s, want %q", s.Tag, s.Reason, want)
+				}
+				if s.Message == "" {
+					t.Errorf("FilterByAge() skipped %s without a message", s.Tag)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingTimestamp(t *testing.T) {
+	malformed := &LabelTimestampFormatError{Labels: []string{"org.label-schema.build-date"}}
+
+	tests := []struct {
+		name        string
+		err         error
+		wantReason  slipwayk8sfacebookcomv1.SkipReason
+		wantMessage string
+	}{
+		{"no timestamp", nil, slipwayk8sfacebookcomv1.SkipReasonMissingTimestamp, "the image has neither a created time nor timestamp labels"},
+		{"malformed label", malformed, slipwayk8sfacebookcomv1.SkipReasonMalformedTimestamp, malformed.Error()},
+		{"wrapped malformed label", errors.Wrap(malformed, "unable to GetInfo"), slipwayk8sfacebookcomv1.SkipReasonMalformedTimestamp, malformed.Error()},
+		{"fetch error", errors.New("unable to Get: 404"), slipwayk8sfacebookcomv1.SkipReasonMissingTimestamp, "unable to Get: 404"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := missingTimestamp("v1", tt.err)
+			want := slipwayk8sfacebookcomv1.SkippedTag{Tag: "v1", Reason: tt.wantReason, Message: tt.wantMessage}
+			if got != want {
+				t.Errorf("missingTimestamp() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetInfoCachesByDigest(t *testing.T) {
+	r := newTestRegistry(t)
+	img, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Config.Labels = map[string]string{"org.opencontainers.image.created": "yesterday"}
+	config.Created = v1.Time{Time: time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)}
+	img, err = mutate.ConfigFile(img, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.PushImage("src/app", "v1", img)
+	r.PushImage("src/app", "v2", img)
+	r.Requests()
+
+	for _, tag := range []string{"v1", "v1", "v2"} {
+		ref, err := name.ParseReference(r.Host() + "/src/app:" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := GetInfo(ref, nil, []remote.Option{})
+		var labelErr *LabelTimestampFormatError
+		if !errors.As(err, &labelErr) {
+			t.Errorf("GetInfo(%s) error = %v, want a LabelTimestampFormatError", tag, err)
+		}
+		if !info.CreatedAt.Equal(config.Created.Time) {
+			t.Errorf("GetInfo(%s) CreatedAt = %v, want %v", tag, info.CreatedAt, config.Created.Time)
+		}
+	}
+
+	// Only the first GetInfo reads the config; the others share its manifest.
+	requests := r.Requests()
+	if got := countRequests(requests, "GET /v2/src/app/manifests/"); got != 3 {
+		t.Errorf("fetched %d manifests, want 3", got)
+	}
+	if got := countRequests(requests, "GET /v2/src/app/blobs/"); got != 1 {
+		t.Errorf("fetched %d blobs, want 1", got)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/pkg/errors"
+)
+
+// blobCache is a cache.Cache which keeps the compressed layers read from the
+// source registry in a temporary directory, so that pushing a tag to several
+// destinations reads each layer from the source only once. A layer is only
+// cached once it has been read completely.
+type blobCache struct {
+	dir string
+
+	mu     sync.Mutex
+	layers map[v1.Hash]v1.Layer
+}
+
+// newBlobCache returns an empty blobCache, which must be closed to remove
+// its directory.
+func newBlobCache() (*blobCache, error) {
+	dir, err := ioutil.TempDir("", "slipway-blobs-")
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to TempDir")
+	}
+	return &blobCache{dir: dir, layers: make(map[v1.Hash]v1.Layer)}, nil
+}
+
+// Close removes every cached layer.
+func (c *blobCache) Close() error {
+	return os.RemoveAll(c.dir)
+}
+
+func (c *blobCache) path(h v1.Hash) string {
+	return filepath.Join(c.dir, h.Algorithm+"-"+h.Hex)
+}
+
+// Put implements cache.Cache.
+func (c *blobCache) Put(l v1.Layer) (v1.Layer, error) {
+	digest, err := l.Digest()
+	if err != nil {
+		return nil, err
+	}
+	return &cachingLayer{Layer: l, digest: digest, cache: c}, nil
+}
+
+// Get implements cache.Cache. Only compressed layers are cached, so looking
+// up a layer by its diff ID always misses.
+func (c *blobCache) Get(h v1.Hash) (v1.Layer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, ok := c.layers[h]
+	if !ok {
+		return nil, cache.ErrNotFound
+	}
+	return &cachedLayer{Layer: l, path: c.path(h)}, nil
+}
+
+// Delete implements cache.Cache.
+func (c *blobCache) Delete(h v1.Hash) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.layers[h]; !ok {
+		return cache.ErrNotFound
+	}
+	delete(c.layers, h)
+	return os.Remove(c.path(h))
+}
+
+// add records that the layer with digest h has been written to path.
+func (c *blobCache) add(h v1.Hash, l v1.Layer, path string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := os.Rename(path, c.path(h)); err != nil {
+		return err
+	}
+	c.layers[h] = l
+	return nil
+}
+
+// cachingLayer is a layer which copies its compressed contents into the
+// cache as they are read.
+type cachingLayer struct {
+	v1.Layer
+	digest v1.Hash
+	cache  *blobCache
+}
+
+// Compressed implements v1.Layer.
+func (l *cachingLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		return nil, err
+	}
+
+	// Failing to cache a layer only means it is read from the source again.
+	f, err := ioutil.TempFile(l.cache.dir, "partial-")
+	if err != nil {
+		return rc, nil
+	}
+	return &cachingReader{rc: rc, f: f, layer: l}, nil
+}
+
+// cachingReader tees a layer into a temporary file, which is added to the
+// cache if the whole layer was read without error.
+type cachingReader struct {
+	rc       io.ReadCloser
+	f        *os.File
+	layer    *cachingLayer
+	complete bool
+	failed   bool
+}
+
+func (r *cachingReader) Read(b []byte) (int, error) {
+	n, err := r.rc.Read(b)
+	if n > 0 && !r.failed {
+		if _, werr := r.f.Write(b[:n]); werr != nil {
+			r.failed = true
+		}
+	}
+	if err == io.EOF {
+		r.complete = true
+	} else if err != nil {
+		r.failed = true
+	}
+	return n, err
+}
+
+func (r *cachingReader) Close() error {
+	err := r.rc.Close()
+	if ferr := r.f.Close(); ferr != nil {
+		r.failed = true
+	}
+
+	if r.complete && !r.failed && err == nil {
+		if r.layer.cache.add(r.layer.digest, r.layer.Layer, r.f.Name()) == nil {
+			return nil
+		}
+	}
+	os.Remove(r.f.Name())
+	return err
+}
+
+// cachedLayer is a layer whose compressed contents are read from the cache.
+type cachedLayer struct {
+	v1.Layer
+	path string
+}
+
+// Compressed implements v1.Layer.
+func (l *cachedLayer) Compressed() (io.ReadCloser, error) {
+	return os.Open(l.path)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// TestMirrorImageReadsLayersOnce checks that a tag mirrored to several
+// destinations reads each layer from the source once, writes it to every
+// destination, and that a destination which rejects it does not stop the
+// others.
+func TestMirrorImageReadsLayersOnce(t *testing.T) {
+	tests := []struct {
+		name string
+		deny int
+	}{
+		{"all destinations", -1},
+		{"first destination denied", 0},
+		{"second destination denied", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The in-memory registry shares blobs between repositories, so
+			// each destination has a registry of its own.
+			source := newTestRegistry(t)
+			dests := []*testRegistry{newTestRegistry(t), newTestRegistry(t)}
+			img, err := random.Image(1024, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			source.PushImage("src/app", "v1", img)
+			source.Requests()
+			// Destinations must exist before their tags can be listed.
+			for _, dest := range dests {
+				base, err := random.Image(64, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				dest.PushImage("dst/app", "base", base)
+				dest.Requests()
+			}
+			layers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			imageMirror := testImageMirror(source)
+			imageMirror.Spec.DestRepo = ""
+			status := slipwayk8sfacebookcomv1.ImageStatus{Name: "app"}
+			for i, dest := range dests {
+				repo := dest.Host() + "/dst"
+				imageMirror.Spec.Destinations = append(imageMirror.Spec.Destinations, slipwayk8sfacebookcomv1.Destination{Repo: repo})
+				// Push permission was checked before, so a denied
+				// destination fails while the tag is written.
+				status.Destinations = append(status.Destinations, slipwayk8sfacebookcomv1.DestinationStatus{Repo: repo, PushCheckedSecretVersion: "default"})
+				if i == tt.deny {
+					dest.denyPush["dst/app"] = true
+				}
+			}
+			imageMirror.Status.Images = []slipwayk8sfacebookcomv1.ImageStatus{status}
+
+			result := mirrorImage(context.Background(), ctrl.Log, imageMirror, Inventory{}, "app", SecretData{}, noSecrets)
+			if result.Err != nil {
+				t.Fatalf("mirrorImage() = %v", result.Err)
+			}
+
+			requests := source.Requests()
+			for _, layer := range layers {
+				digest, err := layer.Digest()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := countRequests(requests, "GET /v2/src/app/blobs/"+digest.String()); got != 1 {
+					t.Errorf("read layer %s from the source %d times, want once", digest, got)
+				}
+			}
+
+			for i, dest := range dests {
+				destination := result.Destinations[i]
+				if i == tt.deny {
+					if len(destination.FailedTags) != 1 || destination.FailedTags[0].Reason != slipwayk8sfacebookcomv1.FailureUnauthorized {
+						t.Errorf("destination %d FailedTags = %+v, want v1 Unauthorized", i, destination.FailedTags)
+					}
+					if got := dest.Tags("dst/app"); !reflect.DeepEqual(got, []string{"base"}) {
+						t.Errorf("denied destination %d has tags %v, want [base]", i, got)
+					}
+					continue
+				}
+				if destination.Err != nil {
+					t.Errorf("destination %d error = %v", i, destination.Err)
+				}
+				if !reflect.DeepEqual(destination.MirroredTags, []string{"v1"}) {
+					t.Errorf("destination %d MirroredTags = %v, want [v1]", i, destination.MirroredTags)
+				}
+				if got := countRequests(dest.Requests(), "POST /v2/dst/app/blobs/uploads/"); got < len(layers) {
+					t.Errorf("destination %d initiated %d uploads, want at least %d", i, got, len(layers))
+				}
+				if got := dest.Tags("dst/app"); !reflect.DeepEqual(got, []string{"base", "v1"}) {
+					t.Errorf("destination %d has tags %v, want [base v1]", i, got)
+				}
+			}
+		})
+	}
+}
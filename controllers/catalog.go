@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// ResolveImageNames returns the names of the images described by spec. If
+// spec has an ImageNamePattern, it is matched against the images listed in
+// spec, or if there are none, against the images in the source repository
+// listed by the registry catalog.
+func ResolveImageNames(ctx context.Context, log logr.Logger,
+	spec slipwayk8sfacebookcomv1.ImageMirrorSpec, sourceSecretData SecretData) ([]string, error) {
+	imageNames := spec.AllImageNames()
+	if spec.ImageNamePattern == "" {
+		return imageNames, nil
+	}
+
+	pattern, err := ParsePattern(spec.ImageNamePattern)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to ParsePattern imageNamePattern")
+	}
+
+	if len(imageNames) == 0 {
+		imageNames, err = ListCatalog(ctx, spec.SourceRepo, sourceSecretData)
+		if err != nil {
+			return nil, &RepositoryError{Role: RoleSource, Err: err}
+		}
+		log.Info("Source repository catalog", "imageNames", imageNames)
+	}
+
+	matched := []string{}
+	for _, imageName := range imageNames {
+		if pattern.Matches(imageName) {
+			matched = append(matched, imageName)
+		}
+	}
+	return matched, nil
+}
+
+// ListCatalog lists the images at repoName, using the catalog of its
+// registry. Images are named relative to repoName, so that they can be passed
+// to ListImageTags.
+func ListCatalog(ctx context.Context, repoName string, secretData SecretData) (_ []string, err error) {
+	ctx, span := startSpan(ctx, "ListCatalog", repositoryKey.String(repoName))
+	defer func() { endSpan(ctx, span, err) }()
+
+	registry, prefix, err := repositoryPrefix(repoName)
+	if err != nil {
+		return nil, err
+	}
+
+	repos, err := remote.Catalog(ctx, registry, withTraceContext(ctx, GetRemoteOptions(secretData))...)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to Catalog")
+	}
+
+	imageNames := []string{}
+	for _, r := range repos {
+		if strings.HasPrefix(r, prefix) && len(r) > len(prefix) {
+			imageNames = append(imageNames, strings.TrimPrefix(r, prefix))
+		}
+	}
+	sort.Strings(imageNames)
+	return imageNames, nil
+}
+
+// repositoryPrefix returns the registry of repoName, and the prefix of the
+// repositories within it which hold the images at repoName.
+func repositoryPrefix(repoName string) (name.Registry, string, error) {
+	// Name a placeholder image in repoName, so that the organization is
+	// normalized in the same way as the images it contains.
+	const placeholder = "image"
+	repo, err := name.NewRepository(GetNormalizedName(repoName, placeholder))
+	if err != nil {
+		return name.Registry{}, "", errors.Wrap(err, "unable to NewRepository")
+	}
+
+	return repo.Registry, strings.TrimSuffix(repo.RepositoryStr(), placeholder), nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/pkg/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestResolveImageNames(t *testing.T) {
+	tests := []struct {
+		name          string
+		pageSize      int
+		catalogStatus int
+		catalogCode   string
+		imageNames    []string
+		pattern       string
+		want          []string
+		wantPages     int
+		wantErr       bool
+	}{
+		{
+			name:       "no pattern",
+			imageNames: []string{"app", "missing"},
+			want:       []string{"app", "missing"},
+			wantPages:  0,
+		},
+		{
+			name:      "whole catalog",
+			pattern:   "glob:*",
+			want:      []string{"app", "app-debug", "tools/cli", "web"},
+			wantPages: 1,
+		},
+		{
+			name:      "paginated catalog",
+			pageSize:  2,
+			pattern:   "glob:*",
+			want:      []string{"app", "app-debug", "tools/cli", "web"},
+			wantPages: 3,
+		},
+		{
+			name:      "glob",
+			pageSize:  3,
+			pattern:   "glob:app*",
+			want:      []string{"app", "app-debug"},
+			wantPages: 2,
+		},
+		{
+			name:      "regex",
+			pattern:   "regex:^[a-z]+$",
+			want:      []string{"app", "web"},
+			wantPages: 1,
+		},
+		{
+			name:       "listed images are not looked up",
+			imageNames: []string{"app", "web", "missing"},
+			pattern:    "glob:*",
+			want:       []string{"app", "web", "missing"},
+			wantPages:  0,
+		},
+		{
+			name:      "invalid pattern",
+			pattern:   "regex:(",
+			wantPages: 0,
+			wantErr:   true,
+		},
+		{
+			name:          "unsupported catalog",
+			catalogStatus: http.StatusNotFound,
+			catalogCode:   "UNSUPPORTED",
+			pattern:       "glob:*",
+			wantPages:     1,
+			wantErr:       true,
+		},
+		{
+			name:          "denied catalog",
+			catalogStatus: http.StatusUnauthorized,
+			catalogCode:   "UNAUTHORIZED",
+			pattern:       "glob:*",
+			wantPages:     1,
+			wantErr:       true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			img, err := random.Image(64, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Repositories outside the source are not images of it.
+			for _, repo := range []string{"src/app", "src/app-debug", "src/tools/cli", "src/web", "dst/app", "srcapp"} {
+				r.PushImage(repo, "latest", img)
+			}
+			r.Requests()
+			r.catalogPageSize = tt.pageSize
+			r.catalogStatus = tt.catalogStatus
+			r.catalogCode = tt.catalogCode
+
+			spec := testImageMirror(r).Spec
+			spec.ImageName = ""
+			spec.ImageNames = tt.imageNames
+			spec.ImageNamePattern = tt.pattern
+			got, err := ResolveImageNames(context.Background(), ctrl.Log, spec, SecretData{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ResolveImageNames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if pages := countRequests(r.Requests(), "GET /v2/_catalog"); pages != tt.wantPages {
+				t.Errorf("requested %d catalog pages, want %d", pages, tt.wantPages)
+			}
+			if tt.catalogStatus != 0 {
+				var repositoryErr *RepositoryError
+				if !errors.As(err, &repositoryErr) || repositoryErr.Role != RoleSource {
+					t.Errorf("ResolveImageNames() error = %v, want a source RepositoryError", err)
+				}
+				if got := IsUnauthorized(err); got != (tt.catalogStatus == http.StatusUnauthorized) {
+					t.Errorf("IsUnauthorized() = %v", got)
+				}
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ResolveImageNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListCatalog(t *testing.T) {
+	r := newTestRegistry(t)
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, repo := range []string{"org/team/app", "org/team/web", "org/other/app", "org/teamwork/app"} {
+		r.PushImage(repo, "latest", img)
+	}
+	r.catalogPageSize = 1
+
+	tests := []struct {
+		repo string
+		want []string
+	}{
+		{r.Host() + "/org/team", []string{"app", "web"}},
+		{r.Host() + "/org", []string{"other/app", "team/app", "team/web", "teamwork/app"}},
+		{r.Host() + "/none", []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			got, err := ListCatalog(context.Background(), tt.repo, SecretData{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListCatalog() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
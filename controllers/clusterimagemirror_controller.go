@@ -0,0 +1,158 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/api/kv"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// ClusterImageMirrorReconciler reconciles a ClusterImageMirror object
+type ClusterImageMirrorReconciler struct {
+	client.Client
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// InventoryNamespace is the namespace of the MirrorInventories of every
+	// ClusterImageMirror, which are namespaced.
+	InventoryNamespace string
+
+	// APIReader reads MirrorInventories from the API server rather than the
+	// cache, which may not yet have the shards written by the last sync.
+	APIReader client.Reader
+
+	// Notifications, if set, receives ClusterImageMirrors to be synced immediately
+	// because their source was pushed to.
+	Notifications <-chan event.GenericEvent
+}
+
+// ClusterImageMirrors are created and deleted by cluster admins only, so the
+// manager may read them and write their status and finalizers, but not
+// create or delete them.
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=clusterimagemirrors,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=clusterimagemirrors/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=clusterimagemirrors/finalizers,verbs=update
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=mirrorinventories,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// Reconcile is called when a resource we are watching may have changed.
+func (r *ClusterImageMirrorReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	var clusterImageMirror slipwayk8sfacebookcomv1.ClusterImageMirror
+
+	ctx, span := startSpan(context.Background(), "ClusterImageMirror.Reconcile", kv.String("slipway.name", req.Name))
+	defer span.End()
+	log := r.Log.WithValues("clusterimagemirror", req.Name)
+
+	// Get current version of the spec.
+	if err := r.Get(ctx, req.NamespacedName, &clusterImageMirror); err != nil {
+		log.Error(err, "unable to fetch ClusterImageMirror")
+		if apierrors.IsNotFound(err) {
+			deleteMirrorMetrics(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	return syncMirror(ctx, r.Client, r.Recorder, log, mirrorObject{
+		Object:     &clusterImageMirror,
+		Kind:       "ClusterImageMirror",
+		Meta:       clusterImageMirror.ObjectMeta,
+		Spec:       clusterImageMirror.Spec.ImageMirrorSpec,
+		Status:     &clusterImageMirror.Status,
+		Generation: clusterImageMirror.ObjectMeta.Generation,
+		GetSecretData: func(name string) (SecretData, error) {
+			return getSecretData(ctx, r.Client, clusterImageMirror.Spec.SecretNamespace, name)
+		},
+		InventoryNamespace: r.InventoryNamespace,
+		InventoryReader:    r.APIReader,
+	})
+}
+
+// clusterImageMirrorSecretNames returns the namespaced names of the Secrets
+// referenced by a ClusterImageMirror, in the form namespace/name.
+func clusterImageMirrorSecretNames(obj runtime.Object) []string {
+	clusterImageMirror, ok := obj.(*slipwayk8sfacebookcomv1.ClusterImageMirror)
+	if !ok {
+		return nil
+	}
+
+	var names []string
+	for _, name := range clusterImageMirror.Spec.SecretNames() {
+		names = append(names, types.NamespacedName{
+			Namespace: clusterImageMirror.Spec.SecretNamespace,
+			Name:      name,
+		}.String())
+	}
+	return names
+}
+
+// secretToClusterImageMirrors maps a Secret to reconcile requests for every
+// ClusterImageMirror which references it.
+func (r *ClusterImageMirrorReconciler) secretToClusterImageMirrors(obj handler.MapObject) []reconcile.Request {
+	secretName := types.NamespacedName{Namespace: obj.Meta.GetNamespace(), Name: obj.Meta.GetName()}.String()
+
+	var clusterImageMirrors slipwayk8sfacebookcomv1.ClusterImageMirrorList
+	if err := r.List(context.Background(), &clusterImageMirrors,
+		client.MatchingFields{secretNameIndex: secretName}); err != nil {
+		r.Log.Error(err, "unable to list ClusterImageMirrors for Secret", "secret", secretName)
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(clusterImageMirrors.Items))
+	for _, clusterImageMirror := range clusterImageMirrors.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Name: clusterImageMirror.Name,
+		}})
+	}
+	return requests
+}
+
+// SetupWithManager registers controller with manager and configures shared informer.
+func (r *ClusterImageMirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(&slipwayk8sfacebookcomv1.ClusterImageMirror{},
+		secretNameIndex, clusterImageMirrorSecretNames); err != nil {
+		return err
+	}
+
+	// Watch referenced Secrets, so that rotated credentials, or Secrets
+	// created after the ClusterImageMirror, take effect immediately.
+	builder := ctrl.NewControllerManagedBy(mgr).
+		For(&slipwayk8sfacebookcomv1.ClusterImageMirror{}).
+		Watches(&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.secretToClusterImageMirrors)})
+	if r.Notifications != nil {
+		builder = builder.Watches(&source.Channel{Source: r.Notifications}, &handler.EnqueueRequestForObject{})
+	}
+
+	return builder.WithEventFilter(specChanged).Complete(r)
+}
@@ -0,0 +1,100 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// ClusterImageMirrorValidatorPath is the path at which
+// ClusterImageMirrorValidator is served.
+const ClusterImageMirrorValidatorPath = "/validate-slipway-k8s-facebook-com-v1-clusterimagemirror"
+
+// +kubebuilder:webhook:path=/validate-slipway-k8s-facebook-com-v1-clusterimagemirror,mutating=false,failurePolicy=fail,groups=slipway.k8s.facebook.com,resources=clusterimagemirrors,verbs=create;update,versions=v1,name=vclusterimagemirror.kb.io
+
+// ClusterImageMirrorValidator is a validating admission webhook which
+// rejects ClusterImageMirrors with an invalid spec.
+type ClusterImageMirrorValidator struct {
+	Client  client.Client
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+// Handle validates the ClusterImageMirror in req.
+func (v *ClusterImageMirrorValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var clusterImageMirror slipwayk8sfacebookcomv1.ClusterImageMirror
+	if err := v.decoder.Decode(req, &clusterImageMirror); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	log := v.Log.WithValues("clusterimagemirror", req.Name)
+
+	// A mirror which is being deleted only loses its finalizer, which must
+	// not be blocked by a spec which was valid when it was created.
+	if clusterImageMirror.DeletionTimestamp != nil {
+		return admission.Allowed("")
+	}
+
+	if errs := ValidateClusterImageMirrorSpec(clusterImageMirror.Spec, field.NewPath("spec")); len(errs) > 0 {
+		log.Info("Denied invalid ClusterImageMirror", "errors", errs.ToAggregate().Error())
+		return admission.Denied(errs.ToAggregate().Error())
+	}
+
+	return allowWithSecretWarnings(ctx, v.Client, log, clusterImageMirror.Spec.SecretNamespace,
+		clusterImageMirror.Spec.SecretNames())
+}
+
+// ValidateClusterImageMirrorSpec returns the problems with spec, if any. The
+// paths of the errors are relative to path.
+func ValidateClusterImageMirrorSpec(spec slipwayk8sfacebookcomv1.ClusterImageMirrorSpec, path *field.Path) field.ErrorList {
+	errs := ValidateImageMirrorSpec(spec.ImageMirrorSpec, path)
+
+	if spec.SecretNamespace == "" {
+		if len(spec.SecretNames()) > 0 {
+			errs = append(errs, field.Required(path.Child("secretNamespace"), "secrets are referenced"))
+		}
+	} else {
+		for _, msg := range validation.IsDNS1123Label(spec.SecretNamespace) {
+			errs = append(errs, field.Invalid(path.Child("secretNamespace"), spec.SecretNamespace, msg))
+		}
+	}
+
+	return errs
+}
+
+// SetupWithManager registers the webhook with the manager's webhook server.
+func (v *ClusterImageMirrorValidator) SetupWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+
+	mgr.GetWebhookServer().Register(ClusterImageMirrorValidatorPath, &webhook.Admission{Handler: v})
+	return nil
+}
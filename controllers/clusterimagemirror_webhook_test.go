@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestValidateClusterImageMirrorSpec(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec)
+		want   []string
+	}{
+		{
+			name:   "valid without secrets",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) {},
+			want:   []string{},
+		},
+		{
+			name: "valid with secrets",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) {
+				spec.SecretNamespace = "registry-credentials"
+				spec.SourceSecretName = "docker-hub"
+			},
+			want: []string{},
+		},
+		{
+			name:   "secret namespace without secrets",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) { spec.SecretNamespace = "default" },
+			want:   []string{},
+		},
+		{
+			name:   "source secret without namespace",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) { spec.SourceSecretName = "docker-hub" },
+			want:   []string{"FieldValueRequired spec.secretNamespace"},
+		},
+		{
+			name:   "destination secret without namespace",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) { spec.DestSecretName = "dtr" },
+			want:   []string{"FieldValueRequired spec.secretNamespace"},
+		},
+		{
+			name: "destinations secret without namespace",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) {
+				spec.DestRepo = ""
+				spec.Destinations = []slipwayk8sfacebookcomv1.Destination{{Repo: "registry.example.com/mirror", SecretName: "dtr"}}
+			},
+			want: []string{"FieldValueRequired spec.secretNamespace"},
+		},
+		{
+			name: "invalid secret namespace",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) {
+				spec.SecretNamespace = "Registry_Credentials"
+				spec.SourceSecretName = "docker-hub"
+			},
+			want: []string{"FieldValueInvalid spec.secretNamespace"},
+		},
+		{
+			name: "secret namespace too long",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) {
+				spec.SecretNamespace = strings.Repeat("n", 64)
+			},
+			want: []string{"FieldValueInvalid spec.secretNamespace"},
+		},
+		{
+			name: "invalid image mirror spec",
+			modify: func(spec *slipwayk8sfacebookcomv1.ClusterImageMirrorSpec) {
+				spec.Pattern = "regex:("
+				spec.DestRepo = spec.SourceRepo
+				spec.SourceSecretName = "docker-hub"
+			},
+			want: []string{
+				"FieldValueInvalid spec.destRepo",
+				"FieldValueInvalid spec.pattern",
+				"FieldValueRequired spec.secretNamespace",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := slipwayk8sfacebookcomv1.ClusterImageMirrorSpec{ImageMirrorSpec: validImageMirrorSpec()}
+			tt.modify(&spec)
+			errs := ValidateClusterImageMirrorSpec(spec, field.NewPath("spec"))
+			if got := errorFields(errs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateClusterImageMirrorSpec() = %v, want %v", errs, tt.want)
+			}
+
+			// The paths of the namespaced validation are unchanged, since
+			// its spec is embedded.
+			for _, err := range ValidateImageMirrorSpec(spec.ImageMirrorSpec, field.NewPath("spec")) {
+				if !containsError(errs, err) {
+					t.Errorf("ValidateClusterImageMirrorSpec() is missing %v", err)
+				}
+			}
+		})
+	}
+}
+
+// containsError returns true if errs has an error of the same type and path
+// as err.
+func containsError(errs field.ErrorList, err *field.Error) bool {
+	for _, e := range errs {
+		if e.Type == err.Type && e.Field == err.Field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,319 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// These are the reasons used for ImageMirror conditions.
+const (
+	ReasonSynced             = "Synced"
+	ReasonSyncing            = "Syncing"
+	ReasonIdle               = "Idle"
+	ReasonListed             = "Listed"
+	ReasonUnreachable        = "Unreachable"
+	ReasonUnauthorized       = "Unauthorized"
+	ReasonAuthenticated      = "Authenticated"
+	ReasonSecretError        = "SecretError"
+	ReasonNotChecked         = "NotChecked"
+	ReasonPushNotChecked     = "PushNotChecked"
+	ReasonSourceError        = "SourceUnreachable"
+	ReasonDestinationError   = "DestinationUnreachable"
+	ReasonMirrorFailed       = "MirrorFailed"
+	ReasonTagsFailed         = "TagsFailed"
+	ReasonCredentialsInvalid = "CredentialsInvalid"
+	ReasonNoImages           = "NoImages"
+	ReasonSuspended          = "Suspended"
+	ReasonDeleting           = "Deleting"
+	ReasonDeletionFailed     = "DeletionFailed"
+)
+
+// countFailures returns the number of failed tags in result with reason.
+func countFailures(result DestinationResult, reason slipwayk8sfacebookcomv1.FailureReason) (count int) {
+	for _, failed := range result.FailedTags {
+		if failed.Reason == reason {
+			count++
+		}
+	}
+	return
+}
+
+// setCondition sets a condition on conditions for the given generation.
+func setCondition(conditions *[]slipwayk8sfacebookcomv1.Condition, generation int64,
+	conditionType string, conditionStatus slipwayk8sfacebookcomv1.ConditionStatus, reason, message string) {
+	slipwayk8sfacebookcomv1.SetCondition(conditions, slipwayk8sfacebookcomv1.Condition{
+		Type:               conditionType,
+		Status:             conditionStatus,
+		ObservedGeneration: generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// setSyncingConditions marks the mirror as syncing.
+func setSyncingConditions(status *slipwayk8sfacebookcomv1.ImageMirrorStatus, generation int64) {
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionSyncing,
+		slipwayk8sfacebookcomv1.ConditionTrue, ReasonSyncing, "Mirroring tags from the source repository")
+}
+
+// setSuspendedConditions records that mirroring is suspended. The other
+// conditions describe the last sync before it was suspended.
+func setSuspendedConditions(status *slipwayk8sfacebookcomv1.ImageMirrorStatus, generation int64) {
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionSyncing,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonSuspended, "Mirroring is suspended")
+}
+
+// setSecretConditions records that the source Secret could not be read.
+func setSecretConditions(status *slipwayk8sfacebookcomv1.ImageMirrorStatus, generation int64, err error) {
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionSyncing,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonIdle, "")
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonSecretError, err.Error())
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonSecretError, err.Error())
+}
+
+// setDeletionFailedConditions records that the images in the destinations
+// could not be deleted, which blocks the deletion of the mirror.
+func setDeletionFailedConditions(status *slipwayk8sfacebookcomv1.ImageMirrorStatus, generation int64, err error) {
+	message := fmt.Sprintf("Unable to delete destination images: %v; set the %s annotation to \"true\" "+
+		"to remove the mirror without deleting them", err, slipwayk8sfacebookcomv1.ForceDeleteAnnotation)
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionDeleting,
+		slipwayk8sfacebookcomv1.ConditionTrue, ReasonDeletionFailed, message)
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonDeletionFailed, message)
+}
+
+// setDestinationConditions records the outcome of mirroring to one
+// destination.
+func setDestinationConditions(status *slipwayk8sfacebookcomv1.DestinationStatus, generation int64, result DestinationResult) {
+	conditions := &status.Conditions
+	err := result.Err
+
+	if err == nil {
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionDestinationReachable,
+			slipwayk8sfacebookcomv1.ConditionTrue, ReasonListed, "")
+		if unauthorized := countFailures(result, slipwayk8sfacebookcomv1.FailureUnauthorized); unauthorized > 0 {
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+				slipwayk8sfacebookcomv1.ConditionFalse, ReasonUnauthorized,
+				fmt.Sprintf("%d tags were not authorized", unauthorized))
+		} else if result.PushCheckedSecretVersion == "" {
+			// Listing the destination only proves that the credentials
+			// allow pulling.
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+				slipwayk8sfacebookcomv1.ConditionUnknown, ReasonPushNotChecked,
+				"Pushing to the destination has not been checked")
+		} else {
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+				slipwayk8sfacebookcomv1.ConditionTrue, ReasonAuthenticated, "")
+		}
+
+		if len(result.FailedTags) > 0 {
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+				slipwayk8sfacebookcomv1.ConditionFalse, ReasonTagsFailed,
+				fmt.Sprintf("%d tags mirrored, %d tags failed", len(result.MirroredTags), len(result.FailedTags)))
+			return
+		}
+
+		message := fmt.Sprintf("%d tags mirrored", len(result.MirroredTags))
+		if len(result.PlannedTags) > 0 {
+			message += fmt.Sprintf(", %d tags planned", len(result.PlannedTags))
+		}
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionTrue, ReasonSynced, message)
+		return
+	}
+
+	var serr *SecretError
+	if errors.As(err, &serr) {
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionDestinationReachable,
+			slipwayk8sfacebookcomv1.ConditionUnknown, ReasonNotChecked, "")
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonSecretError, err.Error())
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonSecretError, err.Error())
+		return
+	}
+
+	var cerr *CredentialsError
+	if errors.As(err, &cerr) {
+		// The destination was listed, but the credentials were rejected.
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionDestinationReachable,
+			slipwayk8sfacebookcomv1.ConditionTrue, ReasonListed, "")
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonUnauthorized, err.Error())
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonCredentialsInvalid, err.Error())
+		return
+	}
+
+	unreachableReason := ReasonUnreachable
+	if IsUnauthorized(err) {
+		unreachableReason = ReasonUnauthorized
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonUnauthorized, err.Error())
+	} else {
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+			slipwayk8sfacebookcomv1.ConditionUnknown, ReasonNotChecked, "")
+	}
+
+	message := err.Error()
+	var rerr *RepositoryError
+	if errors.As(err, &rerr) {
+		message = rerr.Err.Error()
+	}
+	setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionDestinationReachable,
+		slipwayk8sfacebookcomv1.ConditionFalse, unreachableReason, message)
+	setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonDestinationError, err.Error())
+}
+
+// namedConditions are the conditions of one part of a mirror, such as an
+// image or a destination, and the name of that part.
+type namedConditions struct {
+	name       string
+	conditions []slipwayk8sfacebookcomv1.Condition
+}
+
+// setAggregateCondition sets conditionType on conditions to True with reason
+// and message if it is true for every part. Otherwise it takes the status
+// and reason of the first part for which it is False (or Unknown), with the
+// messages of all such parts.
+func setAggregateCondition(conditions *[]slipwayk8sfacebookcomv1.Condition, generation int64,
+	parts []namedConditions, conditionType, reason, message string) {
+	aggregate := slipwayk8sfacebookcomv1.ConditionTrue
+	var messages []string
+	for _, part := range parts {
+		condition := slipwayk8sfacebookcomv1.FindCondition(part.conditions, conditionType)
+		if condition == nil || condition.Status == slipwayk8sfacebookcomv1.ConditionTrue {
+			continue
+		}
+
+		if aggregate != slipwayk8sfacebookcomv1.ConditionFalse && condition.Status != aggregate {
+			aggregate = condition.Status
+			reason = condition.Reason
+		}
+
+		detail := condition.Message
+		if detail == "" {
+			detail = condition.Reason
+		}
+		messages = append(messages, part.name+": "+detail)
+	}
+
+	if aggregate != slipwayk8sfacebookcomv1.ConditionTrue {
+		message = strings.Join(messages, "; ")
+	}
+	setCondition(conditions, generation, conditionType, aggregate, reason, message)
+}
+
+// setSourceErrorConditions records on conditions that the source could not
+// be listed, or that the tags listed could not be selected.
+func setSourceErrorConditions(conditions *[]slipwayk8sfacebookcomv1.Condition, generation int64, err error) {
+	var rerr *RepositoryError
+	if errors.As(err, &rerr) && rerr.Role == RoleSource {
+		if IsUnauthorized(err) {
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+				slipwayk8sfacebookcomv1.ConditionFalse, ReasonUnauthorized, err.Error())
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionSourceReachable,
+				slipwayk8sfacebookcomv1.ConditionFalse, ReasonUnauthorized, rerr.Err.Error())
+		} else {
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+				slipwayk8sfacebookcomv1.ConditionUnknown, ReasonNotChecked, "")
+			setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionSourceReachable,
+				slipwayk8sfacebookcomv1.ConditionFalse, ReasonUnreachable, rerr.Err.Error())
+		}
+		setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonSourceError, err.Error())
+		return
+	}
+
+	// The source was listed, so the failure happened while selecting tags.
+	setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionSourceReachable,
+		slipwayk8sfacebookcomv1.ConditionTrue, ReasonListed, "")
+	setCondition(conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonMirrorFailed, err.Error())
+}
+
+// setImageConditions records the outcome of mirroring one image. The
+// conditions of each of its destinations must already have been set by
+// setDestinationConditions.
+func setImageConditions(status *slipwayk8sfacebookcomv1.ImageStatus, generation int64, result ImageResult) {
+	if result.Err != nil {
+		setSourceErrorConditions(&status.Conditions, generation, result.Err)
+		return
+	}
+
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionSourceReachable,
+		slipwayk8sfacebookcomv1.ConditionTrue, ReasonListed, "")
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionCredentialsValid,
+		slipwayk8sfacebookcomv1.ConditionTrue, ReasonAuthenticated, "")
+
+	destinations := make([]namedConditions, 0, len(status.Destinations))
+	for _, destination := range status.Destinations {
+		destinations = append(destinations, namedConditions{name: destination.Repo, conditions: destination.Conditions})
+	}
+	setAggregateCondition(&status.Conditions, generation, destinations, slipwayk8sfacebookcomv1.ConditionReady,
+		ReasonSynced, fmt.Sprintf("%d tags mirrored to %d destinations", len(result.MirroredTags), len(result.Destinations)))
+}
+
+// setMirrorConditions records the outcome of MirrorImages, where err is the
+// error it returned, if any. The conditions of each image must already have
+// been set by setImageConditions.
+func setMirrorConditions(status *slipwayk8sfacebookcomv1.ImageMirrorStatus, generation int64, result MirrorResult, err error) {
+	setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionSyncing,
+		slipwayk8sfacebookcomv1.ConditionFalse, ReasonIdle, "")
+
+	if err != nil {
+		setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionDestinationReachable,
+			slipwayk8sfacebookcomv1.ConditionUnknown, ReasonNotChecked, "")
+		setSourceErrorConditions(&status.Conditions, generation, err)
+		return
+	}
+
+	var images, destinations []namedConditions
+	for _, image := range status.Images {
+		images = append(images, namedConditions{name: image.Name, conditions: image.Conditions})
+		for _, destination := range image.Destinations {
+			destinations = append(destinations, namedConditions{
+				name:       image.Name + " " + destination.Repo,
+				conditions: destination.Conditions,
+			})
+		}
+	}
+
+	setAggregateCondition(&status.Conditions, generation, images, slipwayk8sfacebookcomv1.ConditionSourceReachable,
+		ReasonListed, "")
+	setAggregateCondition(&status.Conditions, generation, destinations, slipwayk8sfacebookcomv1.ConditionDestinationReachable,
+		ReasonListed, "")
+	setAggregateCondition(&status.Conditions, generation, append(images, destinations...),
+		slipwayk8sfacebookcomv1.ConditionCredentialsValid, ReasonAuthenticated, "")
+
+	if len(status.Images) == 0 {
+		setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonNoImages, "No images match imageNamePattern")
+		return
+	}
+	setAggregateCondition(&status.Conditions, generation, images, slipwayk8sfacebookcomv1.ConditionReady,
+		ReasonSynced, fmt.Sprintf("%d tags mirrored from %d images", result.MirroredTagCount(), len(result.Images)))
+}
@@ -0,0 +1,440 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// conditionSummary returns the status and reason of each condition in
+// conditions, keyed by type.
+func conditionSummary(conditions []slipwayk8sfacebookcomv1.Condition) map[string]string {
+	summary := make(map[string]string)
+	for _, condition := range conditions {
+		summary[condition.Type] = string(condition.Status) + " " + condition.Reason
+	}
+	return summary
+}
+
+func TestSetDestinationConditions(t *testing.T) {
+	unauthorized := &transport.Error{StatusCode: http.StatusUnauthorized}
+
+	tests := []struct {
+		name        string
+		result      DestinationResult
+		want        map[string]string
+		wantMessage string
+	}{
+		{
+			name:   "synced",
+			result: DestinationResult{MirroredTags: []string{"v1", "v2"}, PushCheckedSecretVersion: "default"},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:                "True Synced",
+			},
+			wantMessage: "2 tags mirrored",
+		},
+		{
+			name:   "planned",
+			result: DestinationResult{MirroredTags: []string{"v1"}, PlannedTags: []string{"v2"}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "Unknown PushNotChecked",
+				slipwayk8sfacebookcomv1.ConditionReady:                "True Synced",
+			},
+			wantMessage: "1 tags mirrored, 1 tags planned",
+		},
+		{
+			name: "tags failed",
+			result: DestinationResult{
+				MirroredTags:             []string{"v1"},
+				FailedTags:               []slipwayk8sfacebookcomv1.FailedTag{{Tag: "v2", Reason: slipwayk8sfacebookcomv1.FailureNetwork}},
+				PushCheckedSecretVersion: "default",
+			},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False TagsFailed",
+			},
+			wantMessage: "1 tags mirrored, 1 tags failed",
+		},
+		{
+			name: "tags unauthorized",
+			result: DestinationResult{
+				FailedTags:               []slipwayk8sfacebookcomv1.FailedTag{{Tag: "v2", Reason: slipwayk8sfacebookcomv1.FailureUnauthorized}},
+				PushCheckedSecretVersion: "default",
+			},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False TagsFailed",
+			},
+			wantMessage: "0 tags mirrored, 1 tags failed",
+		},
+		{
+			name:   "missing Secret",
+			result: DestinationResult{Err: &SecretError{Role: RoleDestination, Err: errors.New("not found")}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "Unknown NotChecked",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "False SecretError",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False SecretError",
+			},
+			wantMessage: "unable to GetSecretData for destination: not found",
+		},
+		{
+			name:   "push denied",
+			result: DestinationResult{Err: &CredentialsError{Role: RoleDestination, Err: errors.New("denied")}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False CredentialsInvalid",
+			},
+			wantMessage: "invalid credentials for destination: denied",
+		},
+		{
+			name:   "unreachable",
+			result: DestinationResult{Err: &RepositoryError{Role: RoleDestination, Err: errors.New("connection refused")}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "False Unreachable",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "Unknown NotChecked",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False DestinationUnreachable",
+			},
+			wantMessage: "unable to ListImageTags destination: connection refused",
+		},
+		{
+			name:   "listing unauthorized",
+			result: DestinationResult{Err: &RepositoryError{Role: RoleDestination, Err: unauthorized}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False DestinationUnreachable",
+			},
+			wantMessage: "unable to ListImageTags destination: " + unauthorized.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status slipwayk8sfacebookcomv1.DestinationStatus
+			setDestinationConditions(&status, 4, tt.result)
+			if got := conditionSummary(status.Conditions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("conditions = %v, want %v", got, tt.want)
+			}
+			ready := slipwayk8sfacebookcomv1.FindCondition(status.Conditions, slipwayk8sfacebookcomv1.ConditionReady)
+			if ready.Message != tt.wantMessage || ready.ObservedGeneration != 4 {
+				t.Errorf("Ready = %+v, want %q at generation 4", ready, tt.wantMessage)
+			}
+		})
+	}
+}
+
+// TestDestinationConditionTransitions checks that successive syncs only move
+// the transition time of conditions whose status changed.
+func TestDestinationConditionTransitions(t *testing.T) {
+	synced := DestinationResult{MirroredTags: []string{"v1"}, PushCheckedSecretVersion: "default"}
+	failed := DestinationResult{
+		MirroredTags:             []string{"v1"},
+		FailedTags:               []slipwayk8sfacebookcomv1.FailedTag{{Tag: "v2", Reason: slipwayk8sfacebookcomv1.FailureUnauthorized}},
+		PushCheckedSecretVersion: "default",
+	}
+	rotated := DestinationResult{MirroredTags: []string{"v1"}}
+
+	steps := []struct {
+		name   string
+		result DestinationResult
+		// wantChanged are the conditions whose status changed.
+		wantChanged []string
+		want        map[string]string
+	}{
+		{
+			name:   "synced",
+			result: synced,
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:                "True Synced",
+			},
+		},
+		{
+			name:        "tag unauthorized",
+			result:      failed,
+			wantChanged: []string{slipwayk8sfacebookcomv1.ConditionCredentialsValid, slipwayk8sfacebookcomv1.ConditionReady},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False TagsFailed",
+			},
+		},
+		{
+			name:        "credentials rotated",
+			result:      rotated,
+			wantChanged: []string{slipwayk8sfacebookcomv1.ConditionCredentialsValid, slipwayk8sfacebookcomv1.ConditionReady},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "Unknown PushNotChecked",
+				slipwayk8sfacebookcomv1.ConditionReady:                "True Synced",
+			},
+		},
+		{
+			name:        "push checked",
+			result:      synced,
+			wantChanged: []string{slipwayk8sfacebookcomv1.ConditionCredentialsValid},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:                "True Synced",
+			},
+		},
+	}
+
+	var status slipwayk8sfacebookcomv1.DestinationStatus
+	for i, step := range steps {
+		// Date every condition in the past, so that a transition is seen
+		// even within the same second.
+		past := metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		for j := range status.Conditions {
+			status.Conditions[j].LastTransitionTime = past
+		}
+
+		generation := int64(i + 1)
+		setDestinationConditions(&status, generation, step.result)
+		if got := conditionSummary(status.Conditions); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: conditions = %v, want %v", step.name, got, step.want)
+		}
+		if i == 0 {
+			continue
+		}
+		for _, condition := range status.Conditions {
+			changed := !condition.LastTransitionTime.Equal(&past)
+			if want := containsString(step.wantChanged, condition.Type); changed != want {
+				t.Errorf("%s: %s transitioned: %v, want %v", step.name, condition.Type, changed, want)
+			}
+			if condition.ObservedGeneration != generation {
+				t.Errorf("%s: %s observed generation %d, want %d", step.name, condition.Type, condition.ObservedGeneration, generation)
+			}
+		}
+	}
+}
+
+// destinationStatus returns the status of a destination repo after result.
+func destinationStatus(repo string, result DestinationResult) slipwayk8sfacebookcomv1.DestinationStatus {
+	status := slipwayk8sfacebookcomv1.DestinationStatus{Repo: repo}
+	setDestinationConditions(&status, 1, result)
+	return status
+}
+
+func TestSetImageConditions(t *testing.T) {
+	synced := DestinationResult{MirroredTags: []string{"v1"}, PushCheckedSecretVersion: "default"}
+	unchecked := DestinationResult{MirroredTags: []string{"v1"}}
+	failed := DestinationResult{Err: &RepositoryError{Role: RoleDestination, Err: errors.New("connection refused")}}
+
+	tests := []struct {
+		name         string
+		result       ImageResult
+		destinations []DestinationResult
+		want         map[string]string
+		wantMessage  string
+	}{
+		{
+			name:         "all destinations synced",
+			result:       ImageResult{MirroredTags: []string{"v1"}},
+			destinations: []DestinationResult{synced, unchecked},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:  "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid: "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:            "True Synced",
+			},
+			wantMessage: "1 tags mirrored to 2 destinations",
+		},
+		{
+			name:         "one destination failed",
+			result:       ImageResult{},
+			destinations: []DestinationResult{synced, failed},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:  "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid: "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:            "False DestinationUnreachable",
+			},
+			wantMessage: "b: unable to ListImageTags destination: connection refused",
+		},
+		{
+			name:   "source unauthorized",
+			result: ImageResult{Err: &RepositoryError{Role: RoleSource, Err: &transport.Error{StatusCode: http.StatusForbidden}}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:  "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid: "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionReady:            "False SourceUnreachable",
+			},
+		},
+		{
+			name:   "source unreachable",
+			result: ImageResult{Err: &RepositoryError{Role: RoleSource, Err: errors.New("connection refused")}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:  "False Unreachable",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid: "Unknown NotChecked",
+				slipwayk8sfacebookcomv1.ConditionReady:            "False SourceUnreachable",
+			},
+			wantMessage: "unable to ListImageTags source: connection refused",
+		},
+		{
+			name:   "tags not selected",
+			result: ImageResult{Err: errors.New("unable to ParsePattern")},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSourceReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionReady:           "False MirrorFailed",
+			},
+			wantMessage: "unable to ParsePattern",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := slipwayk8sfacebookcomv1.ImageStatus{Name: "app"}
+			for i, destination := range tt.destinations {
+				status.Destinations = append(status.Destinations, destinationStatus(string(rune('a'+i)), destination))
+				tt.result.Destinations = append(tt.result.Destinations, destination)
+			}
+			setImageConditions(&status, 1, tt.result)
+			if got := conditionSummary(status.Conditions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("conditions = %v, want %v", got, tt.want)
+			}
+			ready := slipwayk8sfacebookcomv1.FindCondition(status.Conditions, slipwayk8sfacebookcomv1.ConditionReady)
+			if tt.wantMessage != "" && ready.Message != tt.wantMessage {
+				t.Errorf("Ready message = %q, want %q", ready.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestSetMirrorConditions(t *testing.T) {
+	synced := DestinationResult{MirroredTags: []string{"v1"}, PushCheckedSecretVersion: "default"}
+	unchecked := DestinationResult{MirroredTags: []string{"v1"}}
+	denied := DestinationResult{Err: &CredentialsError{Role: RoleDestination, Err: errors.New("denied")}}
+
+	tests := []struct {
+		name        string
+		images      map[string][]DestinationResult
+		err         error
+		want        map[string]string
+		wantMessage map[string]string
+	}{
+		{
+			name:   "synced",
+			images: map[string][]DestinationResult{"app": {synced}, "web": {synced}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSyncing:              "False Idle",
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:      "True Listed",
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:                "True Synced",
+			},
+			wantMessage: map[string]string{slipwayk8sfacebookcomv1.ConditionReady: "2 tags mirrored from 2 images"},
+		},
+		{
+			name:   "push not checked",
+			images: map[string][]DestinationResult{"app": {synced}, "web": {unchecked}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSyncing:              "False Idle",
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:      "True Listed",
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "Unknown PushNotChecked",
+				slipwayk8sfacebookcomv1.ConditionReady:                "True Synced",
+			},
+			wantMessage: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid: "web dst: Pushing to the destination has not been checked",
+			},
+		},
+		{
+			name:   "a rejection outweighs unchecked credentials",
+			images: map[string][]DestinationResult{"app": {unchecked}, "web": {denied}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSyncing:              "False Idle",
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:      "True Listed",
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False CredentialsInvalid",
+			},
+			wantMessage: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid: "app dst: Pushing to the destination has not been checked; " +
+					"web dst: invalid credentials for destination: denied",
+			},
+		},
+		{
+			name: "no images",
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSyncing:              "False Idle",
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:      "True Listed",
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "True Listed",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "True Authenticated",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False NoImages",
+			},
+		},
+		{
+			name: "catalog unauthorized",
+			err:  &RepositoryError{Role: RoleSource, Err: &transport.Error{StatusCode: http.StatusUnauthorized}},
+			want: map[string]string{
+				slipwayk8sfacebookcomv1.ConditionSyncing:              "False Idle",
+				slipwayk8sfacebookcomv1.ConditionSourceReachable:      "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionDestinationReachable: "Unknown NotChecked",
+				slipwayk8sfacebookcomv1.ConditionCredentialsValid:     "False Unauthorized",
+				slipwayk8sfacebookcomv1.ConditionReady:                "False SourceUnreachable",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status slipwayk8sfacebookcomv1.ImageMirrorStatus
+			var result MirrorResult
+			for _, imageName := range []string{"app", "web"} {
+				destinations, ok := tt.images[imageName]
+				if !ok {
+					continue
+				}
+				image := ImageResult{Name: imageName, MirroredTags: []string{"v1"}, Destinations: destinations}
+				imageStatus := slipwayk8sfacebookcomv1.ImageStatus{Name: imageName}
+				for _, destination := range destinations {
+					imageStatus.Destinations = append(imageStatus.Destinations, destinationStatus("dst", destination))
+				}
+				setImageConditions(&imageStatus, 1, image)
+				status.Images = append(status.Images, imageStatus)
+				result.Images = append(result.Images, image)
+			}
+
+			setMirrorConditions(&status, 1, result, tt.err)
+			if got := conditionSummary(status.Conditions); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("conditions = %v, want %v", got, tt.want)
+			}
+			for conditionType, want := range tt.wantMessage {
+				condition := slipwayk8sfacebookcomv1.FindCondition(status.Conditions, conditionType)
+				if condition.Message != want {
+					t.Errorf("%s message = %q, want %q", conditionType, condition.Message, want)
+				}
+			}
+		})
+	}
+}
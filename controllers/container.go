@@ -18,14 +18,24 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/authn/k8schain"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/api/kv"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	// This dependency was copied into the operator to avoid client-go
 	// dependency conflicts between flux and kubebuilder. This may or
@@ -94,9 +104,13 @@ func Difference(a, b []string) (c []string) {
 }
 
 // Filter takes a slice of tags and returns a new slice such that each tag
-// matches the policy determined by pattern.
-func Filter(tags []string, pattern string) []string {
-	p := NewPattern(pattern)
+// matches the policy determined by pattern, and an error if pattern is
+// invalid.
+func Filter(tags []string, pattern string) ([]string, error) {
+	p, err := ParsePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
 
 	passed := make([]string, 0)
 	for _, tag := range tags {
@@ -105,28 +119,36 @@ func Filter(tags []string, pattern string) []string {
 		}
 	}
 
-	return passed
+	return passed, nil
 }
 
-// SecretData is used to pass credentials internally.
-type SecretData struct {
-	Username string
-	Password string
+// GetRemoteOptions returns a slice of remote.Options which authenticate with
+// the credentials in data matching each registry, falling back to the docker
+// keychain.
+func GetRemoteOptions(data SecretData) (options []remote.Option) {
+	return append(options, remote.WithAuthFromKeychain(GetKeychain(data)), remote.WithTransport(registryTransport))
 }
 
-// GetRemoteOptions returns a slice of remote.Options including the docker keychain,
-// and iff they exist in the Secret map data, other credentials.
-func GetRemoteOptions(data SecretData) (options []remote.Option) {
-	if data.Username != "" && data.Password != "" {
-		options = append(options, remote.WithAuth(&authn.Basic{
-			Username: data.Username,
-			Password: data.Password,
-		}))
-		return
+// GetKeychain returns a keychain which resolves to the credentials in data,
+// iff they exist, and otherwise to the docker keychain.
+func GetKeychain(data SecretData) authn.Keychain {
+	return secretKeychain{data: data}
+}
+
+// CheckPushPermission returns an error if the credentials in data do not allow
+// pushing to imageName at repoName.
+func CheckPushPermission(ctx context.Context, repoName, imageName string, data SecretData) (err error) {
+	normalName := GetNormalizedName(repoName, imageName)
+	ctx, span := startSpan(ctx, "CheckPushPermission", repositoryKey.String(normalName))
+	defer func() { endSpan(ctx, span, err) }()
+
+	repo, err := name.NewRepository(normalName)
+	if err != nil {
+		return errors.Wrap(err, "unable to NewRepository")
 	}
 
-	options = append(options, remote.WithAuthFromKeychain(authn.DefaultKeychain))
-	return
+	return remote.CheckPushPermission(repo.Tag("latest"), GetKeychain(data),
+		&tracingTransport{ctx: ctx, inner: meteredTransport})
 }
 
 // GetNormalizedName returns a "fully qualified image reference". That is, a
@@ -141,11 +163,16 @@ func GetNormalizedName(registryName, imageName string) (normalName string) {
 	return
 }
 
-// ListImageTags lists tags for the imageName at repoName
-func ListImageTags(ctx context.Context, repoName, imageName string, secretData SecretData, log logr.Logger) (string, []string, error) {
+// ListImageTags lists tags for the imageName at repoName. If the repository
+// does not exist, it returns an empty name and no tags.
+func ListImageTags(ctx context.Context, repoName, imageName string, secretData SecretData, log logr.Logger) (_ string, _ []string, err error) {
 	options := GetRemoteOptions(secretData)
 	normalName := GetNormalizedName(repoName, imageName)
 
+	ctx, span := startSpan(ctx, "ListImageTags", repositoryKey.String(normalName))
+	defer func() { endSpan(ctx, span, err) }()
+	options = withTraceContext(ctx, options)
+
 	repo, err := name.NewRepository(normalName)
 	if err != nil {
 		return "", nil, errors.Wrap(err, "unable to NewRegistry")
@@ -153,7 +180,7 @@ func ListImageTags(ctx context.Context, repoName, imageName string, secretData S
 
 	tags, err := remote.ListWithContext(ctx, repo, options...)
 	if err != nil {
-		if strings.ContainsAny(err.Error(), "repository name not known to registry") {
+		if IsNameUnknown(err) {
 			log.Info("NAME_UNKNOWN: [" + repoName + imageName + "] repository does not exist, please create it first")
 			return "", []string{}, nil
 		}
@@ -161,9 +188,431 @@ func ListImageTags(ctx context.Context, repoName, imageName string, secretData S
 		return "", nil, errors.Wrap(err, "unable to ListWithContext")
 	}
 
+	span.SetAttributes(kv.Int("slipway.tags", len(tags)))
 	return normalName, tags, nil
 }
 
+// ParsePlatform parses a platform of the form os/arch[/variant], e.g.
+// linux/arm64/v8, and returns the corresponding v1.Platform.
+func ParsePlatform(platform string) (v1.Platform, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return v1.Platform{}, errors.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+	}
+
+	p := v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// ParsePlatforms parses each of platforms using ParsePlatform.
+func ParsePlatforms(platforms []string) ([]v1.Platform, error) {
+	parsed := make([]v1.Platform, 0, len(platforms))
+	for _, platform := range platforms {
+		p, err := ParsePlatform(platform)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// MatchesPlatform returns true if given matches any of required. The variant
+// is only compared when it is specified by the required platform.
+func MatchesPlatform(given *v1.Platform, required []v1.Platform) bool {
+	if given == nil {
+		return false
+	}
+
+	for _, r := range required {
+		if given.OS != r.OS || given.Architecture != r.Architecture {
+			continue
+		}
+		if r.Variant != "" && given.Variant != r.Variant {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// FilterIndex returns a new index containing only the child manifests of idx
+// which match one of platforms. The media type of idx is preserved, so that a
+// Docker manifest list remains a manifest list.
+func FilterIndex(idx v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to IndexManifest")
+	}
+
+	mediaType, err := idx.MediaType()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to MediaType")
+	}
+
+	var adds []mutate.IndexAddendum
+	for _, desc := range manifest.Manifests {
+		if !MatchesPlatform(desc.Platform, platforms) {
+			continue
+		}
+
+		var child mutate.Appendable
+		switch desc.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			child, err = idx.ImageIndex(desc.Digest)
+		default:
+			child, err = idx.Image(desc.Digest)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get child manifest %s", desc.Digest)
+		}
+
+		adds = append(adds, mutate.IndexAddendum{Add: child, Descriptor: desc})
+	}
+
+	if len(adds) == 0 {
+		return nil, errors.New("no child manifests match the requested platforms")
+	}
+
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), mediaType), nil
+}
+
+// Manifest is either a single image or an image index fetched from a
+// registry, ready to be written elsewhere.
+type Manifest struct {
+	Image v1.Image
+	Index v1.ImageIndex
+}
+
+// Digest returns the digest of the manifest.
+func (m Manifest) Digest() (string, error) {
+	var (
+		h   v1.Hash
+		err error
+	)
+	if m.Index != nil {
+		h, err = m.Index.Digest()
+	} else {
+		h, err = m.Image.Digest()
+	}
+	if err != nil {
+		return "", err
+	}
+	return h.String(), nil
+}
+
+// Size returns the total size of the manifest and everything it references,
+// which is what is written to a registry which has none of it.
+func (m Manifest) Size() (int64, error) {
+	if m.Index != nil {
+		return indexSize(m.Index)
+	}
+	return imageSize(m.Image)
+}
+
+// imageSize returns the total size of the manifest, config and layers of img.
+func imageSize(img v1.Image) (int64, error) {
+	size, err := img.Size()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to Size image")
+	}
+
+	manifest, err := img.Manifest()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to Manifest")
+	}
+	size += manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+	return size, nil
+}
+
+// indexSize returns the total size of idx and each of its children.
+func indexSize(idx v1.ImageIndex) (int64, error) {
+	size, err := idx.Size()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to Size index")
+	}
+
+	manifest, err := idx.IndexManifest()
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to IndexManifest")
+	}
+
+	for _, desc := range manifest.Manifests {
+		var childSize int64
+		switch desc.MediaType {
+		case types.OCIImageIndex, types.DockerManifestList:
+			child, err := idx.ImageIndex(desc.Digest)
+			if err != nil {
+				return 0, errors.Wrap(err, "unable to ImageIndex")
+			}
+			childSize, err = indexSize(child)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			child, err := idx.Image(desc.Digest)
+			if err != nil {
+				return 0, errors.Wrap(err, "unable to Image")
+			}
+			childSize, err = imageSize(child)
+			if err != nil {
+				return 0, err
+			}
+		}
+		size += childSize
+	}
+	return size, nil
+}
+
+// cachedIndex wraps an image index so that each child manifest is fetched
+// once, and the layers of each child image are cached.
+type cachedIndex struct {
+	index   v1.ImageIndex
+	cache   cache.Cache
+	images  map[v1.Hash]v1.Image
+	indexes map[v1.Hash]v1.ImageIndex
+}
+
+func newCachedIndex(idx v1.ImageIndex, c cache.Cache) *cachedIndex {
+	return &cachedIndex{
+		index:   idx,
+		cache:   c,
+		images:  make(map[v1.Hash]v1.Image),
+		indexes: make(map[v1.Hash]v1.ImageIndex),
+	}
+}
+
+// MediaType implements v1.ImageIndex.
+func (i *cachedIndex) MediaType() (types.MediaType, error) {
+	return i.index.MediaType()
+}
+
+// Digest implements v1.ImageIndex.
+func (i *cachedIndex) Digest() (v1.Hash, error) {
+	return i.index.Digest()
+}
+
+// Size implements v1.ImageIndex.
+func (i *cachedIndex) Size() (int64, error) {
+	return i.index.Size()
+}
+
+// IndexManifest implements v1.ImageIndex.
+func (i *cachedIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return i.index.IndexManifest()
+}
+
+// RawManifest implements v1.ImageIndex.
+func (i *cachedIndex) RawManifest() ([]byte, error) {
+	return i.index.RawManifest()
+}
+
+// Image implements v1.ImageIndex.
+func (i *cachedIndex) Image(h v1.Hash) (v1.Image, error) {
+	if img, ok := i.images[h]; ok {
+		return img, nil
+	}
+	img, err := i.index.Image(h)
+	if err != nil {
+		return nil, err
+	}
+	i.images[h] = cache.Image(img, i.cache)
+	return i.images[h], nil
+}
+
+// ImageIndex implements v1.ImageIndex.
+func (i *cachedIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	if idx, ok := i.indexes[h]; ok {
+		return idx, nil
+	}
+	idx, err := i.index.ImageIndex(h)
+	if err != nil {
+		return nil, err
+	}
+	i.indexes[h] = newCachedIndex(idx, i.cache)
+	return i.indexes[h], nil
+}
+
+// Write pushes the manifest, and everything it references, to ref.
+func (m Manifest) Write(ref name.Reference, options []remote.Option) error {
+	if m.Index != nil {
+		return errors.Wrap(remote.WriteIndex(ref, m.Index, options...), "unable to WriteIndex")
+	}
+	return errors.Wrap(remote.Write(ref, m.Image, options...), "unable to Write")
+}
+
+// GetManifest fetches the manifest referenced by ref. When the manifest is a
+// multi-arch manifest list or OCI image index, the whole index is returned so
+// that its digest is unchanged, unless platforms is non-empty, in which case
+// only the matching children are included in a filtered index. If c is not
+// nil, the layers are cached in c as they are read.
+func GetManifest(ref name.Reference, platforms []v1.Platform, options []remote.Option, c cache.Cache) (Manifest, error) {
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return Manifest{}, errors.Wrap(err, "unable to Get")
+	}
+
+	switch desc.MediaType {
+	case types.OCIImageIndex, types.DockerManifestList:
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return Manifest{}, errors.Wrap(err, "unable to ImageIndex")
+		}
+		if c != nil {
+			idx = newCachedIndex(idx, c)
+		}
+
+		if len(platforms) > 0 {
+			idx, err = FilterIndex(idx, platforms)
+			if err != nil {
+				return Manifest{}, errors.Wrap(err, "unable to FilterIndex")
+			}
+		}
+		return Manifest{Index: idx}, nil
+	default:
+		img, err := desc.Image()
+		if err != nil {
+			return Manifest{}, errors.Wrap(err, "unable to Image")
+		}
+		if c != nil {
+			img = cache.Image(img, c)
+		}
+		return Manifest{Image: img}, nil
+	}
+}
+
+// GetDigest returns the digest of the manifest referenced by ref, as it is
+// stored in the registry.
+func GetDigest(ref name.Reference, options []remote.Option) (string, error) {
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to Get")
+	}
+	return desc.Digest.String(), nil
+}
+
+// maxCachedInfos is the most entries kept in infoCache.
+const maxCachedInfos = 10000
+
+// infoCache holds the Info which GetInfo read for each manifest, by its digest
+// and platform. A manifest never changes, so neither does its Info, and a tag
+// which has not moved only costs its manifest on later syncs.
+var infoCache = struct {
+	sync.Mutex
+	entries map[string]cachedInfo
+}{entries: make(map[string]cachedInfo)}
+
+// cachedInfo is an entry of infoCache.
+type cachedInfo struct {
+	info Info
+	err  error
+}
+
+// GetInfo fetches the config of the image referenced by ref, and returns its
+// labels and creation time. When ref is a multi-arch index, the image for the
+// first of platforms (or linux/amd64 if there are none) is used. The creation
+// time is taken from the org.opencontainers.image.created or
+// org.label-schema.build-date labels, falling back to the config created
+// field. If a label is malformed, the info is returned along with a
+// *LabelTimestampFormatError. The config of each manifest is only fetched
+// once.
+func GetInfo(ref name.Reference, platforms []v1.Platform, options []remote.Option) (Info, error) {
+	info := Info{LastFetched: time.Now()}
+	platform := "linux/amd64"
+	if len(platforms) > 0 {
+		options = append(options[:len(options):len(options)], remote.WithPlatform(platforms[0]))
+		platform = platforms[0].OS + "/" + platforms[0].Architecture + "/" + platforms[0].Variant
+	}
+
+	desc, err := remote.Get(ref, options...)
+	if err != nil {
+		return info, errors.Wrap(err, "unable to Get")
+	}
+	key := desc.Digest.String() + " " + platform
+	infoCache.Lock()
+	cached, ok := infoCache.entries[key]
+	infoCache.Unlock()
+	if ok {
+		return cached.info, cached.err
+	}
+
+	img, err := desc.Image()
+	if err != nil {
+		return info, errors.Wrap(err, "unable to Image")
+	}
+
+	digest, err := img.Digest()
+	if err != nil {
+		return info, errors.Wrap(err, "unable to Digest")
+	}
+	info.Digest = digest.String()
+
+	config, err := img.ConfigFile()
+	if err != nil {
+		return info, errors.Wrap(err, "unable to ConfigFile")
+	}
+
+	// Labels decodes the timestamp labels we are interested in from JSON,
+	// and keeps those which are well formed.
+	var labelErr error
+	if len(config.Config.Labels) > 0 {
+		raw, err := json.Marshal(config.Config.Labels)
+		if err != nil {
+			return info, errors.Wrap(err, "unable to Marshal labels")
+		}
+		labelErr = json.Unmarshal(raw, &info.Labels)
+	}
+
+	switch {
+	case !info.Labels.Created.IsZero():
+		info.CreatedAt = info.Labels.Created
+	case !info.Labels.BuildDate.IsZero():
+		info.CreatedAt = info.Labels.BuildDate
+	case config.Created.Unix() > 0:
+		// Reproducible builds set created to the epoch, which says
+		// nothing about the age of the image.
+		info.CreatedAt = config.Created.Time
+	}
+
+	infoCache.Lock()
+	if len(infoCache.entries) >= maxCachedInfos {
+		for evicted := range infoCache.entries {
+			delete(infoCache.entries, evicted)
+			break
+		}
+	}
+	infoCache.entries[key] = cachedInfo{info: info, err: labelErr}
+	infoCache.Unlock()
+
+	return info, labelErr
+}
+
+// CopyImage copies the manifest referenced by sourceRef to destRef, as
+// described by GetManifest, and returns the digest which was written.
+func CopyImage(sourceRef, destRef name.Reference, platforms []v1.Platform, sourceOptions, destOptions []remote.Option) (string, error) {
+	manifest, err := GetManifest(sourceRef, platforms, sourceOptions, nil)
+	if err != nil {
+		return "", err
+	}
+
+	digest, err := manifest.Digest()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to Digest")
+	}
+
+	if err := manifest.Write(destRef, destOptions); err != nil {
+		return "", err
+	}
+
+	return digest, nil
+}
+
 // MirrorImagesOptions are options for MirrorImages()
 type MirrorImagesOptions struct {
 	ctx context.Context
@@ -177,65 +626,820 @@ type MirrorImagesOptions struct {
 	destSecretData   SecretData
 }
 
-// MirrorImages lists all tags for the image from the source repository and
-// writes them to the destination repository iff they are not already there,
-// and they match pattern. Returns the tags already mirrored, and an error, if
-// any.
+// SecretGetter returns the credentials in the Secret named name, or empty
+// credentials if name is empty.
+type SecretGetter func(name string) (SecretData, error)
+
+// DestinationResult is the outcome of mirroring to one destination.
+type DestinationResult struct {
+	// Repo is the repository of the destination.
+	Repo string
+	// MirroredTags are the matching tags which exist in the destination.
+	MirroredTags []string
+	// Tags records the source and destination digest of each mirrored tag.
+	Tags []slipwayk8sfacebookcomv1.TagStatus
+	// DriftedTags are tags whose destination digest differs from the source,
+	// and which were left in place because of the DriftPolicy.
+	DriftedTags []string
+	// FailedTags are tags which could not be mirrored, including those
+	// which are waiting to be retried.
+	FailedTags []slipwayk8sfacebookcomv1.FailedTag
+	// CreatedTags are the tags which slipway created in the destination.
+	CreatedTags []string
+	// PrunedTags are the tags which were deleted by the Retention policy.
+	PrunedTags []string
+	// PrunableTags are the tags which a dry run of the Retention policy
+	// would have deleted.
+	PrunableTags []string
+	// FailedPrunes are tags which could not be deleted.
+	FailedPrunes []slipwayk8sfacebookcomv1.FailedTag
+	// PlannedTags are the tags which a dry run would have copied.
+	PlannedTags []string
+	// PushCheckedSecretVersion identifies the credentials which this or an
+	// earlier sync found to allow pushing, as secretVersion does, or is
+	// empty if they have not been checked.
+	PushCheckedSecretVersion string
+	// CopiedTags are the tags which were copied or resynced by this sync.
+	CopiedTags []slipwayk8sfacebookcomv1.TagStatus
+	// CopiedBytes is the total size of the images in CopiedTags.
+	CopiedBytes int64
+	// CopyDurations are how long each of CopiedTags took to write.
+	CopyDurations []time.Duration
+	// Err is set if the destination could not be synced at all, in which
+	// case the fields above are carried over from its previous status and
+	// inventory.
+	Err error
+}
+
+// ImageResult is the outcome of mirroring one source image.
+type ImageResult struct {
+	// Name is the name of the image in the source.
+	Name string
+	// MirroredTags are the matching tags which exist in every destination.
+	MirroredTags []string
+	// SelectedTags are the source tags which were selected for mirroring.
+	SelectedTags []string
+	// SkippedTags are the other source tags, and why they were skipped.
+	SkippedTags []slipwayk8sfacebookcomv1.SkippedTag
+	// Destinations holds the outcome for each destination.
+	Destinations []DestinationResult
+	// Err is set if the source image could not be listed, or its tags
+	// could not be selected, in which case nothing was mirrored.
+	Err error
+}
+
+// MirrorResult is the outcome of MirrorImages.
+type MirrorResult struct {
+	// Images holds the outcome for each source image.
+	Images []ImageResult
+}
+
+// Err returns an error describing the images and destinations which could
+// not be synced at all, or nil if there were none.
+func (r MirrorResult) Err() error {
+	var messages []string
+	for _, image := range r.Images {
+		if image.Err != nil {
+			messages = append(messages, image.Name+": "+image.Err.Error())
+			continue
+		}
+		for _, destination := range image.Destinations {
+			if destination.Err != nil {
+				messages = append(messages, image.Name+" "+destination.Repo+": "+destination.Err.Error())
+			}
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// NextRetryTime returns the earliest time at which a failed tag should be
+// retried, or the zero time if there are no failed tags. Images and
+// destinations which could not be synced at all are ignored.
+func (r MirrorResult) NextRetryTime() (next time.Time) {
+	for _, image := range r.Images {
+		if image.Err != nil {
+			continue
+		}
+		for _, destination := range image.Destinations {
+			if destination.Err != nil {
+				continue
+			}
+			for _, failures := range [][]slipwayk8sfacebookcomv1.FailedTag{destination.FailedTags, destination.FailedPrunes} {
+				for _, failed := range failures {
+					if next.IsZero() || failed.NextRetryTime.Time.Before(next) {
+						next = failed.NextRetryTime.Time
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// MirroredTagCount returns the number of tags mirrored to every destination,
+// summed over all images.
+func (r MirrorResult) MirroredTagCount() (count int) {
+	for _, image := range r.Images {
+		count += len(image.MirroredTags)
+	}
+	return
+}
+
+// sourceTag fetches the manifest of a tag in the source repository at most
+// once, however many destinations it is written to.
+type sourceTag struct {
+	name      string
+	platforms []v1.Platform
+	options   []remote.Option
+	cache     cache.Cache
+
+	fetched  bool
+	manifest Manifest
+	digest   string
+	err      error
+}
+
+// Manifest returns the manifest of the tag, and its digest. It is fetched
+// within ctx the first time.
+func (s *sourceTag) Manifest(ctx context.Context) (Manifest, string, error) {
+	if s.fetched {
+		return s.manifest, s.digest, s.err
+	}
+	s.fetched = true
+
+	ctx, span := startSpan(ctx, "GetManifest", repositoryKey.String(s.name))
+	defer func() {
+		span.SetAttributes(digestKey.String(s.digest))
+		endSpan(ctx, span, s.err)
+	}()
+
+	ref, err := name.ParseReference(s.name)
+	if err != nil {
+		s.err = errors.Wrap(err, "unable to ParseReference source")
+		return s.manifest, s.digest, s.err
+	}
+
+	s.manifest, s.err = GetManifest(ref, s.platforms, withTraceContext(ctx, s.options), s.cache)
+	if s.err != nil {
+		s.err = errors.Wrap(s.err, "unable to GetManifest source")
+		return s.manifest, s.digest, s.err
+	}
+
+	s.digest, s.err = s.manifest.Digest()
+	if s.err != nil {
+		s.err = errors.Wrap(s.err, "unable to Digest source")
+	}
+	return s.manifest, s.digest, s.err
+}
+
+// destinationMirror holds everything needed to mirror individual tags of an
+// image to one destination.
+type destinationMirror struct {
+	log      logr.Logger
+	destName string
+	options  []remote.Option
+	policy   slipwayk8sfacebookcomv1.DriftPolicy
+	dryRun   bool
+	existing map[string]bool
+	destTags map[string]string
+	previous map[string]slipwayk8sfacebookcomv1.TagStatus
+	failures map[string]slipwayk8sfacebookcomv1.FailedTag
+	result   DestinationResult
+
+	// created are the tags which slipway created in the destination, and
+	// pruneFailures are those which could not be deleted. Both are named as
+	// in the destination.
+	created       []string
+	pruneFailures map[string]slipwayk8sfacebookcomv1.FailedTag
+
+	// repo, imageName and data are checked for push permission once
+	// secretVersion changes, which pushChecked records.
+	repo          string
+	imageName     string
+	data          SecretData
+	secretVersion string
+	pushChecked   bool
+
+	// lastStatus and lastInventory are carried over if the destination
+	// fails as a whole; either may be nil.
+	lastStatus    *slipwayk8sfacebookcomv1.DestinationStatus
+	lastInventory *slipwayk8sfacebookcomv1.DestinationInventory
+}
+
+// newDestinationMirror lists imageName in the destination. If that fails, the
+// error is recorded in the result and the previous status and inventory of
+// the destination are carried over. destTags maps each source tag to its name
+// in the destination.
+func newDestinationMirror(ctx context.Context, log logr.Logger,
+	imageMirror slipwayk8sfacebookcomv1.ImageMirror, inventory Inventory, imageName string,
+	destination slipwayk8sfacebookcomv1.Destination, getSecretData SecretGetter,
+	selectedTags []string, destTags map[string]string) *destinationMirror {
+	m := &destinationMirror{
+		log:      log.WithValues("destination", destination.Repo),
+		policy:   destination.DriftPolicy,
+		dryRun:   imageMirror.Spec.DryRun,
+		existing: make(map[string]bool),
+		destTags: destTags,
+		previous: make(map[string]slipwayk8sfacebookcomv1.TagStatus),
+		failures: make(map[string]slipwayk8sfacebookcomv1.FailedTag),
+		result:   DestinationResult{Repo: destination.Repo, MirroredTags: []string{}},
+
+		pruneFailures: make(map[string]slipwayk8sfacebookcomv1.FailedTag),
+	}
+	if m.policy == "" {
+		m.policy = slipwayk8sfacebookcomv1.DriftPolicyResync
+	}
+
+	// Remember what we knew about each tag, so that copy times are not lost
+	// for tags which are already up to date, and tags which are backing off
+	// keep their last known digests. Failures are recorded in status, and
+	// every tag in the inventory.
+	if image := imageMirror.Status.FindImage(imageName); image != nil {
+		m.lastStatus = image.FindDestination(destination.Repo)
+	}
+	if m.lastStatus != nil {
+		for _, failed := range m.lastStatus.FailedTags {
+			m.failures[failed.Tag] = failed
+		}
+		for _, failed := range m.lastStatus.FailedPrunes {
+			m.pruneFailures[failed.Tag] = failed
+		}
+	}
+	if image, ok := inventory[imageName]; ok {
+		m.lastInventory = image.FindDestination(destination.Repo)
+	}
+	if m.lastInventory != nil {
+		for _, status := range m.lastInventory.Tags {
+			m.previous[status.Tag] = status
+		}
+		m.created = m.lastInventory.CreatedTags
+	}
+
+	if err := m.prepare(ctx, imageMirror.Spec.DestinationImageName(imageName), destination, getSecretData, selectedTags); err != nil {
+		m.fail(err)
+		return m
+	}
+
+	// Credentials which were already found to allow pushing are trusted
+	// until the Secret changes. Otherwise pushing is checked now, even if
+	// nothing is written, unless this is a dry run.
+	if m.lastStatus != nil && m.lastStatus.PushCheckedSecretVersion == m.secretVersion {
+		m.pushChecked = true
+		m.result.PushCheckedSecretVersion = m.secretVersion
+	} else if !m.dryRun {
+		_ = m.checkPush(ctx)
+	}
+	return m
+}
+
+// secretVersion identifies the credentials in data, which were read from the
+// Secret named secretName, if any.
+func secretVersion(secretName string, data SecretData) string {
+	if secretName == "" {
+		return "default"
+	}
+	return secretName + "@" + data.ResourceVersion
+}
+
+// fail records that the destination could not be synced at all, and carries
+// over its previous status and inventory.
+func (m *destinationMirror) fail(err error) {
+	m.result = DestinationResult{Repo: m.result.Repo, MirroredTags: []string{}, Err: err}
+	if m.lastStatus != nil {
+		m.result.DriftedTags = m.lastStatus.DriftedTags
+		m.result.FailedTags = m.lastStatus.FailedTags
+		m.result.FailedPrunes = m.lastStatus.FailedPrunes
+		m.result.PushCheckedSecretVersion = m.lastStatus.PushCheckedSecretVersion
+	}
+	if m.lastInventory != nil {
+		m.result.MirroredTags = m.lastInventory.MirroredTags
+		m.result.Tags = m.lastInventory.Tags
+		m.result.CreatedTags = m.lastInventory.CreatedTags
+	}
+}
+
+// prepare reads the credentials of destination and lists its tags.
+func (m *destinationMirror) prepare(ctx context.Context, imageName string,
+	destination slipwayk8sfacebookcomv1.Destination, getSecretData SecretGetter, selectedTags []string) error {
+	data, err := getSecretData(destination.SecretName)
+	if err != nil {
+		return &SecretError{Role: RoleDestination, Err: err}
+	}
+	m.repo, m.imageName, m.data = destination.Repo, imageName, data
+	m.secretVersion = secretVersion(destination.SecretName, data)
+
+	destName, destTags, err := ListImageTags(ctx, destination.Repo, imageName, data, m.log)
+	if err != nil {
+		return &RepositoryError{Role: RoleDestination, Err: err}
+	}
+	if destName == "" {
+		return &RepositoryError{Role: RoleDestination, Err: ErrRepositoryNotFound}
+	}
+	m.log.Info("Dest repository tags", "destTags", destTags)
+
+	m.destName = destName
+	m.options = GetRemoteOptions(data)
+
+	// Forget created tags which have since been deleted by someone else.
+	m.created = Intersection(m.created, destTags)
+
+	// Selected tags are compared by the name they are given in the
+	// destination.
+	present := make(map[string]bool, len(destTags))
+	for _, tag := range destTags {
+		present[tag] = true
+	}
+
+	var existingTags, missingTags []string
+	for _, tag := range selectedTags {
+		if present[m.destTag(tag)] {
+			existingTags = append(existingTags, tag)
+			m.existing[tag] = true
+		} else {
+			missingTags = append(missingTags, tag)
+		}
+	}
+	m.log.Info("Existing destination tags", "existingTags", existingTags)
+	m.log.Info("Missing destination tags", "missingTags", missingTags)
+
+	return nil
+}
+
+// checkPush checks that the credentials of the destination allow pushing,
+// since listing it only proves that they allow pulling. It is called before
+// each write, but only checks once, and not at all if an earlier sync checked
+// the same credentials, so that syncs which write nothing do not start an
+// upload. If pushing is not allowed, the destination fails as a whole, and
+// the error is returned.
+func (m *destinationMirror) checkPush(ctx context.Context) error {
+	if !m.pushChecked {
+		m.pushChecked = true
+		if err := CheckPushPermission(ctx, m.repo, m.imageName, m.data); err != nil {
+			m.fail(&CredentialsError{Role: RoleDestination, Err: err})
+			m.result.PushCheckedSecretVersion = ""
+		} else {
+			m.result.PushCheckedSecretVersion = m.secretVersion
+		}
+	}
+	return m.result.Err
+}
+
+// destTag returns the name of the source tag in the destination.
+func (m *destinationMirror) destTag(tag string) string {
+	if destTag, ok := m.destTags[tag]; ok {
+		return destTag
+	}
+	return tag
+}
+
+// ref returns the destination reference for destTag, which is named as in
+// the destination.
+func (m *destinationMirror) ref(destTag string) (name.Reference, error) {
+	ref, err := name.ParseReference(m.destName + ":" + destTag)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to ParseReference dest")
+	}
+	return ref, nil
+}
+
+// syncExisting compares the digests of a tag which exists in both
+// repositories, and handles drift according to the DriftPolicy. Returns the
+// status of the tag, whether it was left drifted, and an error, if any.
+func (m *destinationMirror) syncExisting(ctx context.Context, tag string, source *sourceTag) (_ slipwayk8sfacebookcomv1.TagStatus, _ bool, err error) {
+	status := m.tagStatus(tag)
+	status.CopyTime = m.previous[tag].CopyTime
+	if m.policy == slipwayk8sfacebookcomv1.DriftPolicyIgnore {
+		// The digests are not compared, so keep those we last knew of,
+		// which drift reporting and deletion rely on.
+		status.SourceDigest = m.previous[tag].SourceDigest
+		status.DestDigest = m.previous[tag].DestDigest
+		return status, false, nil
+	}
+
+	ctx, span := startSpan(ctx, "SyncTag", repositoryKey.String(m.destName), tagKey.String(m.destTag(tag)))
+	defer func() {
+		span.SetAttributes(digestKey.String(status.DestDigest))
+		endSpan(ctx, span, err)
+	}()
+
+	destRef, err := m.ref(m.destTag(tag))
+	if err != nil {
+		return status, false, err
+	}
+
+	// The digest is computed from the (possibly filtered) manifest which
+	// would be written, rather than the source registry, so that a platform
+	// filter does not look like drift.
+	manifest, digest, err := source.Manifest(ctx)
+	if err != nil {
+		return status, false, err
+	}
+	status.SourceDigest = digest
+
+	status.DestDigest, err = GetDigest(destRef, withTraceContext(ctx, m.options))
+	if err != nil {
+		return status, false, errors.Wrap(err, "unable to GetDigest dest")
+	}
+
+	if status.SourceDigest == status.DestDigest {
+		return status, false, nil
+	}
+
+	m.log.Info("Tag has drifted from source", "tag", tag, "sourceDigest", status.SourceDigest, "destDigest", status.DestDigest)
+	if m.policy != slipwayk8sfacebookcomv1.DriftPolicyResync {
+		return status, true, nil
+	}
+
+	if m.dryRun {
+		m.log.Info("Would resync tag", "tag", tag)
+		m.result.PlannedTags = append(m.result.PlannedTags, tag)
+		return status, true, nil
+	}
+
+	if err := m.checkPush(ctx); err != nil {
+		return status, false, err
+	}
+	start := time.Now()
+	if err := manifest.Write(destRef, withTraceContext(ctx, m.options)); err != nil {
+		return status, false, errors.Wrap(err, "unable to Write drifted tag")
+	}
+
+	now := metav1.Now()
+	status.DestDigest = status.SourceDigest
+	status.CopyTime = &now
+	span.SetAttributes(bytesKey.Int64(m.recordCopy(status, manifest, now.Sub(start))))
+	return status, false, nil
+}
+
+// tagStatus returns an empty status for tag, recording its destination name
+// if it was renamed.
+func (m *destinationMirror) tagStatus(tag string) slipwayk8sfacebookcomv1.TagStatus {
+	status := slipwayk8sfacebookcomv1.TagStatus{Tag: tag}
+	if destTag := m.destTag(tag); destTag != tag {
+		status.DestTag = destTag
+	}
+	return status
+}
+
+// copyMissing copies a tag which does not exist in the destination, and
+// returns its status.
+func (m *destinationMirror) copyMissing(ctx context.Context, tag string, source *sourceTag) (_ slipwayk8sfacebookcomv1.TagStatus, err error) {
+	status := m.tagStatus(tag)
+
+	ctx, span := startSpan(ctx, "CopyTag", repositoryKey.String(m.destName), tagKey.String(m.destTag(tag)))
+	defer func() { endSpan(ctx, span, err) }()
+
+	destRef, err := m.ref(m.destTag(tag))
+	if err != nil {
+		return status, err
+	}
+
+	if err := m.checkPush(ctx); err != nil {
+		return status, err
+	}
+	manifest, digest, err := source.Manifest(ctx)
+	if err != nil {
+		return status, err
+	}
+	span.SetAttributes(digestKey.String(digest))
+
+	start := time.Now()
+	if err := manifest.Write(destRef, withTraceContext(ctx, m.options)); err != nil {
+		return status, errors.Wrap(err, "unable to CopyImage")
+	}
+
+	now := metav1.Now()
+	status.SourceDigest = digest
+	status.DestDigest = digest
+	status.CopyTime = &now
+	span.SetAttributes(bytesKey.Int64(m.recordCopy(status, manifest, now.Sub(start))))
+	return status, nil
+}
+
+// recordCopy records that the tag described by status was written from
+// manifest, taking duration, and returns the size of the manifest, or zero
+// if it is unknown.
+func (m *destinationMirror) recordCopy(status slipwayk8sfacebookcomv1.TagStatus, manifest Manifest, duration time.Duration) int64 {
+	m.result.CopiedTags = append(m.result.CopiedTags, status)
+	m.result.CopyDurations = append(m.result.CopyDurations, duration)
+
+	size, err := manifest.Size()
+	if err != nil {
+		m.log.Error(err, "unable to Size copied tag", "tag", status.Tag)
+		return 0
+	}
+	m.result.CopiedBytes += size
+	return size
+}
+
+// mirror syncs or copies tag, unless it is backing off after a failure, and
+// records the outcome in the result. Nothing is done once the destination has
+// failed as a whole.
+func (m *destinationMirror) mirror(ctx context.Context, tag string, source *sourceTag, now time.Time) {
+	if m.result.Err != nil {
+		return
+	}
+
+	failed, hasFailed := m.failures[tag]
+	previous, hasPrevious := m.previous[tag]
+	backingOff := hasFailed && now.Before(failed.NextRetryTime.Time)
+
+	if m.existing[tag] {
+		// The tag exists in the destination either way.
+		m.result.MirroredTags = append(m.result.MirroredTags, tag)
+
+		if backingOff {
+			m.result.FailedTags = append(m.result.FailedTags, failed)
+			if hasPrevious {
+				m.result.Tags = append(m.result.Tags, previous)
+			}
+			return
+		}
+
+		status, drifted, err := m.syncExisting(ctx, tag, source)
+		if m.result.Err != nil {
+			m.log.Error(m.result.Err, "unable to sync destination")
+			return
+		}
+		if err != nil {
+			m.log.Error(err, "unable to sync existing tag", "tag", tag)
+			m.result.FailedTags = append(m.result.FailedTags, NewFailedTag(failed, tag, err, now))
+			if hasPrevious {
+				m.result.Tags = append(m.result.Tags, previous)
+			}
+			return
+		}
+
+		if drifted {
+			m.result.DriftedTags = append(m.result.DriftedTags, tag)
+		}
+		m.result.Tags = append(m.result.Tags, status)
+		return
+	}
+
+	if backingOff {
+		m.result.FailedTags = append(m.result.FailedTags, failed)
+		return
+	}
+
+	if m.dryRun {
+		m.log.Info("Would copy tag", "tag", tag)
+		m.result.PlannedTags = append(m.result.PlannedTags, tag)
+		return
+	}
+
+	status, err := m.copyMissing(ctx, tag, source)
+	if m.result.Err != nil {
+		m.log.Error(m.result.Err, "unable to sync destination")
+		return
+	}
+	if err != nil {
+		m.log.Error(err, "unable to copy missing tag", "tag", tag)
+		m.result.FailedTags = append(m.result.FailedTags, NewFailedTag(failed, tag, err, now))
+		return
+	}
+
+	m.result.MirroredTags = append(m.result.MirroredTags, tag)
+	m.result.Tags = append(m.result.Tags, status)
+	m.created = append(m.created, m.destTag(tag))
+}
+
+// skipTags records that each of tags was skipped for reason.
+func skipTags(tags []string, reason slipwayk8sfacebookcomv1.SkipReason) (skipped []slipwayk8sfacebookcomv1.SkippedTag) {
+	for _, tag := range tags {
+		skipped = append(skipped, slipwayk8sfacebookcomv1.SkippedTag{Tag: tag, Reason: reason})
+	}
+	return
+}
+
+// MirrorImages resolves the images to mirror, and mirrors each of them. An
+// image which cannot be mirrored does not stop the others; its error is
+// recorded in its result. inventory holds the tags of each image as of the
+// previous sync, and may be empty. Returns the outcome for each image, and an
+// error, if the images could not be resolved.
 func MirrorImages(ctx context.Context, log logr.Logger,
-	imageMirror slipwayk8sfacebookcomv1.ImageMirror,
-	sourceSecretData, destSecretData SecretData) ([]string, error) {
+	imageMirror slipwayk8sfacebookcomv1.ImageMirror, inventory Inventory,
+	sourceSecretData SecretData, getSecretData SecretGetter) (MirrorResult, error) {
+	var result MirrorResult
+
+	imageNames, err := ResolveImageNames(ctx, log, imageMirror.Spec, sourceSecretData)
+	if err != nil {
+		return result, err
+	}
+	log.Info("Resolved source images", "imageNames", imageNames)
+
+	for _, imageName := range imageNames {
+		image := mirrorImage(ctx, log.WithValues("image", imageName), imageMirror, inventory, imageName,
+			sourceSecretData, getSecretData)
+		result.Images = append(result.Images, image)
+	}
+
+	return result, nil
+}
 
-	sourceName, sourceTags, err := ListImageTags(ctx, imageMirror.Spec.SourceRepo, imageMirror.Spec.ImageName, sourceSecretData, log)
+// mirrorImage lists all tags for imageName from the source repository and
+// writes them to each destination repository iff they are not already there,
+// and they match pattern. Each tag is read from the source once, however
+// many destinations it is written to. Tags which already exist are compared
+// by digest and handled according to the DriftPolicy. A tag which cannot be
+// mirrored does not stop the others; it is recorded in FailedTags and retried
+// with its own exponential backoff. Likewise, a destination which cannot be
+// listed does not stop the others. Returns the outcome for each destination,
+// with Err set if the source repository cannot be listed or does not exist.
+func mirrorImage(ctx context.Context, log logr.Logger,
+	imageMirror slipwayk8sfacebookcomv1.ImageMirror, inventory Inventory, imageName string,
+	sourceSecretData SecretData, getSecretData SecretGetter) (result ImageResult) {
+	result = ImageResult{Name: imageName, MirroredTags: []string{}}
+
+	ctx, span := startSpan(ctx, "MirrorImage",
+		repositoryKey.String(GetNormalizedName(imageMirror.Spec.SourceRepo, imageName)))
+	defer func() { endSpan(ctx, span, result.Err) }()
+
+	sourceName, sourceTags, err := ListImageTags(ctx, imageMirror.Spec.SourceRepo, imageName, sourceSecretData, log)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to ListImageTags source")
+		result.Err = &RepositoryError{Role: RoleSource, Err: err}
+		log.Error(result.Err, "unable to sync image")
+		return result
+	}
+	if sourceName == "" {
+		// A missing source, which may only be missing for the moment, is not
+		// the same as a source without tags, which the Retention policy would
+		// prune every created tag for.
+		result.Err = &RepositoryError{Role: RoleSource, Err: ErrRepositoryNotFound}
+		log.Error(result.Err, "unable to sync image")
+		return result
 	}
 	log.Info("Source repository tags", "sourceTags", sourceTags)
 
-	destName, destTags, err := ListImageTags(ctx, imageMirror.Spec.DestRepo, imageMirror.Spec.ImageName, destSecretData, log)
+	platforms, err := ParsePlatforms(imageMirror.Spec.Platforms)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to ListImageTags dest")
+		result.Err = errors.Wrap(err, "unable to ParsePlatforms")
+		return result
 	}
-	log.Info("Dest repository tags", "destTags", destTags)
 
-	filteredTags := Filter(sourceTags, imageMirror.Spec.Pattern)
-	mirroredTags := Intersection(filteredTags, destTags)
-	missingTags := Difference(filteredTags, destTags)
+	selector, err := NewSelector(imageMirror.Spec)
+	if err != nil {
+		result.Err = errors.Wrap(err, "unable to NewSelector")
+		return result
+	}
+	pattern := selector.Ordering()
 
-	log.Info("Filtered source repository tags", "filteredTags", filteredTags)
-	log.Info("Mirrored destination tags", "mirroredTags", mirroredTags)
-	log.Info("Missing destination tags", "missingTags", missingTags)
+	filteredTags, skippedTags := selector.Select(sourceTags)
 
-	for _, tag := range missingTags {
-		sourceNameWithTag := sourceName + ":" + tag
-		destNameWithTag := destName + ":" + tag
+	rewriter, err := NewTagRewriter(imageMirror.Spec.TagTemplate)
+	if err != nil {
+		result.Err = errors.Wrap(err, "unable to NewTagRewriter")
+		return result
+	}
+	destTags, invalidTags := rewriter.RewriteAll(filteredTags)
+	if len(invalidTags) > 0 {
+		log.Info("Skipped source repository tags with invalid destination names", "skippedTags", invalidTags)
+		skippedTags = append(skippedTags, invalidTags...)
+		renamed := []string{}
+		for _, tag := range filteredTags {
+			if _, ok := destTags[tag]; ok {
+				renamed = append(renamed, tag)
+			}
+		}
+		filteredTags = renamed
+	}
+	log.Info("Filtered source repository tags", "filteredTags", filteredTags)
 
-		sourceRef, err := name.ParseReference(sourceNameWithTag)
+	// Image configs are only fetched when tags are filtered or ordered by
+	// their creation time, and at most once per tag.
+	sourceOptions := GetRemoteOptions(sourceSecretData)
+	infos := make(map[string]Info)
+	infoErrs := make(map[string]error)
+	infoFor := func(tag string) (Info, error) {
+		if info, ok := infos[tag]; ok {
+			return info, infoErrs[tag]
+		}
+		ref, err := name.ParseReference(sourceName + ":" + tag)
 		if err != nil {
-			return mirroredTags, errors.Wrap(err, "unable to ParseReference source")
+			return Info{}, errors.Wrap(err, "unable to ParseReference source")
 		}
-
-		destRef, err := name.ParseReference(destNameWithTag)
+		info, err := GetInfo(ref, platforms, withTraceContext(ctx, sourceOptions))
 		if err != nil {
-			return mirroredTags, errors.Wrap(err, "unable to ParseReference dest")
+			log.Error(err, "unable to GetInfo", "tag", tag)
+		}
+		infos[tag], infoErrs[tag] = info, err
+		return info, err
+	}
+	createdAt := func(tag string) (time.Time, error) {
+		info, err := infoFor(tag)
+		if info.CreatedAt.IsZero() {
+			if err == nil {
+				err = errors.New("no creation time")
+			}
+			return time.Time{}, err
 		}
+		return info.CreatedAt, nil
+	}
 
-		img, err := remote.Image(sourceRef, GetRemoteOptions(sourceSecretData)...)
-		if err != nil {
-			return mirroredTags, errors.Wrap(err, "unable to Image")
+	selectedTags, tooOldOrNew := FilterByAge(filteredTags, imageMirror.Spec.MinAge, imageMirror.Spec.MaxAge, time.Now(), infoFor)
+	if len(tooOldOrNew) > 0 {
+		log.Info("Skipped source repository tags by age", "skippedTags", tooOldOrNew)
+	}
+	skippedTags = append(skippedTags, tooOldOrNew...)
+
+	if latest := imageMirror.Spec.Latest; latest != nil {
+		latestTags := NewestTags(selectedTags, pattern, int(*latest), imageName, createdAt)
+		log.Info("Latest source repository tags", "latestTags", latestTags)
+		skippedTags = append(skippedTags, skipTags(Difference(selectedTags, latestTags),
+			slipwayk8sfacebookcomv1.SkipReasonNotLatest)...)
+		selectedTags = Intersection(selectedTags, latestTags)
+	}
+
+	// Tags which would be deleted by the Retention policy are not mirrored
+	// in the first place.
+	retainedTags, prune := RetainedTags(imageMirror.Spec.Retention, filteredTags, pattern,
+		imageName, createdAt)
+	if len(retainedTags) != len(filteredTags) {
+		log.Info("Retained source repository tags", "retainedTags", retainedTags)
+		skippedTags = append(skippedTags, skipTags(Difference(selectedTags, retainedTags),
+			slipwayk8sfacebookcomv1.SkipReasonNotRetained)...)
+		selectedTags = Intersection(selectedTags, retainedTags)
+	}
+	if prune && len(retainedTags) == 0 {
+		// Keeping nothing would delete every tag slipway created, which an
+		// empty listing or an overly strict pattern is more likely to cause
+		// than intent.
+		log.Info("Not pruning, since no source tags are retained")
+		prune = false
+	}
+
+	result.SelectedTags = selectedTags
+	result.SkippedTags = skippedTags
+
+	var mirrors, active []*destinationMirror
+	for _, destination := range imageMirror.Spec.AllDestinations() {
+		m := newDestinationMirror(ctx, log, imageMirror, inventory, imageName, destination, getSecretData, selectedTags, destTags)
+		if m.result.Err != nil {
+			m.log.Error(m.result.Err, "unable to sync destination")
+		} else {
+			active = append(active, m)
 		}
+		mirrors = append(mirrors, m)
+	}
 
-		err = remote.Write(destRef, img, GetRemoteOptions(destSecretData)...)
-		if err != nil {
-			return mirroredTags, errors.Wrap(err, "unable to Write")
+	now := time.Now()
+	for _, tag := range selectedTags {
+		// Source layers are read while the tag is written, so their
+		// requests are traced as part of the tag.
+		tagCtx, tagSpan := startSpan(ctx, "MirrorTag", tagKey.String(tag))
+		source := &sourceTag{
+			name:      sourceName + ":" + tag,
+			platforms: platforms,
+			options:   withTraceContext(tagCtx, sourceOptions),
 		}
 
-		mirroredTags = append(mirroredTags, tag)
+		// Keep the layers read from the source while the tag is written to
+		// every destination, and throw them away afterwards.
+		var blobs *blobCache
+		if len(active) > 1 && !imageMirror.Spec.DryRun {
+			if blobs, err = newBlobCache(); err != nil {
+				log.Error(err, "unable to cache layers, reading them once per destination", "tag", tag)
+			} else {
+				source.cache = blobs
+			}
+		}
+
+		for _, m := range active {
+			m.mirror(tagCtx, tag, source, now)
+		}
+
+		if blobs != nil {
+			if err := blobs.Close(); err != nil {
+				log.Error(err, "unable to remove cached layers", "tag", tag)
+			}
+		}
+		tagSpan.End()
 	}
 
-	// TODO(dwat): Consider if this can be removed in favor of omitempty...
-	if mirroredTags == nil {
-		return []string{}, nil
+	for _, m := range active {
+		if m.result.Err != nil {
+			continue
+		}
+		if prune {
+			m.prune(ctx, retainedTags, imageMirror.Spec.Retention.DryRun || imageMirror.Spec.DryRun, now)
+		}
+		m.result.CreatedTags = m.created
+	}
+
+	for i, m := range mirrors {
+		result.Destinations = append(result.Destinations, m.result)
+		if i == 0 {
+			result.MirroredTags = m.result.MirroredTags
+		} else {
+			result.MirroredTags = Intersection(result.MirroredTags, m.result.MirroredTags)
+		}
+	}
+	if result.MirroredTags == nil {
+		result.MirroredTags = []string{}
 	}
 
-	return mirroredTags, nil
+	return result
 }
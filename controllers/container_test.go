@@ -0,0 +1,694 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// testRegistry wraps the in-memory registry of go-containerregistry, which
+// can neither list nor delete tags, nor list its catalog, and records the
+// requests it receives. Pushes to the repositories in denyPush are rejected.
+// The catalog lists the repositories with tags, catalogPageSize at a time if
+// it is set, or fails with catalogStatus and catalogCode if they are set.
+type testRegistry struct {
+	t        *testing.T
+	server   *httptest.Server
+	inner    http.Handler
+	mu       sync.Mutex
+	tags     map[string]map[string]bool
+	denyPush map[string]bool
+	requests []string
+
+	catalogPageSize int
+	catalogStatus   int
+	catalogCode     string
+}
+
+// newTestRegistry starts a testRegistry, which is stopped when t ends.
+func newTestRegistry(t *testing.T) *testRegistry {
+	r := &testRegistry{
+		t:        t,
+		inner:    registry.New(registry.Logger(log.New(ioutil.Discard, "", 0))),
+		tags:     make(map[string]map[string]bool),
+		denyPush: make(map[string]bool),
+	}
+	r.server = httptest.NewServer(r)
+	t.Cleanup(r.server.Close)
+	return r
+}
+
+// Host returns the host:port of the registry.
+func (r *testRegistry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// PushImage writes img to repo:tag, and returns its digest.
+func (r *testRegistry) PushImage(repo, tag string, img v1.Image) string {
+	r.t.Helper()
+	ref, err := name.ParseReference(r.Host() + "/" + repo + ":" + tag)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := remote.Write(ref, img); err != nil {
+		r.t.Fatal(err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return digest.String()
+}
+
+// PushIndex writes idx and its children to repo:tag, and returns its digest.
+func (r *testRegistry) PushIndex(repo, tag string, idx v1.ImageIndex) string {
+	r.t.Helper()
+	ref, err := name.ParseReference(r.Host() + "/" + repo + ":" + tag)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := remote.WriteIndex(ref, idx); err != nil {
+		r.t.Fatal(err)
+	}
+	digest, err := idx.Digest()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return digest.String()
+}
+
+// Requests returns the requests received since the last call, as
+// "METHOD path".
+func (r *testRegistry) Requests() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	requests := r.requests
+	r.requests = nil
+	return requests
+}
+
+// Tags returns the tags of repo.
+func (r *testRegistry) Tags(repo string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tags := []string{}
+	for tag := range r.tags[repo] {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (r *testRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	r.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case req.Method == http.MethodGet && path == "_catalog":
+		if r.catalogStatus != 0 {
+			writeRegistryError(w, r.catalogStatus, r.catalogCode)
+			return
+		}
+		r.serveCatalog(w, req)
+		return
+
+	case req.Method == http.MethodGet && strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		if _, ok := r.tags[repo]; !ok {
+			writeRegistryError(w, http.StatusNotFound, "NAME_UNKNOWN")
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"name": repo, "tags": r.Tags(repo)})
+		return
+
+	case req.Method == http.MethodPost && strings.HasSuffix(path, "/blobs/uploads/"):
+		if r.denyPush[strings.TrimSuffix(path, "/blobs/uploads/")] {
+			writeRegistryError(w, http.StatusForbidden, "DENIED")
+			return
+		}
+
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		repo, ref := path[:i], path[i+len("/manifests/"):]
+		switch req.Method {
+		case http.MethodPut:
+			if r.denyPush[repo] {
+				writeRegistryError(w, http.StatusForbidden, "DENIED")
+				return
+			}
+			if !strings.Contains(ref, ":") {
+				r.mu.Lock()
+				if r.tags[repo] == nil {
+					r.tags[repo] = make(map[string]bool)
+				}
+				r.tags[repo][ref] = true
+				r.mu.Unlock()
+			}
+		case http.MethodDelete:
+			r.mu.Lock()
+			delete(r.tags[repo], ref)
+			r.mu.Unlock()
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+
+	r.inner.ServeHTTP(w, req)
+}
+
+// serveCatalog responds with the repositories after the query parameter last,
+// and links to the next page if there are more than fit in one.
+func (r *testRegistry) serveCatalog(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	repos := []string{}
+	for repo := range r.tags {
+		if repo > req.URL.Query().Get("last") {
+			repos = append(repos, repo)
+		}
+	}
+	r.mu.Unlock()
+	sort.Strings(repos)
+
+	if r.catalogPageSize > 0 && len(repos) > r.catalogPageSize {
+		repos = repos[:r.catalogPageSize]
+		w.Header().Set("Link", fmt.Sprintf(`</v2/_catalog?last=%s&n=%d>; rel="next"`,
+			url.QueryEscape(repos[len(repos)-1]), r.catalogPageSize))
+	}
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"repositories": repos})
+}
+
+// writeRegistryError responds with status and a registry error code.
+func writeRegistryError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"errors": []map[string]string{{"code": code}},
+	})
+}
+
+// countRequests returns how many of requests start with prefix.
+func countRequests(requests []string, prefix string) (count int) {
+	for _, request := range requests {
+		if strings.HasPrefix(request, prefix) {
+			count++
+		}
+	}
+	return
+}
+
+// testImageMirror returns an ImageMirror of image app from src to dst in r.
+func testImageMirror(r *testRegistry) slipwayk8sfacebookcomv1.ImageMirror {
+	return slipwayk8sfacebookcomv1.ImageMirror{
+		Spec: slipwayk8sfacebookcomv1.ImageMirrorSpec{
+			SourceRepo: r.Host() + "/src",
+			DestRepo:   r.Host() + "/dst",
+			ImageName:  "app",
+			Pattern:    "glob:*",
+		},
+	}
+}
+
+// noSecrets is a SecretGetter for registries which need no credentials.
+func noSecrets(string) (SecretData, error) {
+	return SecretData{}, nil
+}
+
+// TestMirrorImageChecksPushPermission checks that pushing is checked whenever
+// the credentials of the destination change, even if nothing is written, but
+// not again while they stay the same.
+func TestMirrorImageChecksPushPermission(t *testing.T) {
+	tests := []struct {
+		name            string
+		checkedVersion  string
+		dryRun          bool
+		sourceTags      []string
+		wantErr         bool
+		wantUploads     int
+		wantVersion     string
+		wantCredentials slipwayk8sfacebookcomv1.ConditionStatus
+	}{
+		{"up to date with checked credentials", "default", false, []string{"v1"}, false, 0, "default", slipwayk8sfacebookcomv1.ConditionTrue},
+		{"up to date with new credentials", "", false, []string{"v1"}, true, 1, "", slipwayk8sfacebookcomv1.ConditionFalse},
+		{"up to date with rotated credentials", "other@1", false, []string{"v1"}, true, 1, "", slipwayk8sfacebookcomv1.ConditionFalse},
+		{"missing tag with new credentials", "", false, []string{"v1", "v2"}, true, 1, "", slipwayk8sfacebookcomv1.ConditionFalse},
+		{"missing tag with checked credentials", "default", false, []string{"v1", "v2"}, false, 0, "default", slipwayk8sfacebookcomv1.ConditionFalse},
+		{"dry run", "", true, []string{"v1", "v2"}, false, 0, "", slipwayk8sfacebookcomv1.ConditionUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			var digest string
+			for _, tag := range tt.sourceTags {
+				img, err := random.Image(256, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.PushImage("src/app", tag, img)
+				if tag == "v1" {
+					digest = r.PushImage("dst/app", tag, img)
+				}
+			}
+			r.denyPush["dst/app"] = true
+			r.Requests()
+
+			imageMirror := testImageMirror(r)
+			imageMirror.Spec.DryRun = tt.dryRun
+			imageMirror.Status.Images = []slipwayk8sfacebookcomv1.ImageStatus{{
+				Name: "app",
+				Destinations: []slipwayk8sfacebookcomv1.DestinationStatus{{
+					Repo:                     imageMirror.Spec.DestRepo,
+					PushCheckedSecretVersion: tt.checkedVersion,
+				}},
+			}}
+			inventory := Inventory{"app": {
+				MirroredTags: []string{"v1"},
+				Destinations: []slipwayk8sfacebookcomv1.DestinationInventory{{
+					Repo:         imageMirror.Spec.DestRepo,
+					MirroredTags: []string{"v1"},
+					Tags:         []slipwayk8sfacebookcomv1.TagStatus{{Tag: "v1", SourceDigest: digest, DestDigest: digest}},
+				}},
+			}}
+
+			result := mirrorImage(context.Background(), ctrl.Log, imageMirror, inventory, "app", SecretData{}, noSecrets)
+			if result.Err != nil {
+				t.Fatalf("mirrorImage() = %v", result.Err)
+			}
+			destination := result.Destinations[0]
+			var credentialsErr *CredentialsError
+			if got := errors.As(destination.Err, &credentialsErr); got != tt.wantErr {
+				t.Errorf("destination error = %v, want a CredentialsError: %v", destination.Err, tt.wantErr)
+			}
+			if got := countRequests(r.Requests(), "POST /v2/dst/app/blobs/uploads/"); got != tt.wantUploads {
+				t.Errorf("initiated %d uploads to the destination, want %d", got, tt.wantUploads)
+			}
+			if destination.PushCheckedSecretVersion != tt.wantVersion {
+				t.Errorf("PushCheckedSecretVersion = %q, want %q", destination.PushCheckedSecretVersion, tt.wantVersion)
+			}
+			if len(destination.MirroredTags) != 1 || destination.MirroredTags[0] != "v1" {
+				t.Errorf("MirroredTags = %v, want [v1]", destination.MirroredTags)
+			}
+			if len(destination.Tags) != 1 || destination.Tags[0].DestDigest != digest {
+				t.Errorf("Tags = %+v, want v1 at %s", destination.Tags, digest)
+			}
+
+			var status slipwayk8sfacebookcomv1.DestinationStatus
+			setDestinationConditions(&status, 1, destination)
+			credentials := slipwayk8sfacebookcomv1.FindCondition(status.Conditions, slipwayk8sfacebookcomv1.ConditionCredentialsValid)
+			if credentials == nil || credentials.Status != tt.wantCredentials {
+				t.Errorf("CredentialsValid = %+v, want %s", credentials, tt.wantCredentials)
+			}
+		})
+	}
+}
+
+// testIndex returns a Docker manifest list with a random image for each of
+// platforms, and the digest of each child keyed by its platform.
+func testIndex(t *testing.T, platforms ...v1.Platform) (v1.ImageIndex, map[string]string) {
+	t.Helper()
+	var adds []mutate.IndexAddendum
+	children := make(map[string]string)
+	for i := range platforms {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		children[platformString(platforms[i])] = digest.String()
+		adds = append(adds, mutate.IndexAddendum{Add: img, Descriptor: v1.Descriptor{Platform: &platforms[i]}})
+	}
+	return mutate.IndexMediaType(mutate.AppendManifests(empty.Index, adds...), types.DockerManifestList), children
+}
+
+// platformString formats p as os/architecture[/variant].
+func platformString(p v1.Platform) string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// TestCopyManifest checks that GetManifest and Manifest.Write copy an index
+// intact, or filtered to the requested platforms with the digests of the
+// children unchanged.
+func TestCopyManifest(t *testing.T) {
+	amd64 := v1.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	armv7 := v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}
+
+	tests := []struct {
+		name         string
+		platforms    []v1.Platform
+		wantChildren []string
+		wantErr      bool
+	}{
+		{"whole index", nil, nil, false},
+		{"one platform", []v1.Platform{amd64}, []string{"linux/amd64"}, false},
+		{"any variant", []v1.Platform{{OS: "linux", Architecture: "arm"}, amd64}, []string{"linux/amd64", "linux/arm/v7"}, false},
+		{"variant", []v1.Platform{{OS: "linux", Architecture: "arm64", Variant: "v8"}}, []string{"linux/arm64/v8"}, false},
+		{"other variant", []v1.Platform{{OS: "linux", Architecture: "arm", Variant: "v6"}}, nil, true},
+		{"no match", []v1.Platform{{OS: "windows", Architecture: "amd64"}}, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			idx, children := testIndex(t, amd64, arm64, armv7)
+			digest := r.PushIndex("src/app", "v1", idx)
+			src, err := name.ParseReference(r.Host() + "/src/app:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst, err := name.ParseReference(r.Host() + "/dst/app:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			manifest, err := GetManifest(src, tt.platforms, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetManifest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if manifest.Index == nil {
+				t.Fatal("GetManifest() returned an image, want an index")
+			}
+			if err := manifest.Write(dst, nil); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			written, err := remote.Index(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mediaType, err := written.MediaType(); err != nil || mediaType != types.DockerManifestList {
+				t.Errorf("written media type = %s, %v, want %s", mediaType, err, types.DockerManifestList)
+			}
+			writtenDigest, err := GetDigest(dst, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if wantDigest, _ := manifest.Digest(); writtenDigest != wantDigest {
+				t.Errorf("written digest = %s, want %s", writtenDigest, wantDigest)
+			}
+			if tt.platforms == nil {
+				if writtenDigest != digest {
+					t.Errorf("copied index digest = %s, want the source digest %s", writtenDigest, digest)
+				}
+				return
+			}
+			if writtenDigest == digest {
+				t.Errorf("filtered index has the digest of the source")
+			}
+
+			index, err := written.IndexManifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, desc := range index.Manifests {
+				platform := platformString(*desc.Platform)
+				got = append(got, platform)
+				if desc.Digest.String() != children[platform] {
+					t.Errorf("child %s has digest %s, want %s", platform, desc.Digest, children[platform])
+				}
+				if _, err := remote.Image(dst.Context().Digest(desc.Digest.String())); err != nil {
+					t.Errorf("child %s was not written: %v", platform, err)
+				}
+			}
+			sort.Strings(got)
+			if strings.Join(got, " ") != strings.Join(tt.wantChildren, " ") {
+				t.Errorf("filtered children = %v, want %v", got, tt.wantChildren)
+			}
+		})
+	}
+}
+
+func TestCopyManifestImage(t *testing.T) {
+	r := newTestRegistry(t)
+	img, err := random.Image(256, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := r.PushImage("src/app", "v1", img)
+	src, err := name.ParseReference(r.Host() + "/src/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := name.ParseReference(r.Host() + "/dst/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Platforms only filter indexes, and are ignored for single images.
+	manifest, err := GetManifest(src, []v1.Platform{{OS: "linux", Architecture: "arm64"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Image == nil {
+		t.Fatal("GetManifest() returned an index, want an image")
+	}
+	if err := manifest.Write(dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := GetDigest(dst, nil); err != nil || got != digest {
+		t.Errorf("written digest = %s, %v, want %s", got, err, digest)
+	}
+}
+
+// TestMirrorImageDryRun checks that a dry run plans the tags it would copy
+// and the tags it would prune, without writing to or deleting from the
+// destination.
+func TestMirrorImageDryRun(t *testing.T) {
+	r := newTestRegistry(t)
+	for _, tag := range []string{"v1", "v2", "v3"} {
+		img, err := random.Image(256, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.PushImage("src/app", tag, img)
+		if tag == "v1" {
+			r.PushImage("dst/app", tag, img)
+		}
+	}
+	old, err := random.Image(256, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.PushImage("dst/app", "v0", old)
+	r.Requests()
+
+	imageMirror := testImageMirror(r)
+	imageMirror.Spec.Pattern = "numeric:v#"
+	imageMirror.Spec.DryRun = true
+	imageMirror.Spec.Retention = &slipwayk8sfacebookcomv1.Retention{
+		Policy: slipwayk8sfacebookcomv1.RetentionKeepLatest,
+		Keep:   2,
+	}
+	inventory := Inventory{"app": {
+		Destinations: []slipwayk8sfacebookcomv1.DestinationInventory{{
+			Repo:        imageMirror.Spec.DestRepo,
+			CreatedTags: []string{"v0", "v1"},
+		}},
+	}}
+
+	result := mirrorImage(context.Background(), ctrl.Log, imageMirror, inventory, "app", SecretData{}, noSecrets)
+	if result.Err != nil {
+		t.Fatalf("mirrorImage() = %v", result.Err)
+	}
+	destination := result.Destinations[0]
+	if destination.Err != nil {
+		t.Fatalf("destination error = %v", destination.Err)
+	}
+
+	planned := append([]string{}, destination.PlannedTags...)
+	sort.Strings(planned)
+	if want := []string{"v2", "v3"}; !reflect.DeepEqual(planned, want) {
+		t.Errorf("PlannedTags = %v, want %v", planned, want)
+	}
+	prunable := append([]string{}, destination.PrunableTags...)
+	sort.Strings(prunable)
+	if want := []string{"v0", "v1"}; !reflect.DeepEqual(prunable, want) {
+		t.Errorf("PrunableTags = %v, want %v", prunable, want)
+	}
+	if len(destination.PrunedTags) > 0 || len(destination.CopiedTags) > 0 {
+		t.Errorf("dry run pruned %v and copied %+v", destination.PrunedTags, destination.CopiedTags)
+	}
+
+	for _, request := range r.Requests() {
+		if !strings.HasPrefix(request, http.MethodGet+" ") && !strings.HasPrefix(request, http.MethodHead+" ") {
+			t.Errorf("dry run sent %s", request)
+		}
+	}
+	if got, want := r.Tags("dst/app"), []string{"v0", "v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("destination tags = %v, want %v", got, want)
+	}
+}
+
+// TestMirrorImageDriftPolicy checks how a tag which was changed in the
+// destination since it was mirrored is handled by each DriftPolicy.
+func TestMirrorImageDriftPolicy(t *testing.T) {
+	tests := []struct {
+		name              string
+		policy            slipwayk8sfacebookcomv1.DriftPolicy
+		destinationPolicy slipwayk8sfacebookcomv1.DriftPolicy
+		dryRun            bool
+		drifted           bool
+		wantCompared      bool
+		wantDrifted       bool
+		wantOverwritten   bool
+		wantPlanned       bool
+	}{
+		{name: "ignore", policy: slipwayk8sfacebookcomv1.DriftPolicyIgnore, drifted: true},
+		{name: "report", policy: slipwayk8sfacebookcomv1.DriftPolicyReport, drifted: true, wantCompared: true, wantDrifted: true},
+		{name: "report without drift", policy: slipwayk8sfacebookcomv1.DriftPolicyReport, wantCompared: true},
+		{name: "resync", policy: slipwayk8sfacebookcomv1.DriftPolicyResync, drifted: true, wantCompared: true, wantOverwritten: true},
+		{name: "resync by default", drifted: true, wantCompared: true, wantOverwritten: true},
+		{name: "resync without drift", policy: slipwayk8sfacebookcomv1.DriftPolicyResync, wantCompared: true},
+		{name: "resync dry run", policy: slipwayk8sfacebookcomv1.DriftPolicyResync, dryRun: true, drifted: true, wantCompared: true, wantDrifted: true, wantPlanned: true},
+		{
+			name:              "destination overrides",
+			policy:            slipwayk8sfacebookcomv1.DriftPolicyReport,
+			destinationPolicy: slipwayk8sfacebookcomv1.DriftPolicyResync,
+			drifted:           true,
+			wantCompared:      true,
+			wantOverwritten:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			img, err := random.Image(256, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sourceDigest := r.PushImage("src/app", "v1", img)
+			destDigest := r.PushImage("dst/app", "v1", img)
+			if tt.drifted {
+				changed, err := random.Image(256, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				destDigest = r.PushImage("dst/app", "v1", changed)
+			}
+			r.Requests()
+
+			imageMirror := testImageMirror(r)
+			imageMirror.Spec.DestRepo = ""
+			imageMirror.Spec.DriftPolicy = tt.policy
+			imageMirror.Spec.DryRun = tt.dryRun
+			destRepo := r.Host() + "/dst"
+			imageMirror.Spec.Destinations = []slipwayk8sfacebookcomv1.Destination{{Repo: destRepo, DriftPolicy: tt.destinationPolicy}}
+			imageMirror.Status.Images = []slipwayk8sfacebookcomv1.ImageStatus{{
+				Name:         "app",
+				Destinations: []slipwayk8sfacebookcomv1.DestinationStatus{{Repo: destRepo, PushCheckedSecretVersion: "default"}},
+			}}
+			// The tag was in sync when it was last mirrored.
+			inventory := Inventory{"app": {
+				MirroredTags: []string{"v1"},
+				Destinations: []slipwayk8sfacebookcomv1.DestinationInventory{{
+					Repo:         destRepo,
+					MirroredTags: []string{"v1"},
+					Tags:         []slipwayk8sfacebookcomv1.TagStatus{{Tag: "v1", SourceDigest: sourceDigest, DestDigest: sourceDigest}},
+				}},
+			}}
+
+			result := mirrorImage(context.Background(), ctrl.Log, imageMirror, inventory, "app", SecretData{}, noSecrets)
+			if result.Err != nil {
+				t.Fatalf("mirrorImage() = %v", result.Err)
+			}
+			destination := result.Destinations[0]
+			if destination.Err != nil {
+				t.Fatalf("destination error = %v", destination.Err)
+			}
+			requests := r.Requests()
+
+			if got := countRequests(requests, "GET /v2/dst/app/manifests/v1") > 0; got != tt.wantCompared {
+				t.Errorf("compared the destination digest: %v, want %v", got, tt.wantCompared)
+			}
+			if got := len(destination.DriftedTags) == 1; got != tt.wantDrifted {
+				t.Errorf("DriftedTags = %v, want v1 drifted: %v", destination.DriftedTags, tt.wantDrifted)
+			}
+			if got := len(destination.PlannedTags) == 1; got != tt.wantPlanned {
+				t.Errorf("PlannedTags = %v, want v1 planned: %v", destination.PlannedTags, tt.wantPlanned)
+			}
+			if got := countRequests(requests, "PUT /v2/dst/app/manifests/") > 0; got != tt.wantOverwritten {
+				t.Errorf("wrote the destination: %v, want %v", got, tt.wantOverwritten)
+			}
+			if got := len(destination.CopiedTags) == 1; got != tt.wantOverwritten {
+				t.Errorf("CopiedTags = %+v, want v1 resynced: %v", destination.CopiedTags, tt.wantOverwritten)
+			}
+
+			// Ignore keeps the digests it last knew of; the others record
+			// what they found, or wrote.
+			wantTag := slipwayk8sfacebookcomv1.TagStatus{Tag: "v1", SourceDigest: sourceDigest, DestDigest: sourceDigest}
+			if tt.wantCompared && !tt.wantOverwritten {
+				wantTag.DestDigest = destDigest
+			}
+			if len(destination.Tags) != 1 || destination.Tags[0].SourceDigest != wantTag.SourceDigest || destination.Tags[0].DestDigest != wantTag.DestDigest {
+				t.Errorf("Tags = %+v, want %+v", destination.Tags, wantTag)
+			}
+			if !reflect.DeepEqual(destination.MirroredTags, []string{"v1"}) {
+				t.Errorf("MirroredTags = %v, want [v1]", destination.MirroredTags)
+			}
+
+			ref, err := name.ParseReference(destRepo + "/app:v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := destDigest
+			if tt.wantOverwritten {
+				want = sourceDigest
+			}
+			if got, err := GetDigest(ref, nil); err != nil || got != want {
+				t.Errorf("destination v1 = %s, %v, want %s", got, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Keys of an Opaque Secret which hold registry credentials.
+const (
+	SecretUsernameKey      = "username"
+	SecretPasswordKey      = "password"
+	SecretIdentityTokenKey = "identitytoken"
+	SecretRegistryTokenKey = "registrytoken"
+)
+
+// SecretData is used to pass credentials internally.
+type SecretData struct {
+	Username string
+	Password string
+	// IdentityToken is exchanged with the registry's token service for an
+	// access token.
+	IdentityToken string
+	// RegistryToken is a bearer token which is sent to the registry as is.
+	RegistryToken string
+	// Auths holds the credentials of a dockerconfigjson or dockercfg Secret,
+	// keyed by registry host.
+	Auths map[string]authn.AuthConfig
+	// ResourceVersion is the resourceVersion of the Secret, which changes
+	// whenever the credentials do.
+	ResourceVersion string
+}
+
+// dockerConfigJSON is the content of a kubernetes.io/dockerconfigjson Secret.
+type dockerConfigJSON struct {
+	Auths map[string]authn.AuthConfig `json:"auths"`
+}
+
+// ParseSecretData returns the credentials in secret. Opaque Secrets provide
+// username and password, or identitytoken, or registrytoken keys, while
+// kubernetes.io/dockerconfigjson and kubernetes.io/dockercfg Secrets provide
+// credentials for each registry.
+func ParseSecretData(secret *corev1.Secret) (data SecretData, err error) {
+	data.ResourceVersion = secret.ResourceVersion
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		config := dockerConfigJSON{}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return data, errors.Wrapf(err, "unable to parse %s", corev1.DockerConfigJsonKey)
+		}
+		data.Auths, err = normalizeAuths(config.Auths)
+		return data, err
+
+	case corev1.SecretTypeDockercfg:
+		auths := map[string]authn.AuthConfig{}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return data, errors.Wrapf(err, "unable to parse %s", corev1.DockerConfigKey)
+		}
+		data.Auths, err = normalizeAuths(auths)
+		return data, err
+	}
+
+	data.Username = string(secret.Data[SecretUsernameKey])
+	data.Password = string(secret.Data[SecretPasswordKey])
+	data.IdentityToken = string(secret.Data[SecretIdentityTokenKey])
+	data.RegistryToken = string(secret.Data[SecretRegistryTokenKey])
+	return data, nil
+}
+
+// normalizeAuths keys auths by registry host, and decodes the auth field of
+// each entry into a username and password.
+func normalizeAuths(auths map[string]authn.AuthConfig) (map[string]authn.AuthConfig, error) {
+	normalized := make(map[string]authn.AuthConfig, len(auths))
+	for key, config := range auths {
+		if config.Auth != "" && config.Username == "" && config.Password == "" {
+			decoded, err := base64.StdEncoding.DecodeString(config.Auth)
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to decode auth for %s", key)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.Errorf("auth for %s is not of the form username:password", key)
+			}
+			config.Username, config.Password = parts[0], parts[1]
+		}
+		config.Auth = ""
+		normalized[registryHost(key)] = config
+	}
+
+	return normalized, nil
+}
+
+// registryHost returns the registry host of a docker config key, which may
+// include a scheme and path (e.g. https://index.docker.io/v1/).
+func registryHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+len("://"):]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+
+	switch host {
+	case "docker.io", "registry-1.docker.io":
+		return name.DefaultRegistry
+	}
+
+	return host
+}
+
+// Authenticator returns the credentials to use for registry, or nil if data
+// holds none.
+func (data SecretData) Authenticator(registry string) authn.Authenticator {
+	if data.Auths != nil {
+		config, ok := data.Auths[registryHost(registry)]
+		if !ok {
+			return nil
+		}
+		return authenticatorFromConfig(config)
+	}
+
+	return authenticatorFromConfig(authn.AuthConfig{
+		Username:      data.Username,
+		Password:      data.Password,
+		IdentityToken: data.IdentityToken,
+		RegistryToken: data.RegistryToken,
+	})
+}
+
+// authenticatorFromConfig returns the authn.Authenticator matching the
+// credentials in config, or nil if it is empty.
+func authenticatorFromConfig(config authn.AuthConfig) authn.Authenticator {
+	switch {
+	case config.IdentityToken != "":
+		return authn.FromConfig(config)
+	case config.RegistryToken != "":
+		return &authn.Bearer{Token: config.RegistryToken}
+	case config.Username != "" && config.Password != "":
+		return &authn.Basic{Username: config.Username, Password: config.Password}
+	}
+
+	return nil
+}
+
+// secretKeychain is an authn.Keychain which resolves each registry to the
+// matching credentials in data, falling back to the docker keychain.
+type secretKeychain struct {
+	data SecretData
+}
+
+// Resolve implements authn.Keychain.
+func (k secretKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth := k.data.Authenticator(target.RegistryStr()); auth != nil {
+		return auth, nil
+	}
+
+	return authn.DefaultKeychain.Resolve(target)
+}
@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+func TestParseSecretData(t *testing.T) {
+	tests := []struct {
+		name    string
+		secret  corev1.Secret
+		want    SecretData
+		wantErr bool
+	}{
+		{
+			name: "opaque basic auth",
+			secret: corev1.Secret{Data: map[string][]byte{
+				SecretUsernameKey: []byte("user"),
+				SecretPasswordKey: []byte("pass"),
+			}},
+			want: SecretData{Username: "user", Password: "pass"},
+		},
+		{
+			name: "opaque tokens",
+			secret: corev1.Secret{Type: corev1.SecretTypeOpaque, Data: map[string][]byte{
+				SecretIdentityTokenKey: []byte("identity"),
+				SecretRegistryTokenKey: []byte("registry"),
+			}},
+			want: SecretData{IdentityToken: "identity", RegistryToken: "registry"},
+		},
+		{
+			name:   "opaque empty",
+			secret: corev1.Secret{},
+			want:   SecretData{},
+		},
+		{
+			name: "dockerconfigjson",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockerConfigJson, Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": {
+					"https://index.docker.io/v1/": {"auth": "` + basicAuth("hub", "secret") + `"},
+					"http://registry.example.com:5000/v2/": {"username": "example", "password": "p:w"},
+					"quay.io": {"identitytoken": "token"}
+				}}`),
+			}},
+			want: SecretData{Auths: map[string]authn.AuthConfig{
+				"index.docker.io":           {Username: "hub", Password: "secret"},
+				"registry.example.com:5000": {Username: "example", Password: "p:w"},
+				"quay.io":                   {IdentityToken: "token"},
+			}},
+		},
+		{
+			name: "dockerconfigjson docker.io alias",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockerConfigJson, Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": {"docker.io": {"auth": "` + basicAuth("hub", "a:b") + `"}}}`),
+			}},
+			want: SecretData{Auths: map[string]authn.AuthConfig{
+				"index.docker.io": {Username: "hub", Password: "a:b"},
+			}},
+		},
+		{
+			name: "dockerconfigjson explicit username wins over auth",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockerConfigJson, Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": {"gcr.io": {"username": "u", "password": "p", "auth": "!!!"}}}`),
+			}},
+			want: SecretData{Auths: map[string]authn.AuthConfig{
+				"gcr.io": {Username: "u", Password: "p"},
+			}},
+		},
+		{
+			name: "dockercfg",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockercfg, Data: map[string][]byte{
+				corev1.DockerConfigKey: []byte(`{"https://registry-1.docker.io": {"auth": "` + basicAuth("hub", "secret") + `"}}`),
+			}},
+			want: SecretData{Auths: map[string]authn.AuthConfig{
+				"index.docker.io": {Username: "hub", Password: "secret"},
+			}},
+		},
+		{
+			name: "dockerconfigjson invalid json",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockerConfigJson, Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": `),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "dockercfg missing key",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockercfg, Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{}`),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "auth not base64",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockerConfigJson, Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": {"gcr.io": {"auth": "not base64!"}}}`),
+			}},
+			wantErr: true,
+		},
+		{
+			name: "auth without password",
+			secret: corev1.Secret{Type: corev1.SecretTypeDockerConfigJson, Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(`{"auths": {"gcr.io": {"auth": "` +
+					base64.StdEncoding.EncodeToString([]byte("useronly")) + `"}}}`),
+			}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSecretData(&tt.secret)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSecretData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSecretData() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryHost(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"gcr.io", "gcr.io"},
+		{"registry.example.com:5000", "registry.example.com:5000"},
+		{"https://registry.example.com:5000", "registry.example.com:5000"},
+		{"http://registry.example.com/v2/", "registry.example.com"},
+		{"registry.example.com/org/image", "registry.example.com"},
+		{"https://index.docker.io/v1/", "index.docker.io"},
+		{"index.docker.io", "index.docker.io"},
+		{"docker.io", "index.docker.io"},
+		{"https://docker.io", "index.docker.io"},
+		{"registry-1.docker.io", "index.docker.io"},
+	}
+
+	for _, tt := range tests {
+		if got := registryHost(tt.key); got != tt.want {
+			t.Errorf("registryHost(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticator(t *testing.T) {
+	auths := SecretData{Auths: map[string]authn.AuthConfig{
+		"index.docker.io": {Username: "hub", Password: "secret"},
+		"quay.io":         {RegistryToken: "bearer"},
+		"gcr.io":          {IdentityToken: "identity"},
+	}}
+
+	tests := []struct {
+		name     string
+		data     SecretData
+		registry string
+		want     *authn.AuthConfig
+	}{
+		{"basic", SecretData{Username: "u", Password: "p"}, "gcr.io", &authn.AuthConfig{Username: "u", Password: "p"}},
+		{"username only", SecretData{Username: "u"}, "gcr.io", nil},
+		{"registry token", SecretData{RegistryToken: "bearer"}, "gcr.io", &authn.AuthConfig{RegistryToken: "bearer"}},
+		{"identity token", SecretData{IdentityToken: "identity", Username: "u"}, "gcr.io", &authn.AuthConfig{IdentityToken: "identity", Username: "u"}},
+		{"empty", SecretData{}, "gcr.io", nil},
+		{"auths docker.io", auths, "docker.io", &authn.AuthConfig{Username: "hub", Password: "secret"}},
+		{"auths index.docker.io", auths, "index.docker.io", &authn.AuthConfig{Username: "hub", Password: "secret"}},
+		{"auths bearer", auths, "quay.io", &authn.AuthConfig{RegistryToken: "bearer"}},
+		{"auths identity", auths, "gcr.io", &authn.AuthConfig{IdentityToken: "identity"}},
+		{"auths unknown registry", auths, "registry.example.com", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := tt.data.Authenticator(tt.registry)
+			if auth == nil {
+				if tt.want != nil {
+					t.Fatalf("Authenticator(%q) = nil, want %+v", tt.registry, tt.want)
+				}
+				return
+			}
+			if tt.want == nil {
+				t.Fatalf("Authenticator(%q) = %T, want nil", tt.registry, auth)
+			}
+			got, err := auth.Authorization()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Authenticator(%q) authorizes with %+v, want %+v", tt.registry, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,325 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// hasFinalizer returns true if m carries the DestinationImagesFinalizer.
+func hasFinalizer(m mirrorObject) bool {
+	for _, finalizer := range m.Meta.Finalizers {
+		if finalizer == slipwayk8sfacebookcomv1.DestinationImagesFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+// addFinalizer adds the DestinationImagesFinalizer to m, unless it already
+// has it.
+func addFinalizer(ctx context.Context, c client.Client, m mirrorObject) error {
+	if hasFinalizer(m) {
+		return nil
+	}
+	if err := controllerutil.AddFinalizerWithError(m.Object, slipwayk8sfacebookcomv1.DestinationImagesFinalizer); err != nil {
+		return errors.Wrap(err, "unable to AddFinalizer")
+	}
+	return errors.Wrap(c.Update(ctx, m.Object), "unable to add finalizer")
+}
+
+// removeFinalizer removes the DestinationImagesFinalizer from m, allowing it
+// to be deleted.
+func removeFinalizer(ctx context.Context, c client.Client, m mirrorObject) error {
+	if err := controllerutil.RemoveFinalizerWithError(m.Object, slipwayk8sfacebookcomv1.DestinationImagesFinalizer); err != nil {
+		return errors.Wrap(err, "unable to RemoveFinalizer")
+	}
+	return errors.Wrap(c.Update(ctx, m.Object), "unable to remove finalizer")
+}
+
+// finalizeMirror applies the DeletionPolicy of m, which is being deleted, and
+// then releases its finalizer. If the images in its destinations cannot be
+// deleted, the finalizer is kept, and the Deleting condition explains why,
+// until they are, or until the ForceDeleteAnnotation is set.
+func finalizeMirror(ctx context.Context, c client.Client, recorder record.EventRecorder,
+	log logr.Logger, m mirrorObject) (ctrl.Result, error) {
+	if !hasFinalizer(m) {
+		return ctrl.Result{}, nil
+	}
+
+	switch {
+	case m.Meta.Annotations[slipwayk8sfacebookcomv1.ForceDeleteAnnotation] == "true":
+		log.Info("Removing mirror by force, without applying its deletion policy")
+		recorder.Event(m.Object, corev1.EventTypeWarning, EventReasonForceDeleted,
+			"Removed by force, without deleting anything from the destinations")
+
+	case m.Spec.DeletionPolicy != slipwayk8sfacebookcomv1.DeletionPolicyDelete || m.Spec.DryRun:
+		inventory, err := loadInventory(ctx, m.InventoryReader, m)
+		if err != nil {
+			log.Error(err, "unable to read inventory")
+			return ctrl.Result{}, err
+		}
+		tags, repos := createdImages(m.Spec, inventory)
+		log.Info("Retaining destination images", "tags", tags, "repos", repos)
+		if len(repos) == 0 {
+			recorder.Eventf(m.Object, corev1.EventTypeNormal, EventReasonImagesRetained,
+				"Deleted with deletionPolicy %s; slipway created no tags in the destinations", retainedPolicy(m.Spec))
+		} else {
+			recorder.Eventf(m.Object, corev1.EventTypeNormal, EventReasonImagesRetained,
+				"Deleted with deletionPolicy %s, leaving %d tags created by slipway in %s",
+				retainedPolicy(m.Spec), tags, truncateList(repos, maxTagEvents))
+		}
+
+	default:
+		// Record that deletion has started, since it may take as long as a
+		// sync.
+		setCondition(&m.Status.Conditions, m.Generation, slipwayk8sfacebookcomv1.ConditionDeleting,
+			slipwayk8sfacebookcomv1.ConditionTrue, ReasonDeleting, "Deleting the images slipway created in the destinations")
+		if err := c.Status().Update(ctx, m.Object); err != nil {
+			log.Error(err, "unable to update status")
+			return ctrl.Result{}, err
+		}
+
+		inventory, err := loadInventory(ctx, m.InventoryReader, m)
+		if err != nil {
+			log.Error(err, "unable to read inventory")
+			return ctrl.Result{}, err
+		}
+		// Without its inventory, nothing would be deleted, so keep the
+		// mirror rather than leave its tags behind unnoticed.
+		if tags, _ := createdImages(m.Spec, inventory); tags == 0 && statusCreatedTags(m.Status) > 0 {
+			err := ErrInventoryMissing
+			log.Error(err, "unable to delete destination images")
+			recorder.Event(m.Object, corev1.EventTypeWarning, EventReasonDeletionFailed, err.Error())
+			return updateFailedStatus(ctx, c, log, m, err, setDeletionFailedConditions)
+		}
+		result := deleteCreatedImages(ctx, log, m, inventory)
+		if err := result.Err(); err != nil {
+			log.Error(err, "unable to delete destination images")
+			recorder.Event(m.Object, corev1.EventTypeWarning, EventReasonDeletionFailed, err.Error())
+			return updateFailedStatus(ctx, c, log, m, err, setDeletionFailedConditions)
+		}
+		log.Info("Deleted destination images", "tags", result.Tags, "manifests", result.Manifests)
+		recorder.Eventf(m.Object, corev1.EventTypeNormal, EventReasonImagesDeleted,
+			"Deleted %d tags and %d manifests created by slipway from the destinations", result.Tags, result.Manifests)
+	}
+
+	if err := removeFinalizer(ctx, c, m); err != nil {
+		log.Error(err, "unable to remove finalizer")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// retainedPolicy describes why the images of a mirror were retained.
+func retainedPolicy(spec slipwayk8sfacebookcomv1.ImageMirrorSpec) string {
+	if spec.DeletionPolicy == slipwayk8sfacebookcomv1.DeletionPolicyDelete {
+		return "Delete, as a dry run"
+	}
+	return string(slipwayk8sfacebookcomv1.DeletionPolicyRetain)
+}
+
+// createdImages returns the number of tags slipway created according to
+// inventory, and the destination repositories they are in.
+func createdImages(spec slipwayk8sfacebookcomv1.ImageMirrorSpec, inventory Inventory) (tags int, repos []string) {
+	for imageName, image := range inventory {
+		for _, destination := range image.Destinations {
+			if len(destination.CreatedTags) == 0 {
+				continue
+			}
+			tags += len(destination.CreatedTags)
+			repos = append(repos, GetNormalizedName(destination.Repo, spec.DestinationImageName(imageName)))
+		}
+	}
+	sort.Strings(repos)
+	return tags, repos
+}
+
+// statusCreatedTags returns the number of tags which status counts as created
+// by slipway in every destination.
+func statusCreatedTags(status *slipwayk8sfacebookcomv1.ImageMirrorStatus) int {
+	tags := 0
+	for _, image := range status.Images {
+		for _, destination := range image.Destinations {
+			tags += int(destination.CreatedTagCount)
+		}
+	}
+	return tags
+}
+
+// deletionResult is the outcome of deleting the images a mirror created.
+type deletionResult struct {
+	// Tags and Manifests count what was deleted.
+	Tags      int
+	Manifests int
+	// Errors describe each destination, tag or manifest which could not be
+	// deleted.
+	Errors []string
+}
+
+// fail records that subject could not be deleted.
+func (r *deletionResult) fail(subject string, err error) {
+	r.Errors = append(r.Errors, subject+": "+err.Error())
+}
+
+// Err returns an error describing everything which could not be deleted, or
+// nil if there was nothing.
+func (r deletionResult) Err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	return errors.New(truncateList(r.Errors, maxTagEvents))
+}
+
+// deleteCreatedImages deletes the tags slipway created for each image of m in
+// each of its destinations, as recorded in inventory. A destination which
+// cannot be reached does not stop the others.
+func deleteCreatedImages(ctx context.Context, log logr.Logger, m mirrorObject, inventory Inventory) (result deletionResult) {
+	ctx, span := startSpan(ctx, "DeleteImages")
+	defer func() { endSpan(ctx, span, result.Err()) }()
+
+	imageNames := make([]string, 0, len(inventory))
+	for imageName := range inventory {
+		imageNames = append(imageNames, imageName)
+	}
+	sort.Strings(imageNames)
+
+	for _, imageName := range imageNames {
+		for _, destination := range m.Spec.AllDestinations() {
+			created := inventory[imageName].FindDestination(destination.Repo)
+			if created == nil || len(created.CreatedTags) == 0 {
+				continue
+			}
+			deleteDestinationImages(ctx, log.WithValues("image", imageName, "destination", destination.Repo),
+				m, imageName, destination, *created, &result)
+		}
+	}
+	return result
+}
+
+// deleteDestinationImages deletes the tags slipway created in one
+// destination, and then the manifests they referred to, unless another tag
+// still refers to them. Tags which have already been deleted are ignored.
+func deleteDestinationImages(ctx context.Context, log logr.Logger, m mirrorObject, imageName string,
+	destination slipwayk8sfacebookcomv1.Destination, created slipwayk8sfacebookcomv1.DestinationInventory,
+	result *deletionResult) {
+	subject := imageName + " " + destination.Repo
+
+	data, err := m.GetSecretData(destination.SecretName)
+	if err != nil {
+		result.fail(subject, &SecretError{Role: RoleDestination, Err: err})
+		return
+	}
+
+	destName, destTags, err := ListImageTags(ctx, destination.Repo, m.Spec.DestinationImageName(imageName), data, log)
+	if err != nil {
+		result.fail(subject, &RepositoryError{Role: RoleDestination, Err: err})
+		return
+	}
+	if destName == "" {
+		log.Info("Destination repository no longer exists")
+		return
+	}
+	options := withTraceContext(ctx, GetRemoteOptions(data))
+
+	// Remember the digest each tag had when it was last synced, which is the
+	// manifest slipway wrote.
+	digests := make(map[string]string)
+	for _, status := range created.Tags {
+		destTag := status.Tag
+		if status.DestTag != "" {
+			destTag = status.DestTag
+		}
+		if status.DestDigest != "" {
+			digests[destTag] = status.DestDigest
+		}
+	}
+
+	var deleted []string
+	manifests := make(map[string]bool)
+	for _, tag := range Intersection(created.CreatedTags, destTags) {
+		if err := deleteReference(destName+":"+tag, options); err != nil {
+			result.fail(destName+":"+tag, err)
+			continue
+		}
+		log.Info("Deleted tag", "tag", tag)
+		deleted = append(deleted, tag)
+		result.Tags++
+		if digest, ok := digests[tag]; ok {
+			manifests[digest] = true
+		}
+	}
+	if len(manifests) == 0 {
+		return
+	}
+
+	// Manifests which other tags still refer to are left alone.
+	for _, tag := range Difference(destTags, deleted) {
+		ref, err := name.ParseReference(destName + ":" + tag)
+		if err != nil {
+			result.fail(destName+":"+tag, errors.Wrap(err, "unable to ParseReference"))
+			return
+		}
+		digest, err := GetDigest(ref, options)
+		if err != nil {
+			result.fail(destName+":"+tag, err)
+			return
+		}
+		delete(manifests, digest)
+	}
+
+	remaining := make([]string, 0, len(manifests))
+	for digest := range manifests {
+		remaining = append(remaining, digest)
+	}
+	sort.Strings(remaining)
+	for _, digest := range remaining {
+		if err := deleteReference(destName+"@"+digest, options); err != nil {
+			result.fail(destName+"@"+digest, err)
+			continue
+		}
+		log.Info("Deleted manifest", "digest", digest)
+		result.Manifests++
+	}
+}
+
+// deleteReference deletes the tag or manifest ref from a registry. A
+// reference which no longer exists is not an error.
+func deleteReference(ref string, options []remote.Option) error {
+	r, err := name.ParseReference(ref)
+	if err != nil {
+		return errors.Wrap(err, "unable to ParseReference")
+	}
+	err = remote.Delete(r, options...)
+	if err != nil && ClassifyError(err) != slipwayk8sfacebookcomv1.FailureNotFound {
+		return errors.Wrap(err, "unable to Delete")
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// TestFinalizeMirrorWithoutInventory checks that a mirror whose status counts
+// created tags keeps its finalizer when its inventory is gone, as it is after
+// foreground deletion, unless it is deleted by force.
+func TestFinalizeMirrorWithoutInventory(t *testing.T) {
+	tests := []struct {
+		name            string
+		forceDelete     bool
+		createdTags     int32
+		wantErr         error
+		wantFinalizer   bool
+		wantEventReason string
+	}{
+		{"created tags", false, 2, ErrInventoryMissing, true, EventReasonDeletionFailed},
+		{"no created tags", false, 0, nil, false, EventReasonImagesDeleted},
+		{"force", true, 2, nil, false, EventReasonForceDeleted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			if err := slipwayk8sfacebookcomv1.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+
+			now := metav1.Now()
+			imageMirror := &slipwayk8sfacebookcomv1.ImageMirror{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:         "default",
+					Name:              "app",
+					UID:               "uid",
+					DeletionTimestamp: &now,
+					Finalizers:        []string{slipwayk8sfacebookcomv1.DestinationImagesFinalizer},
+				},
+				Spec: slipwayk8sfacebookcomv1.ImageMirrorSpec{
+					DeletionPolicy: slipwayk8sfacebookcomv1.DeletionPolicyDelete,
+				},
+				Status: slipwayk8sfacebookcomv1.ImageMirrorStatus{
+					Images: []slipwayk8sfacebookcomv1.ImageStatus{{
+						Name: "app",
+						Destinations: []slipwayk8sfacebookcomv1.DestinationStatus{{
+							Repo:            "registry.example.com/dst/",
+							CreatedTagCount: tt.createdTags,
+						}},
+					}},
+				},
+			}
+			if tt.forceDelete {
+				imageMirror.Annotations = map[string]string{slipwayk8sfacebookcomv1.ForceDeleteAnnotation: "true"}
+			}
+			c := fake.NewFakeClientWithScheme(scheme, imageMirror)
+			recorder := record.NewFakeRecorder(10)
+
+			_, err := finalizeMirror(context.Background(), c, recorder, ctrl.Log, mirrorObject{
+				Object:             imageMirror,
+				Kind:               "ImageMirror",
+				Meta:               imageMirror.ObjectMeta,
+				Spec:               imageMirror.Spec,
+				Status:             &imageMirror.Status,
+				InventoryNamespace: "default",
+				InventoryReader:    c,
+			})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("finalizeMirror() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if got := hasFinalizer(mirrorObject{Meta: imageMirror.ObjectMeta}); got != tt.wantFinalizer {
+				t.Errorf("finalizer kept = %v, want %v", got, tt.wantFinalizer)
+			}
+			if tt.wantFinalizer {
+				deleting := slipwayk8sfacebookcomv1.FindCondition(imageMirror.Status.Conditions, slipwayk8sfacebookcomv1.ConditionDeleting)
+				if deleting == nil || deleting.Reason != ReasonDeletionFailed {
+					t.Errorf("Deleting condition = %+v, want reason %s", deleting, ReasonDeletionFailed)
+				}
+			}
+
+			select {
+			case e := <-recorder.Events:
+				if fields := strings.Fields(e); len(fields) < 2 || fields[1] != tt.wantEventReason {
+					t.Errorf("recorded %q, want reason %s", e, tt.wantEventReason)
+				}
+			default:
+				t.Errorf("recorded no Event, want reason %s", tt.wantEventReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+const (
+	// TagRetryBaseDelay is how long to wait before retrying a tag which
+	// failed for the first time. The delay doubles for every attempt.
+	TagRetryBaseDelay = time.Minute
+	// TagRetryMaxDelay caps the delay between attempts to mirror a tag.
+	TagRetryMaxDelay = 6 * time.Hour
+)
+
+const (
+	// RoleSource identifies the source repository in a RepositoryError.
+	RoleSource = "source"
+	// RoleDestination identifies the destination repository in a RepositoryError.
+	RoleDestination = "destination"
+)
+
+// RepositoryError is returned by MirrorImages when the source or destination
+// repository could not be listed.
+type RepositoryError struct {
+	// Role is either RoleSource or RoleDestination.
+	Role string
+	Err  error
+}
+
+func (e *RepositoryError) Error() string {
+	return "unable to ListImageTags " + e.Role + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *RepositoryError) Unwrap() error {
+	return e.Err
+}
+
+// CredentialsError is returned by MirrorImages when the credentials for a
+// repository were rejected, e.g. because they do not allow pushing.
+type CredentialsError struct {
+	// Role is either RoleSource or RoleDestination.
+	Role string
+	Err  error
+}
+
+func (e *CredentialsError) Error() string {
+	return "invalid credentials for " + e.Role + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// ErrRepositoryNotFound is recorded by MirrorImages when a source or
+// destination repository does not exist.
+var ErrRepositoryNotFound = errors.New("repository does not exist, please create it first")
+
+// ErrInventoryMissing is returned by finalizeMirror when the status of a
+// mirror counts tags slipway created, but its inventory lists none, e.g.
+// because foreground deletion removed its MirrorInventories first.
+var ErrInventoryMissing = errors.New("the inventory of the tags slipway created is missing")
+
+// SecretError is recorded by MirrorImages when the Secret referenced by a
+// destination could not be read.
+type SecretError struct {
+	// Role is either RoleSource or RoleDestination.
+	Role string
+	Err  error
+}
+
+func (e *SecretError) Error() string {
+	return "unable to GetSecretData for " + e.Role + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *SecretError) Unwrap() error {
+	return e.Err
+}
+
+// IsUnauthorized returns true if err was caused by a registry rejecting our
+// credentials.
+func IsUnauthorized(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	return terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden
+}
+
+// IsNameUnknown returns true if err was caused by a registry reporting that
+// the repository does not exist.
+func IsNameUnknown(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+	for _, diagnostic := range terr.Errors {
+		if diagnostic.Code == transport.NameUnknownErrorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// ClassifyError returns the FailureReason which best describes err.
+func ClassifyError(err error) slipwayk8sfacebookcomv1.FailureReason {
+	var schema1 *remote.ErrSchema1
+	if errors.As(err, &schema1) {
+		return slipwayk8sfacebookcomv1.FailureManifestUnsupported
+	}
+
+	var terr *transport.Error
+	if errors.As(err, &terr) {
+		for _, diagnostic := range terr.Errors {
+			switch diagnostic.Code {
+			case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+				return slipwayk8sfacebookcomv1.FailureUnauthorized
+			case transport.ManifestUnknownErrorCode, transport.NameUnknownErrorCode, transport.BlobUnknownErrorCode:
+				return slipwayk8sfacebookcomv1.FailureNotFound
+			case transport.UnsupportedErrorCode, transport.ManifestInvalidErrorCode:
+				return slipwayk8sfacebookcomv1.FailureManifestUnsupported
+			case "TOOMANYREQUESTS":
+				return slipwayk8sfacebookcomv1.FailureRateLimited
+			}
+		}
+
+		switch {
+		case terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden:
+			return slipwayk8sfacebookcomv1.FailureUnauthorized
+		case terr.StatusCode == http.StatusNotFound:
+			return slipwayk8sfacebookcomv1.FailureNotFound
+		case terr.StatusCode == http.StatusTooManyRequests:
+			return slipwayk8sfacebookcomv1.FailureRateLimited
+		case terr.StatusCode == http.StatusUnsupportedMediaType:
+			return slipwayk8sfacebookcomv1.FailureManifestUnsupported
+		case terr.StatusCode >= http.StatusInternalServerError:
+			return slipwayk8sfacebookcomv1.FailureNetwork
+		}
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) {
+		return slipwayk8sfacebookcomv1.FailureNetwork
+	}
+
+	return slipwayk8sfacebookcomv1.FailureUnknown
+}
+
+// TagRetryDelay returns how long to wait before the given attempt to mirror a
+// tag, which doubles from TagRetryBaseDelay up to TagRetryMaxDelay.
+func TagRetryDelay(attempts int32) time.Duration {
+	delay := TagRetryBaseDelay
+	for i := int32(1); i < attempts; i++ {
+		delay *= 2
+		if delay >= TagRetryMaxDelay {
+			return TagRetryMaxDelay
+		}
+	}
+	return delay
+}
+
+// NewFailedTag records a failure to mirror tag at now, counting on from
+// previous, which is the zero value if the tag has not failed before.
+func NewFailedTag(previous slipwayk8sfacebookcomv1.FailedTag, tag string, err error, now time.Time) slipwayk8sfacebookcomv1.FailedTag {
+	attempts := previous.Attempts + 1
+	return slipwayk8sfacebookcomv1.FailedTag{
+		Tag:             tag,
+		Reason:          ClassifyError(err),
+		Message:         err.Error(),
+		Attempts:        attempts,
+		LastFailureTime: metav1.NewTime(now),
+		NextRetryTime:   metav1.NewTime(now.Add(TagRetryDelay(attempts))),
+	}
+}
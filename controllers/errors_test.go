@@ -0,0 +1,155 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// registryError returns a transport.Error with status and, if code is set,
+// a single diagnostic.
+func registryError(status int, code transport.ErrorCode) error {
+	terr := &transport.Error{StatusCode: status}
+	if code != "" {
+		terr.Errors = []transport.Diagnostic{{Code: code}}
+	}
+	return terr
+}
+
+func TestClassifyError(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		err  error
+		want slipwayk8sfacebookcomv1.FailureReason
+	}{
+		{"unknown", errors.New("boom"), slipwayk8sfacebookcomv1.FailureUnknown},
+		{"schema1", &remote.ErrSchema1{}, slipwayk8sfacebookcomv1.FailureManifestUnsupported},
+		{"wrapped schema1", errors.Wrap(&remote.ErrSchema1{}, "unable to GetManifest"), slipwayk8sfacebookcomv1.FailureManifestUnsupported},
+		{"dial", dialErr, slipwayk8sfacebookcomv1.FailureNetwork},
+		{"url dial", &url.Error{Op: "Get", URL: "https://registry.example.com/v2/", Err: dialErr}, slipwayk8sfacebookcomv1.FailureNetwork},
+		{"wrapped dial", errors.Wrap(dialErr, "unable to CopyImage"), slipwayk8sfacebookcomv1.FailureNetwork},
+
+		{"unauthorized code", registryError(http.StatusBadRequest, transport.UnauthorizedErrorCode), slipwayk8sfacebookcomv1.FailureUnauthorized},
+		{"denied code", registryError(http.StatusBadRequest, transport.DeniedErrorCode), slipwayk8sfacebookcomv1.FailureUnauthorized},
+		{"manifest unknown code", registryError(http.StatusBadRequest, transport.ManifestUnknownErrorCode), slipwayk8sfacebookcomv1.FailureNotFound},
+		{"name unknown code", registryError(http.StatusBadRequest, transport.NameUnknownErrorCode), slipwayk8sfacebookcomv1.FailureNotFound},
+		{"blob unknown code", registryError(http.StatusBadRequest, transport.BlobUnknownErrorCode), slipwayk8sfacebookcomv1.FailureNotFound},
+		{"unsupported code", registryError(http.StatusBadRequest, transport.UnsupportedErrorCode), slipwayk8sfacebookcomv1.FailureManifestUnsupported},
+		{"manifest invalid code", registryError(http.StatusBadRequest, transport.ManifestInvalidErrorCode), slipwayk8sfacebookcomv1.FailureManifestUnsupported},
+		{"too many requests code", registryError(http.StatusBadRequest, "TOOMANYREQUESTS"), slipwayk8sfacebookcomv1.FailureRateLimited},
+		{"code wins over status", registryError(http.StatusInternalServerError, transport.DeniedErrorCode), slipwayk8sfacebookcomv1.FailureUnauthorized},
+		{"unrecognized code", registryError(http.StatusNotFound, transport.SizeInvalidErrorCode), slipwayk8sfacebookcomv1.FailureNotFound},
+
+		{"401", registryError(http.StatusUnauthorized, ""), slipwayk8sfacebookcomv1.FailureUnauthorized},
+		{"403", registryError(http.StatusForbidden, ""), slipwayk8sfacebookcomv1.FailureUnauthorized},
+		{"404", registryError(http.StatusNotFound, ""), slipwayk8sfacebookcomv1.FailureNotFound},
+		{"415", registryError(http.StatusUnsupportedMediaType, ""), slipwayk8sfacebookcomv1.FailureManifestUnsupported},
+		{"429", registryError(http.StatusTooManyRequests, ""), slipwayk8sfacebookcomv1.FailureRateLimited},
+		{"500", registryError(http.StatusInternalServerError, ""), slipwayk8sfacebookcomv1.FailureNetwork},
+		{"503", registryError(http.StatusServiceUnavailable, ""), slipwayk8sfacebookcomv1.FailureNetwork},
+		{"400", registryError(http.StatusBadRequest, ""), slipwayk8sfacebookcomv1.FailureUnknown},
+		{"wrapped 429", &RepositoryError{Role: RoleSource, Err: errors.Wrap(registryError(http.StatusTooManyRequests, ""), "unable to ListWithContext")}, slipwayk8sfacebookcomv1.FailureRateLimited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsUnauthorizedAndIsNameUnknown(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		unauthorized bool
+		nameUnknown  bool
+	}{
+		{"plain", errors.New("boom"), false, false},
+		{"401", registryError(http.StatusUnauthorized, ""), true, false},
+		{"403", errors.Wrap(registryError(http.StatusForbidden, ""), "unable to List"), true, false},
+		{"name unknown", registryError(http.StatusNotFound, transport.NameUnknownErrorCode), false, true},
+		{"manifest unknown", registryError(http.StatusNotFound, transport.ManifestUnknownErrorCode), false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsUnauthorized(tt.err); got != tt.unauthorized {
+				t.Errorf("IsUnauthorized() = %v, want %v", got, tt.unauthorized)
+			}
+			if got := IsNameUnknown(tt.err); got != tt.nameUnknown {
+				t.Errorf("IsNameUnknown() = %v, want %v", got, tt.nameUnknown)
+			}
+		})
+	}
+}
+
+func TestTagRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempts int32
+		want     time.Duration
+	}{
+		{0, TagRetryBaseDelay},
+		{1, TagRetryBaseDelay},
+		{2, 2 * TagRetryBaseDelay},
+		{3, 4 * TagRetryBaseDelay},
+		{9, 256 * TagRetryBaseDelay},
+		{10, TagRetryMaxDelay},
+		{11, TagRetryMaxDelay},
+		{1000, TagRetryMaxDelay},
+	}
+
+	for _, tt := range tests {
+		if got := TagRetryDelay(tt.attempts); got != tt.want {
+			t.Errorf("TagRetryDelay(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestNewFailedTag(t *testing.T) {
+	now := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	err := registryError(http.StatusTooManyRequests, "")
+
+	first := NewFailedTag(slipwayk8sfacebookcomv1.FailedTag{}, "v1", err, now)
+	if first.Tag != "v1" || first.Attempts != 1 || first.Reason != slipwayk8sfacebookcomv1.FailureRateLimited {
+		t.Errorf("NewFailedTag() = %+v, want the first rate limited attempt of v1", first)
+	}
+	if !first.LastFailureTime.Time.Equal(now) || !first.NextRetryTime.Time.Equal(now.Add(TagRetryBaseDelay)) {
+		t.Errorf("NewFailedTag() failed at %v and retries at %v, want %v and %v",
+			first.LastFailureTime, first.NextRetryTime, now, now.Add(TagRetryBaseDelay))
+	}
+
+	later := now.Add(time.Hour)
+	second := NewFailedTag(first, "v1", err, later)
+	if second.Attempts != 2 || !second.NextRetryTime.Time.Equal(later.Add(2*TagRetryBaseDelay)) {
+		t.Errorf("NewFailedTag() = %+v, want a second attempt retried at %v", second, later.Add(2*TagRetryBaseDelay))
+	}
+}
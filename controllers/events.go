@@ -0,0 +1,169 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// Reasons of the Events recorded on mirrors.
+const (
+	EventReasonTagCopied          = "TagCopied"
+	EventReasonTagsCopied         = "TagsCopied"
+	EventReasonTagsSkipped        = "TagsSkipped"
+	EventReasonTagsFailed         = "TagsFailed"
+	EventReasonCredentialsFailed  = "CredentialsFailed"
+	EventReasonRepositoryNotFound = "DestinationRepositoryNotFound"
+	EventReasonSyncFailed         = "SyncFailed"
+	EventReasonImagesRetained     = "ImagesRetained"
+	EventReasonImagesDeleted      = "ImagesDeleted"
+	EventReasonDeletionFailed     = "DeletionFailed"
+	EventReasonForceDeleted       = "ForceDeleted"
+)
+
+// maxTagEvents is the most tags copied to a destination in one sync which
+// are recorded as individual Events. Beyond that, a single summary is
+// recorded, so that the first sync of a large repository does not flood the
+// API server.
+const maxTagEvents = 10
+
+// recordMirrorEvents records Events on obj describing result. Failures are
+// summarized per destination, and the messages of repeated failures do not
+// change between syncs, so that the event recorder aggregates them into a
+// single Event with a count. Tags whose last failure was before since, because
+// they are still backing off and were not retried, are not reported again.
+func recordMirrorEvents(recorder record.EventRecorder, obj runtime.Object, result MirrorResult, since time.Time) {
+	for _, image := range result.Images {
+		if image.Err != nil {
+			recordErrorEvent(recorder, obj, image.Name, image.Err)
+			continue
+		}
+
+		if len(image.SkippedTags) > 0 {
+			reasons := make(map[string]int)
+			for _, skipped := range image.SkippedTags {
+				reasons[string(skipped.Reason)]++
+			}
+			recorder.Eventf(obj, corev1.EventTypeNormal, EventReasonTagsSkipped,
+				"Skipped %d tags of %s: %s", len(image.SkippedTags), image.Name, countReasons(reasons))
+		}
+
+		for _, destination := range image.Destinations {
+			if destination.Err != nil {
+				recordErrorEvent(recorder, obj, image.Name+" "+destination.Repo, destination.Err)
+				continue
+			}
+			recordDestinationEvents(recorder, obj, image.Name, destination, since)
+		}
+	}
+}
+
+// recordDestinationEvents records the tags of imageName copied to, or which
+// failed to be mirrored to, a destination since the given time.
+func recordDestinationEvents(recorder record.EventRecorder, obj runtime.Object,
+	imageName string, destination DestinationResult, since time.Time) {
+	if len(destination.CopiedTags) > maxTagEvents {
+		recorder.Eventf(obj, corev1.EventTypeNormal, EventReasonTagsCopied,
+			"Copied %d tags of %s to %s", len(destination.CopiedTags), imageName, destination.Repo)
+	} else {
+		for _, copied := range destination.CopiedTags {
+			destTag := copied.Tag
+			if copied.DestTag != "" {
+				destTag = copied.DestTag
+			}
+			recorder.Eventf(obj, corev1.EventTypeNormal, EventReasonTagCopied,
+				"Copied %s:%s to %s:%s with digest %s", imageName, copied.Tag, destination.Repo, destTag, copied.DestDigest)
+		}
+	}
+
+	var failed []string
+	reasons := make(map[string]int)
+	for _, failure := range destination.FailedTags {
+		if failure.LastFailureTime.Time.Before(since) {
+			continue
+		}
+		failed = append(failed, failure.Tag)
+		reasons[string(failure.Reason)]++
+	}
+	if len(failed) == 0 {
+		return
+	}
+
+	reason := EventReasonTagsFailed
+	if reasons[string(slipwayk8sfacebookcomv1.FailureUnauthorized)] == len(failed) {
+		reason = EventReasonCredentialsFailed
+	}
+	sort.Strings(failed)
+	recorder.Eventf(obj, corev1.EventTypeWarning, reason,
+		"Failed to mirror %d tags of %s to %s (%s): %s", len(failed), imageName, destination.Repo,
+		countReasons(reasons), truncateList(failed, maxTagEvents))
+}
+
+// recordErrorEvent records err, which stopped subject from being synced at
+// all, as a Warning on obj.
+func recordErrorEvent(recorder record.EventRecorder, obj runtime.Object, subject string, err error) {
+	var secretErr *SecretError
+	var credentialsErr *CredentialsError
+
+	reason := EventReasonSyncFailed
+	switch {
+	case errors.Is(err, ErrRepositoryNotFound):
+		reason = EventReasonRepositoryNotFound
+	case errors.As(err, &secretErr), errors.As(err, &credentialsErr), IsUnauthorized(err):
+		reason = EventReasonCredentialsFailed
+	}
+
+	if subject == "" {
+		recorder.Event(obj, corev1.EventTypeWarning, reason, err.Error())
+		return
+	}
+	recorder.Eventf(obj, corev1.EventTypeWarning, reason, "%s: %v", subject, err)
+}
+
+// countReasons formats counts by reason, e.g. "2 NotIncluded, 1 TooOld", in
+// a stable order.
+func countReasons(counts map[string]int) string {
+	reasons := make([]string, 0, len(counts))
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[reason], reason))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// truncateList joins at most max items, noting how many were left out.
+func truncateList(items []string, max int) string {
+	if len(items) <= max {
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(items[:max], ", "), len(items)-max)
+}
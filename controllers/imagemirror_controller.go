@@ -21,10 +21,20 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/api/kv"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
 )
@@ -32,92 +42,367 @@ import (
 // ImageMirrorReconciler reconciles a ImageMirror object
 type ImageMirrorReconciler struct {
 	client.Client
-	Log    logr.Logger
-	Scheme *runtime.Scheme
+	Log      logr.Logger
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// APIReader reads MirrorInventories from the API server rather than the
+	// cache, which may not yet have the shards written by the last sync.
+	APIReader client.Reader
+
+	// Notifications, if set, receives ImageMirrors to be synced immediately
+	// because their source was pushed to.
+	Notifications <-chan event.GenericEvent
 }
 
 // +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=imagemirrors,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=imagemirrors/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=imagemirrors/finalizers,verbs=update
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=mirrorinventories,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is called when a resource we are watching may have changed.
 func (r *ImageMirrorReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	var imageMirror slipwayk8sfacebookcomv1.ImageMirror
 
-	ctx := context.Background()
+	ctx, span := startSpan(context.Background(), "ImageMirror.Reconcile",
+		kv.String("slipway.namespace", req.Namespace), kv.String("slipway.name", req.Name))
+	defer span.End()
 	log := r.Log.WithValues("imagemirror", req.NamespacedName)
 
 	// Get current version of the spec.
 	if err := r.Get(ctx, req.NamespacedName, &imageMirror); err != nil {
 		log.Error(err, "unable to fetch ImageMirror")
+		if apierrors.IsNotFound(err) {
+			deleteMirrorMetrics(req.NamespacedName)
+		}
 		// we'll ignore not-found errors, since they can't be fixed by an immediate
 		// requeue (we'll need to wait for a new notification), and we can get them
 		// on deleted requests.
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	return syncMirror(ctx, r.Client, r.Recorder, log, mirrorObject{
+		Object:     &imageMirror,
+		Kind:       "ImageMirror",
+		Meta:       imageMirror.ObjectMeta,
+		Spec:       imageMirror.Spec,
+		Status:     &imageMirror.Status,
+		Generation: imageMirror.ObjectMeta.Generation,
+		GetSecretData: func(name string) (SecretData, error) {
+			return r.GetSecretData(ctx, imageMirror.ObjectMeta.Namespace, name)
+		},
+		InventoryNamespace: imageMirror.ObjectMeta.Namespace,
+		InventoryReader:    r.APIReader,
+	})
+}
+
+// mirrorObject is an ImageMirror or ClusterImageMirror to be synced. Status
+// must point into Object, so that updating Object updates the status.
+type mirrorObject struct {
+	Object     runtime.Object
+	Kind       string
+	Meta       metav1.ObjectMeta
+	Spec       slipwayk8sfacebookcomv1.ImageMirrorSpec
+	Status     *slipwayk8sfacebookcomv1.ImageMirrorStatus
+	Generation int64
+
+	// GetSecretData reads a Secret referenced by Spec.
+	GetSecretData SecretGetter
+
+	// InventoryNamespace is the namespace of the MirrorInventories of Object.
+	InventoryNamespace string
+	// InventoryReader reads the MirrorInventories of Object without a cache.
+	InventoryReader client.Reader
+}
+
+// syncMirror mirrors the images described by the spec of m, records the
+// outcome in its status and as Events, and returns the result and error for
+// Reconcile.
+func syncMirror(ctx context.Context, c client.Client, recorder record.EventRecorder,
+	log logr.Logger, m mirrorObject) (ctrl.Result, error) {
+	key := types.NamespacedName{Namespace: m.Meta.Namespace, Name: m.Meta.Name}
+	recordLastSuccessfulSync(key, *m.Status)
+
+	// Apply the deletion policy before the mirror is removed, and make sure
+	// it will be applied otherwise.
+	if !m.Meta.DeletionTimestamp.IsZero() {
+		return finalizeMirror(ctx, c, recorder, log, m)
+	}
+	if err := addFinalizer(ctx, c, m); err != nil {
+		log.Error(err, "unable to add finalizer")
+		return ctrl.Result{}, err
+	}
+
+	// A suspended mirror keeps its status, and is not synced again until it
+	// is resumed, which changes its spec.
+	if m.Spec.Suspend {
+		log.Info("Mirroring is suspended")
+		m.Status.ObservedGeneration = m.Generation
+		m.Status.NextSyncTime = nil
+		setSuspendedConditions(m.Status, m.Generation)
+		if err := c.Status().Update(ctx, m.Object); err != nil {
+			log.Error(err, "unable to update status")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Record that a sync has started, so that long running syncs are visible.
+	generation := m.Generation
+	syncTime := metav1.Now()
+	m.Status.ObservedGeneration = generation
+	m.Status.LastSyncTime = &syncTime
+	if requested, ok := m.Meta.Annotations[slipwayk8sfacebookcomv1.SyncRequestedAnnotation]; ok {
+		m.Status.LastHandledSyncRequest = requested
+	}
+	setSyncingConditions(m.Status, generation)
+	if err := c.Status().Update(ctx, m.Object); err != nil {
+		log.Error(err, "unable to update status")
+		return ctrl.Result{}, err
+	}
+
 	// Get credentials needed to mirror. We unconditionally read these so that
 	// we always have the latest copy, relying on the shared informer cache to
 	// avoid unnecessary reads.
-	sourceSecretData, err := r.GetSecretData(ctx, imageMirror.ObjectMeta.Namespace, imageMirror.Spec.SourceSecretName)
+	sourceSecretData, err := m.GetSecretData(m.Spec.SourceSecretName)
 	if err != nil {
 		log.Error(err, "unable to GetSecretData for source")
-		return ctrl.Result{RequeueAfter: time.Minute}, err
+		recordErrorEvent(recorder, m.Object, "", &SecretError{Role: RoleSource, Err: err})
+		return updateFailedStatus(ctx, c, log, m, err, setSecretConditions)
 	}
 	log.Info("Got source secret", "username", sourceSecretData.Username)
 
-	destSecretData, err := r.GetSecretData(ctx, imageMirror.ObjectMeta.Namespace, imageMirror.Spec.DestSecretName)
+	inventory, err := loadInventory(ctx, m.InventoryReader, m)
 	if err != nil {
-		log.Error(err, "unable to GetSecretData for dest")
-		return ctrl.Result{RequeueAfter: time.Minute}, err
+		log.Error(err, "unable to read inventory")
+		return ctrl.Result{}, err
 	}
-	log.Info("Got destination secret", "username", destSecretData.Username)
 
-	// Mirror tags based on the users intent.
-	mirroredTags, err := MirrorImages(ctx, log, imageMirror, sourceSecretData, destSecretData)
+	// Mirror tags based on the users intent. Credentials for each
+	// destination are read as it is synced, so that a missing Secret only
+	// affects its own destination.
+	imageMirror := slipwayk8sfacebookcomv1.ImageMirror{ObjectMeta: m.Meta, Spec: m.Spec, Status: *m.Status}
+	result, err := MirrorImages(ctx, log, imageMirror, inventory, sourceSecretData, m.GetSecretData)
 	if err != nil {
 		log.Error(err, "unable to MirrorImages")
-		return ctrl.Result{RequeueAfter: time.Minute}, err
+		recordErrorEvent(recorder, m.Object, "", err)
+		return updateFailedStatus(ctx, c, log, m, err,
+			func(status *slipwayk8sfacebookcomv1.ImageMirrorStatus, generation int64, err error) {
+				setMirrorConditions(status, generation, result, err)
+			})
 	}
 	log.Info("Finished mirroring images")
+	recordMirrorEvents(recorder, m.Object, result, syncTime.Time)
+	recordMirrorMetrics(key, result)
+
+	// The full list of tags is kept out of status, which only summarizes
+	// them, so that it does not grow with the source.
+	if err := writeInventory(ctx, c, m, newInventory(inventory, result)); err != nil {
+		log.Error(err, "unable to write inventory")
+		return ctrl.Result{}, err
+	}
+
+	// Work out when to look for new tags again. An invalid schedule should
+	// not stop mirroring, so fall back to the default interval.
+	now := time.Now()
+	nextSyncTime, err := NextSyncTime(m.Spec, now)
+	if err != nil {
+		log.Error(err, "unable to compute NextSyncTime, using default interval")
+		nextSyncTime = now.Add(DefaultInterval)
+	}
 
 	// Update status with the current state.
-	imageMirror.Status.MirroredTags = mirroredTags
-	if err := r.Status().Update(ctx, &imageMirror); err != nil {
-		log.Error(err, "unable to update ImageMirror status")
+	images := make([]slipwayk8sfacebookcomv1.ImageStatus, 0, len(result.Images))
+	for _, image := range result.Images {
+		images = append(images, imageStatus(m.Status.FindImage(image.Name), generation, image, now))
+	}
+
+	m.Status.Images = images
+	m.Status.InventoryNamespace = m.InventoryNamespace
+	m.Status.NextSyncTime = &metav1.Time{Time: nextSyncTime}
+	destinationErr := result.Err()
+	if destinationErr == nil {
+		m.Status.LastSuccessfulSyncTime = &metav1.Time{Time: now}
+		recordLastSuccessfulSync(key, *m.Status)
+	}
+	setMirrorConditions(m.Status, generation, result, nil)
+	if err := c.Status().Update(ctx, m.Object); err != nil {
+		log.Error(err, "unable to update status")
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	if destinationErr != nil {
+		log.Error(destinationErr, "unable to sync some destinations")
+	}
+	requeueTime := RequeueTime(nextSyncTime, result.NextRetryTime(), destinationErr != nil, now)
+	log.Info("Scheduled next sync", "nextSyncTime", nextSyncTime, "requeueTime", requeueTime)
+	return ctrl.Result{RequeueAfter: requeueTime.Sub(now)}, nil
+}
+
+// imageStatus returns the status of an image given the result of mirroring
+// it, and its previous status, which may be nil. If the image could not be
+// mirrored at all, the previous state of its tags is carried over. The tags
+// themselves are only counted; they are listed in the inventory.
+func imageStatus(previous *slipwayk8sfacebookcomv1.ImageStatus, generation int64,
+	result ImageResult, now time.Time) slipwayk8sfacebookcomv1.ImageStatus {
+	status := slipwayk8sfacebookcomv1.ImageStatus{
+		Name:             result.Name,
+		MirroredTagCount: int32(len(result.MirroredTags)),
+		SelectedTagCount: int32(len(result.SelectedTags)),
+		SkippedTagCount:  int32(len(result.SkippedTags)),
+	}
+	if previous != nil {
+		status.Conditions = previous.Conditions
+		if result.Err != nil {
+			status.MirroredTagCount = previous.MirroredTagCount
+			status.SelectedTagCount = previous.SelectedTagCount
+			status.SkippedTagCount = previous.SkippedTagCount
+			status.Destinations = previous.Destinations
+		}
+	}
+
+	for _, destination := range result.Destinations {
+		destinationStatus := slipwayk8sfacebookcomv1.DestinationStatus{
+			Repo:             destination.Repo,
+			MirroredTagCount: int32(len(destination.MirroredTags)),
+			CreatedTagCount:  int32(len(destination.CreatedTags)),
+			RecentTags:       recentTags(destination.Tags),
+			DriftedTags:      destination.DriftedTags,
+			FailedTags:       destination.FailedTags,
+			PrunedTags:       destination.PrunedTags,
+			PrunableTags:     destination.PrunableTags,
+			FailedPrunes:     destination.FailedPrunes,
+			PlannedTags:      destination.PlannedTags,
+
+			PushCheckedSecretVersion: destination.PushCheckedSecretVersion,
+		}
+		if previous != nil {
+			if previousDestination := previous.FindDestination(destination.Repo); previousDestination != nil {
+				destinationStatus.Conditions = previousDestination.Conditions
+				destinationStatus.LastSuccessfulSyncTime = previousDestination.LastSuccessfulSyncTime
+			}
+		}
+		if destination.Err == nil {
+			destinationStatus.LastSuccessfulSyncTime = &metav1.Time{Time: now}
+		}
+		setDestinationConditions(&destinationStatus, generation, destination)
+		status.Destinations = append(status.Destinations, destinationStatus)
+	}
+
+	setImageConditions(&status, generation, result)
+	return status
+}
+
+// updateFailedStatus records a failed sync in the status of m using
+// setConditions, and returns the result and error for Reconcile.
+func updateFailedStatus(ctx context.Context, c client.Client, log logr.Logger, m mirrorObject, err error,
+	setConditions func(*slipwayk8sfacebookcomv1.ImageMirrorStatus, int64, error)) (ctrl.Result, error) {
+	setConditions(m.Status, m.Generation, err)
+	m.Status.NextSyncTime = &metav1.Time{Time: time.Now().Add(time.Minute)}
+	if uerr := c.Status().Update(ctx, m.Object); uerr != nil {
+		log.Error(uerr, "unable to update status")
+	}
+
+	return ctrl.Result{RequeueAfter: time.Minute}, err
 }
 
-// GetSecretData returns basic credentials from the secret named name in
+// GetSecretData returns the credentials from the secret named name in
 // namespace, and an err, if any.
-func (r *ImageMirrorReconciler) GetSecretData(ctx context.Context, namespace, name string) (data SecretData, err error) {
+func (r *ImageMirrorReconciler) GetSecretData(ctx context.Context, namespace, name string) (SecretData, error) {
+	return getSecretData(ctx, r.Client, namespace, name)
+}
+
+// getSecretData returns the credentials from the secret named name in
+// namespace, or empty credentials if name is empty.
+func getSecretData(ctx context.Context, c client.Client, namespace, name string) (data SecretData, err error) {
 	if name == "" {
 		return data, nil
 	}
 
 	// Get the resource using a typed object.
 	secret := &corev1.Secret{}
-	if err := r.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, secret); err != nil {
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, secret); err != nil {
 		return data, err
 	}
 
-	if value, ok := secret.Data["username"]; ok {
-		data.Username = string(value)
+	return ParseSecretData(secret)
+}
+
+// secretNameIndex indexes ImageMirrors by the names of the Secrets they
+// reference, so that they can be found when one of those Secrets changes.
+const secretNameIndex = ".spec.secretNames"
+
+// imageMirrorSecretNames returns the names of the Secrets referenced by an
+// ImageMirror.
+func imageMirrorSecretNames(obj runtime.Object) []string {
+	imageMirror, ok := obj.(*slipwayk8sfacebookcomv1.ImageMirror)
+	if !ok {
+		return nil
+	}
+
+	return imageMirror.Spec.SecretNames()
+}
+
+// secretToImageMirrors maps a Secret to reconcile requests for every
+// ImageMirror in its namespace which references it.
+func (r *ImageMirrorReconciler) secretToImageMirrors(obj handler.MapObject) []reconcile.Request {
+	var imageMirrors slipwayk8sfacebookcomv1.ImageMirrorList
+	if err := r.List(context.Background(), &imageMirrors,
+		client.InNamespace(obj.Meta.GetNamespace()),
+		client.MatchingFields{secretNameIndex: obj.Meta.GetName()}); err != nil {
+		r.Log.Error(err, "unable to list ImageMirrors for Secret",
+			"secret", obj.Meta.GetNamespace()+"/"+obj.Meta.GetName())
+		return nil
 	}
 
-	if value, ok := secret.Data["password"]; ok {
-		data.Password = string(value)
+	requests := make([]reconcile.Request, 0, len(imageMirrors.Items))
+	for _, imageMirror := range imageMirrors.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: imageMirror.Namespace,
+			Name:      imageMirror.Name,
+		}})
 	}
+	return requests
+}
 
-	return data, nil
+// specChanged filters out update events for an ImageMirror or
+// ClusterImageMirror which did not change its spec, request a sync, or
+// delete it, such as our own status updates. Otherwise every status update
+// would trigger another sync, defeating the interval and schedule.
+var specChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		switch e.ObjectNew.(type) {
+		case *slipwayk8sfacebookcomv1.ImageMirror, *slipwayk8sfacebookcomv1.ClusterImageMirror:
+			return e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration() ||
+				e.MetaOld.GetAnnotations()[slipwayk8sfacebookcomv1.SyncRequestedAnnotation] !=
+					e.MetaNew.GetAnnotations()[slipwayk8sfacebookcomv1.SyncRequestedAnnotation] ||
+				e.MetaOld.GetDeletionTimestamp().IsZero() != e.MetaNew.GetDeletionTimestamp().IsZero() ||
+				e.MetaOld.GetAnnotations()[slipwayk8sfacebookcomv1.ForceDeleteAnnotation] !=
+					e.MetaNew.GetAnnotations()[slipwayk8sfacebookcomv1.ForceDeleteAnnotation]
+		default:
+			return true
+		}
+	},
 }
 
 // SetupWithManager registers controller with manager and configures shared informer.
 func (r *ImageMirrorReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	if err := mgr.GetFieldIndexer().IndexField(&slipwayk8sfacebookcomv1.ImageMirror{},
+		secretNameIndex, imageMirrorSecretNames); err != nil {
+		return err
+	}
+
+	// Watch referenced Secrets, so that rotated credentials, or Secrets
+	// created after the ImageMirror, take effect immediately.
+	builder := ctrl.NewControllerManagedBy(mgr).
 		For(&slipwayk8sfacebookcomv1.ImageMirror{}).
-		Complete(r)
+		Watches(&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.secretToImageMirrors)})
+	if r.Notifications != nil {
+		builder = builder.Watches(&source.Channel{Source: r.Notifications}, &handler.EnqueueRequestForObject{})
+	}
+
+	return builder.WithEventFilter(specChanged).Complete(r)
 }
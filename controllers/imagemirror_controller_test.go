@@ -0,0 +1,137 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// TestReconcileSuspended checks that a suspended mirror keeps the status of
+// its last sync without talking to any registry, and that resuming it syncs.
+func TestReconcileSuspended(t *testing.T) {
+	tests := []struct {
+		name        string
+		suspend     bool
+		wantSyncing string
+		wantTags    []string
+	}{
+		{"suspended", true, ReasonSuspended, []string{"v1"}},
+		{"resumed", false, ReasonIdle, []string{"v1", "v2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			for _, tag := range []string{"v1", "v2"} {
+				img, err := random.Image(64, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.PushImage("src/app", tag, img)
+				if tag == "v1" {
+					r.PushImage("dst/app", tag, img)
+				}
+			}
+			r.Requests()
+
+			scheme := runtime.NewScheme()
+			if err := slipwayk8sfacebookcomv1.AddToScheme(scheme); err != nil {
+				t.Fatal(err)
+			}
+			lastSync := metav1.NewTime(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+			imageMirror := testImageMirror(r)
+			imageMirror.ObjectMeta = metav1.ObjectMeta{Namespace: "default", Name: "app", Generation: 2}
+			imageMirror.Spec.Suspend = tt.suspend
+			imageMirror.Status = slipwayk8sfacebookcomv1.ImageMirrorStatus{
+				ObservedGeneration: 1,
+				LastSyncTime:       &lastSync,
+				NextSyncTime:       &lastSync,
+				Images:             []slipwayk8sfacebookcomv1.ImageStatus{{Name: "app", MirroredTagCount: 1}},
+			}
+			setCondition(&imageMirror.Status.Conditions, 1, slipwayk8sfacebookcomv1.ConditionReady,
+				slipwayk8sfacebookcomv1.ConditionTrue, ReasonSynced, "")
+			c := fake.NewFakeClientWithScheme(scheme, &imageMirror)
+			reconciler := &ImageMirrorReconciler{
+				Client:    c,
+				Log:       ctrl.Log,
+				Scheme:    scheme,
+				Recorder:  record.NewFakeRecorder(100),
+				APIReader: c,
+			}
+
+			key := types.NamespacedName{Namespace: "default", Name: "app"}
+			result, err := reconciler.Reconcile(ctrl.Request{NamespacedName: key})
+			if err != nil {
+				t.Fatalf("Reconcile() = %v", err)
+			}
+			requests := r.Requests()
+			if tt.suspend {
+				if len(requests) > 0 {
+					t.Errorf("suspended mirror sent requests %v", requests)
+				}
+				if result.RequeueAfter != 0 || result.Requeue {
+					t.Errorf("suspended mirror requeued with %+v", result)
+				}
+			} else if len(requests) == 0 {
+				t.Error("resumed mirror sent no requests")
+			}
+			if got := r.Tags("dst/app"); !reflect.DeepEqual(got, tt.wantTags) {
+				t.Errorf("destination tags = %v, want %v", got, tt.wantTags)
+			}
+
+			var updated slipwayk8sfacebookcomv1.ImageMirror
+			if err := c.Get(context.Background(), key, &updated); err != nil {
+				t.Fatal(err)
+			}
+			status := updated.Status
+			if status.ObservedGeneration != 2 {
+				t.Errorf("ObservedGeneration = %d, want 2", status.ObservedGeneration)
+			}
+			syncing := slipwayk8sfacebookcomv1.FindCondition(status.Conditions, slipwayk8sfacebookcomv1.ConditionSyncing)
+			if syncing == nil || syncing.Reason != tt.wantSyncing {
+				t.Errorf("Syncing = %+v, want %s", syncing, tt.wantSyncing)
+			}
+			if !tt.suspend {
+				return
+			}
+			if !status.LastSyncTime.Equal(&lastSync) || status.NextSyncTime != nil {
+				t.Errorf("suspended mirror has LastSyncTime %v and NextSyncTime %v, want %v and none",
+					status.LastSyncTime, status.NextSyncTime, lastSync)
+			}
+			ready := slipwayk8sfacebookcomv1.FindCondition(status.Conditions, slipwayk8sfacebookcomv1.ConditionReady)
+			if ready == nil || ready.Status != slipwayk8sfacebookcomv1.ConditionTrue {
+				t.Errorf("Ready = %+v, want the status of the last sync", ready)
+			}
+			if len(status.Images) != 1 || status.Images[0].MirroredTagCount != 1 {
+				t.Errorf("Images = %+v, want those of the last sync", status.Images)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// ImageMirrorValidatorPath is the path at which ImageMirrorValidator is served.
+const ImageMirrorValidatorPath = "/validate-slipway-k8s-facebook-com-v1-imagemirror"
+
+// +kubebuilder:webhook:path=/validate-slipway-k8s-facebook-com-v1-imagemirror,mutating=false,failurePolicy=fail,groups=slipway.k8s.facebook.com,resources=imagemirrors,verbs=create;update,versions=v1,name=vimagemirror.kb.io
+
+// ImageMirrorValidator is a validating admission webhook which rejects
+// ImageMirrors with an invalid spec.
+type ImageMirrorValidator struct {
+	Client  client.Client
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+// Handle validates the ImageMirror in req.
+func (v *ImageMirrorValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var imageMirror slipwayk8sfacebookcomv1.ImageMirror
+	if err := v.decoder.Decode(req, &imageMirror); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	log := v.Log.WithValues("imagemirror", req.Namespace+"/"+req.Name)
+
+	// A mirror which is being deleted only loses its finalizer, which must
+	// not be blocked by a spec which was valid when it was created.
+	if imageMirror.DeletionTimestamp != nil {
+		return admission.Allowed("")
+	}
+
+	if errs := ValidateImageMirrorSpec(imageMirror.Spec, field.NewPath("spec")); len(errs) > 0 {
+		log.Info("Denied invalid ImageMirror", "errors", errs.ToAggregate().Error())
+		return admission.Denied(errs.ToAggregate().Error())
+	}
+
+	return allowWithSecretWarnings(ctx, v.Client, log, req.Namespace, imageMirror.Spec.SecretNames())
+}
+
+// allowWithSecretWarnings allows a request, pointing out which of the Secrets
+// named secretNames in namespace do not exist. A missing Secret is not fatal,
+// since it may be created after the mirror, but it is worth pointing out.
+// The admission API this operator is built against cannot return warnings to
+// the client, so the warning is recorded in the response reason and the log.
+func allowWithSecretWarnings(ctx context.Context, c client.Client, log logr.Logger,
+	namespace string, secretNames []string) admission.Response {
+	var warnings []string
+	for _, secretName := range secretNames {
+		secret := &corev1.Secret{}
+		err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: secretName}, secret)
+		if apierrors.IsNotFound(err) {
+			warnings = append(warnings, fmt.Sprintf("secret %q does not exist", secretName))
+		} else if err != nil {
+			log.Error(err, "unable to check Secret", "secret", secretName)
+		}
+	}
+
+	if len(warnings) > 0 {
+		log.Info("Allowed with warnings", "warnings", warnings)
+		return admission.Allowed(strings.Join(warnings, "; "))
+	}
+
+	return admission.Allowed("")
+}
+
+// ValidateImageMirrorSpec returns the problems with spec, if any. The paths of
+// the errors are relative to path.
+func ValidateImageMirrorSpec(spec slipwayk8sfacebookcomv1.ImageMirrorSpec, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if _, err := ParsePattern(spec.Pattern); err != nil {
+		errs = append(errs, field.Invalid(path.Child("pattern"), spec.Pattern, err.Error()))
+	}
+
+	for i, include := range spec.Include {
+		if _, err := ParsePattern(include); err != nil {
+			errs = append(errs, field.Invalid(path.Child("include").Index(i), include, err.Error()))
+		}
+	}
+
+	for i, exclude := range spec.Exclude {
+		if _, err := ParsePattern(exclude); err != nil {
+			errs = append(errs, field.Invalid(path.Child("exclude").Index(i), exclude, err.Error()))
+		}
+	}
+
+	for i, tag := range spec.Tags {
+		if err := ValidateTag(tag); err != nil {
+			errs = append(errs, field.Invalid(path.Child("tags").Index(i), tag, err.Error()))
+		}
+	}
+
+	imageNames := spec.AllImageNames()
+	if len(imageNames) == 0 && spec.ImageNamePattern == "" {
+		errs = append(errs, field.Required(path.Child("imageName"), "one of imageName, imageNames or imageNamePattern must be specified"))
+	}
+	if strings.ContainsAny(spec.ImageName, ":@") {
+		errs = append(errs, field.Invalid(path.Child("imageName"), spec.ImageName, "must not include a tag or digest"))
+	}
+	for i, imageName := range spec.ImageNames {
+		if imageName == "" {
+			errs = append(errs, field.Required(path.Child("imageNames").Index(i), ""))
+		} else if strings.ContainsAny(imageName, ":@") {
+			errs = append(errs, field.Invalid(path.Child("imageNames").Index(i), imageName, "must not include a tag or digest"))
+		}
+	}
+	if _, err := ParsePattern(spec.ImageNamePattern); err != nil {
+		errs = append(errs, field.Invalid(path.Child("imageNamePattern"), spec.ImageNamePattern, err.Error()))
+	}
+
+	if strings.ContainsAny(spec.DestImageName, ":@") {
+		errs = append(errs, field.Invalid(path.Child("destImageName"), spec.DestImageName, "must not include a tag or digest"))
+	}
+	if spec.DestImageName != "" && (len(imageNames) != 1 || spec.ImageNamePattern != "") {
+		errs = append(errs, field.Invalid(path.Child("destImageName"), spec.DestImageName, "may only be used to mirror a single image"))
+	}
+
+	if template := spec.TagTemplate; template != nil {
+		templatePath := path.Child("tagTemplate")
+		if _, err := NewTagRewriter(template); err != nil {
+			errs = append(errs, field.Invalid(templatePath.Child("regex"), template.Regex, err.Error()))
+		}
+		if template.Prefix != "" {
+			if err := ValidateTag(template.Prefix); err != nil {
+				errs = append(errs, field.Invalid(templatePath.Child("prefix"), template.Prefix, err.Error()))
+			}
+		}
+		// A suffix need not be a tag on its own, since it may start with
+		// a separator (e.g. -mirror).
+		if template.Suffix != "" {
+			if err := ValidateTag("x" + template.Suffix); err != nil {
+				errs = append(errs, field.Invalid(templatePath.Child("suffix"), template.Suffix, "must be a valid end of a tag"))
+			}
+		}
+		if template.Replacement != "" && template.Regex == "" {
+			errs = append(errs, field.Required(templatePath.Child("regex"), "replacement requires a regex"))
+		}
+	}
+
+	// The repositories are checked with the first image, or a placeholder
+	// if the images are discovered from the catalog. Every other image is
+	// named in the same way. An image name with a tag has already been
+	// reported, and is not blamed on the repositories.
+	imageName := "image"
+	if len(imageNames) > 0 && !strings.ContainsAny(imageNames[0], ":@") {
+		imageName = imageNames[0]
+	}
+	destImageName := spec.DestinationImageName(imageName)
+	if strings.ContainsAny(destImageName, ":@") {
+		destImageName = imageName
+	}
+
+	source, sourceErrs := validateRepo(spec.SourceRepo, imageName, path.Child("sourceRepo"))
+	errs = append(errs, sourceErrs...)
+
+	if spec.DestRepo == "" && len(spec.Destinations) == 0 {
+		errs = append(errs, field.Required(path.Child("destRepo"), "either destRepo or destinations must be specified"))
+	}
+
+	// Every destination must be valid, distinct from the source, and
+	// distinct from each other.
+	destPaths := []*field.Path{}
+	if spec.DestRepo != "" {
+		destPaths = append(destPaths, path.Child("destRepo"))
+	}
+	for i := range spec.Destinations {
+		destPaths = append(destPaths, path.Child("destinations").Index(i).Child("repo"))
+	}
+
+	seen := make(map[CanonicalName]bool)
+	for i, destination := range spec.AllDestinations() {
+		destPath := destPaths[i]
+		dest, destErrs := validateRepo(destination.Repo, destImageName, destPath)
+		errs = append(errs, destErrs...)
+		if len(destErrs) > 0 {
+			continue
+		}
+
+		if len(sourceErrs) == 0 && source.CanonicalName() == dest.CanonicalName() {
+			errs = append(errs, field.Invalid(destPath, destination.Repo, "must differ from the source image"))
+		}
+		if seen[dest.CanonicalName()] {
+			errs = append(errs, field.Duplicate(destPath, destination.Repo))
+		}
+		seen[dest.CanonicalName()] = true
+	}
+
+	for i, platform := range spec.Platforms {
+		if _, err := ParsePlatform(platform); err != nil {
+			errs = append(errs, field.Invalid(path.Child("platforms").Index(i), platform, err.Error()))
+		}
+	}
+
+	if spec.MinAge != nil && spec.MinAge.Duration < 0 {
+		errs = append(errs, field.Invalid(path.Child("minAge"), spec.MinAge.Duration.String(), "must not be negative"))
+	}
+
+	if spec.MaxAge != nil && spec.MaxAge.Duration <= 0 {
+		errs = append(errs, field.Invalid(path.Child("maxAge"), spec.MaxAge.Duration.String(), "must be positive"))
+	}
+
+	if spec.MinAge != nil && spec.MaxAge != nil && spec.MinAge.Duration > spec.MaxAge.Duration {
+		errs = append(errs, field.Invalid(path.Child("minAge"), spec.MinAge.Duration.String(), "must not exceed maxAge"))
+	}
+
+	if spec.Latest != nil && *spec.Latest < 1 {
+		errs = append(errs, field.Invalid(path.Child("latest"), *spec.Latest, "must be at least 1"))
+	}
+
+	if spec.Retention != nil && spec.Retention.Policy == slipwayk8sfacebookcomv1.RetentionKeepLatest && spec.Retention.Keep < 1 {
+		errs = append(errs, field.Invalid(path.Child("retention", "keep"), spec.Retention.Keep, "must be at least 1 for KeepLatest"))
+	}
+
+	if spec.Interval != nil && spec.Interval.Duration < 0 {
+		errs = append(errs, field.Invalid(path.Child("interval"), spec.Interval.Duration.String(), "must not be negative"))
+	}
+
+	if spec.Schedule != "" {
+		if _, _, err := ParseSchedule(spec.Schedule, spec.TimeZone); err != nil {
+			errs = append(errs, field.Invalid(path.Child("schedule"), spec.Schedule, err.Error()))
+		}
+	}
+
+	return errs
+}
+
+// validateRepo checks that repo, combined with imageName, is a valid
+// repository reference without a tag, and returns it.
+func validateRepo(repo, imageName string, path *field.Path) (Name, field.ErrorList) {
+	if repo == "" {
+		return Name{}, field.ErrorList{field.Required(path, "")}
+	}
+
+	if imageName == "" {
+		return Name{}, nil
+	}
+
+	normalName := GetNormalizedName(repo, imageName)
+	ref, err := ParseRef(normalName)
+	if err != nil {
+		return Name{}, field.ErrorList{field.Invalid(path, repo, err.Error())}
+	}
+
+	if ref.Tag != "" {
+		return Name{}, field.ErrorList{field.Invalid(path, repo, "must not include a tag")}
+	}
+
+	if _, err := name.NewRepository(normalName); err != nil {
+		return Name{}, field.ErrorList{field.Invalid(path, repo, err.Error())}
+	}
+
+	return ref.Name, nil
+}
+
+// SetupWithManager registers the webhook with the manager's webhook server.
+func (v *ImageMirrorValidator) SetupWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+
+	mgr.GetWebhookServer().Register(ImageMirrorValidatorPath, &webhook.Admission{Handler: v})
+	return nil
+}
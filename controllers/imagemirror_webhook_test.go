@@ -0,0 +1,296 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// validImageMirrorSpec returns a spec which ValidateImageMirrorSpec accepts.
+func validImageMirrorSpec() slipwayk8sfacebookcomv1.ImageMirrorSpec {
+	return slipwayk8sfacebookcomv1.ImageMirrorSpec{
+		SourceRepo: "docker.io",
+		DestRepo:   "registry.example.com/mirror/",
+		ImageName:  "nginx",
+		Pattern:    "semver: >=1.0",
+	}
+}
+
+// errorFields returns the type and path of each of errs, sorted.
+func errorFields(errs field.ErrorList) []string {
+	fields := []string{}
+	for _, err := range errs {
+		fields = append(fields, string(err.Type)+" "+err.Field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func TestValidateImageMirrorSpec(t *testing.T) {
+	duration := func(d time.Duration) *metav1.Duration { return &metav1.Duration{Duration: d} }
+	int32Ptr := func(i int32) *int32 { return &i }
+
+	tests := []struct {
+		name   string
+		modify func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec)
+		want   []string
+	}{
+		{
+			name:   "valid",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {},
+			want:   []string{},
+		},
+		{
+			name: "valid with every option",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.ImageName = ""
+				spec.ImageNamePattern = "glob:cuda-*"
+				spec.DestRepo = ""
+				spec.Destinations = []slipwayk8sfacebookcomv1.Destination{{Repo: "a.example.com/mirror"}, {Repo: "b.example.com/mirror"}}
+				spec.Include = []string{"glob:*-base"}
+				spec.Exclude = []string{"regex:-rc[0-9]+$"}
+				spec.Tags = []string{"latest"}
+				spec.TagTemplate = &slipwayk8sfacebookcomv1.TagTemplate{Prefix: "upstream-", Suffix: "-mirror", Regex: "^v(.*)$", Replacement: "${1}"}
+				spec.Platforms = []string{"linux/amd64", "linux/arm/v7"}
+				spec.MinAge, spec.MaxAge = duration(time.Hour), duration(24*time.Hour)
+				spec.Latest = int32Ptr(3)
+				spec.Retention = &slipwayk8sfacebookcomv1.Retention{Policy: slipwayk8sfacebookcomv1.RetentionKeepLatest, Keep: 5}
+				spec.Schedule, spec.TimeZone = "0 9 * * *", "Europe/London"
+			},
+			want: []string{},
+		},
+		{
+			name: "invalid patterns",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.Pattern = "regex:("
+				spec.Include = []string{"glob:*", "semver: not a range"}
+				spec.Exclude = []string{"regex:["}
+			},
+			want: []string{"FieldValueInvalid spec.exclude[0]", "FieldValueInvalid spec.include[1]", "FieldValueInvalid spec.pattern"},
+		},
+		{
+			name: "invalid tags",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.Tags = []string{"v1", "has space", ".hidden", "-flag"}
+			},
+			want: []string{"FieldValueInvalid spec.tags[1]", "FieldValueInvalid spec.tags[2]", "FieldValueInvalid spec.tags[3]"},
+		},
+		{
+			name:   "no image",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) { spec.ImageName = "" },
+			want:   []string{"FieldValueRequired spec.imageName"},
+		},
+		{
+			name: "invalid image names",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.ImageName = "nginx:1.19"
+				spec.ImageNames = []string{"redis", "", "busybox@sha256:abc"}
+				spec.ImageNamePattern = "regex:("
+			},
+			want: []string{
+				"FieldValueInvalid spec.imageName",
+				"FieldValueInvalid spec.imageNamePattern",
+				"FieldValueInvalid spec.imageNames[2]",
+				"FieldValueRequired spec.imageNames[1]",
+			},
+		},
+		{
+			name: "destImageName with several images",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.ImageNames = []string{"redis"}
+				spec.DestImageName = "web"
+			},
+			want: []string{"FieldValueInvalid spec.destImageName"},
+		},
+		{
+			name:   "destImageName with a tag",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) { spec.DestImageName = "web:latest" },
+			want:   []string{"FieldValueInvalid spec.destImageName"},
+		},
+		{
+			name: "invalid tag template",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.TagTemplate = &slipwayk8sfacebookcomv1.TagTemplate{Prefix: "-up", Suffix: " mirror", Regex: "(", Replacement: "${1}"}
+			},
+			want: []string{
+				"FieldValueInvalid spec.tagTemplate.prefix",
+				"FieldValueInvalid spec.tagTemplate.regex",
+				"FieldValueInvalid spec.tagTemplate.suffix",
+			},
+		},
+		{
+			name: "replacement without regex",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.TagTemplate = &slipwayk8sfacebookcomv1.TagTemplate{Replacement: "x"}
+			},
+			want: []string{"FieldValueRequired spec.tagTemplate.regex"},
+		},
+		{
+			name: "missing repositories",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.SourceRepo = ""
+				spec.DestRepo = ""
+			},
+			want: []string{"FieldValueRequired spec.destRepo", "FieldValueRequired spec.sourceRepo"},
+		},
+		{
+			name: "invalid repositories",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.SourceRepo = "Not A Registry"
+				spec.DestRepo = "registry.example.com/mirror:v1/"
+				spec.Destinations = []slipwayk8sfacebookcomv1.Destination{{Repo: "UPPER.example.com/Mirror"}}
+			},
+			want: []string{
+				"FieldValueInvalid spec.destRepo",
+				"FieldValueInvalid spec.destinations[0].repo",
+				"FieldValueInvalid spec.sourceRepo",
+			},
+		},
+		{
+			name:   "destination identical to the source",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) { spec.DestRepo = "index.docker.io/library/" },
+			want:   []string{"FieldValueInvalid spec.destRepo"},
+		},
+		{
+			name: "duplicate destinations",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.Destinations = []slipwayk8sfacebookcomv1.Destination{
+					{Repo: "other.example.com/mirror"},
+					{Repo: "registry.example.com/mirror"},
+					{Repo: "other.example.com/mirror/"},
+				}
+			},
+			want: []string{"FieldValueDuplicate spec.destinations[1].repo", "FieldValueDuplicate spec.destinations[2].repo"},
+		},
+		{
+			name: "invalid platforms",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.Platforms = []string{"linux/amd64", "linux", "linux/arm/v7/x", "/arm64"}
+			},
+			want: []string{
+				"FieldValueInvalid spec.platforms[1]",
+				"FieldValueInvalid spec.platforms[2]",
+				"FieldValueInvalid spec.platforms[3]",
+			},
+		},
+		{
+			name: "invalid ages",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.MinAge = duration(-time.Hour)
+				spec.MaxAge = duration(0)
+			},
+			want: []string{"FieldValueInvalid spec.maxAge", "FieldValueInvalid spec.minAge"},
+		},
+		{
+			name: "minAge exceeds maxAge",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.MinAge = duration(48 * time.Hour)
+				spec.MaxAge = duration(24 * time.Hour)
+			},
+			want: []string{"FieldValueInvalid spec.minAge"},
+		},
+		{
+			name:   "latest",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) { spec.Latest = int32Ptr(0) },
+			want:   []string{"FieldValueInvalid spec.latest"},
+		},
+		{
+			name: "retention",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.Retention = &slipwayk8sfacebookcomv1.Retention{Policy: slipwayk8sfacebookcomv1.RetentionKeepLatest}
+			},
+			want: []string{"FieldValueInvalid spec.retention.keep"},
+		},
+		{
+			name:   "interval",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) { spec.Interval = duration(-time.Minute) },
+			want:   []string{"FieldValueInvalid spec.interval"},
+		},
+		{
+			name:   "schedule",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) { spec.Schedule = "every hour" },
+			want:   []string{"FieldValueInvalid spec.schedule"},
+		},
+		{
+			name: "time zone",
+			modify: func(spec *slipwayk8sfacebookcomv1.ImageMirrorSpec) {
+				spec.Schedule = "@hourly"
+				spec.TimeZone = "Mars/Olympus_Mons"
+			},
+			want: []string{"FieldValueInvalid spec.schedule"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := validImageMirrorSpec()
+			tt.modify(&spec)
+			errs := ValidateImageMirrorSpec(spec, field.NewPath("spec"))
+			if got := errorFields(errs); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ValidateImageMirrorSpec() = %v, want %v", errs, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowWithSecretWarnings(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := corev1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewFakeClientWithScheme(scheme, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "present"},
+	})
+
+	tests := []struct {
+		name        string
+		namespace   string
+		secretNames []string
+		wantReason  string
+	}{
+		{"no secrets", "default", nil, ""},
+		{"present", "default", []string{"present"}, ""},
+		{"missing", "default", []string{"present", "missing"}, `secret "missing" does not exist`},
+		{"several missing", "default", []string{"a", "b"}, `secret "a" does not exist; secret "b" does not exist`},
+		{"other namespace", "other", []string{"present"}, `secret "present" does not exist`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := allowWithSecretWarnings(context.Background(), c, ctrl.Log, tt.namespace, tt.secretNames)
+			if !resp.Allowed {
+				t.Errorf("allowWithSecretWarnings() denied the request: %+v", resp.Result)
+			}
+			if got := string(resp.Result.Reason); got != tt.wantReason {
+				t.Errorf("allowWithSecretWarnings() reason = %q, want %q", got, tt.wantReason)
+			}
+		})
+	}
+}
@@ -0,0 +1,359 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// These are the reasons used for ImageMirrorSet conditions.
+const (
+	ReasonMirrorsReady    = "MirrorsReady"
+	ReasonMirrorsNotReady = "MirrorsNotReady"
+	ReasonNoMirrors       = "NoMirrors"
+	ReasonPending         = "Pending"
+	ReasonConfigMapError  = "ConfigMapError"
+	ReasonInvalidParams   = "InvalidParameters"
+	ReasonSyncFailed      = "SyncFailed"
+)
+
+// ImageMirrorSetReconciler reconciles a ImageMirrorSet object
+type ImageMirrorSetReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=imagemirrorsets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=imagemirrorsets/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=slipway.k8s.facebook.com,resources=imagemirrors,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+
+// Reconcile is called when a resource we are watching may have changed.
+func (r *ImageMirrorSetReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	var imageMirrorSet slipwayk8sfacebookcomv1.ImageMirrorSet
+
+	ctx := context.Background()
+	log := r.Log.WithValues("imagemirrorset", req.NamespacedName)
+
+	// Get current version of the spec.
+	if err := r.Get(ctx, req.NamespacedName, &imageMirrorSet); err != nil {
+		log.Error(err, "unable to fetch ImageMirrorSet")
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	status := imageMirrorSet.Status.DeepCopy()
+	generation := imageMirrorSet.ObjectMeta.Generation
+	status.ObservedGeneration = generation
+
+	parameters, err := r.GetParameters(ctx, &imageMirrorSet)
+	if err != nil {
+		// Leave the ImageMirrors alone rather than deleting those whose
+		// parameters could not be read.
+		log.Error(err, "unable to GetParameters")
+		setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonConfigMapError, err.Error())
+		if uerr := r.updateStatus(ctx, &imageMirrorSet, status); uerr != nil {
+			log.Error(uerr, "unable to update ImageMirrorSet status")
+		}
+		return ctrl.Result{RequeueAfter: time.Minute}, err
+	}
+
+	// Create or update an ImageMirror for each set of parameters.
+	desired := make(map[string]bool, len(parameters))
+	mirrors := make([]slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus, 0, len(parameters))
+	for _, params := range parameters {
+		name := imageMirrorSet.Name + "-" + params.Name
+		if desired[name] {
+			mirrors = append(mirrors, failedMirror(name, ReasonInvalidParams, "duplicate parameters for "+params.Name))
+			continue
+		}
+		desired[name] = true
+
+		if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+			mirrors = append(mirrors, failedMirror(name, ReasonInvalidParams, strings.Join(errs, "; ")))
+			continue
+		}
+
+		imageMirror, err := r.syncImageMirror(ctx, &imageMirrorSet, name, params)
+		if err != nil {
+			log.Error(err, "unable to sync ImageMirror", "name", name)
+			mirrors = append(mirrors, failedMirror(name, ReasonSyncFailed, err.Error()))
+			continue
+		}
+		mirrors = append(mirrors, summarizeImageMirror(imageMirror))
+	}
+
+	// Delete the ImageMirrors we created whose parameters were removed.
+	var imageMirrors slipwayk8sfacebookcomv1.ImageMirrorList
+	if err := r.List(ctx, &imageMirrors, client.InNamespace(imageMirrorSet.Namespace),
+		client.MatchingLabels{slipwayk8sfacebookcomv1.ImageMirrorSetLabel: string(imageMirrorSet.UID)}); err != nil {
+		log.Error(err, "unable to list ImageMirrors")
+		return ctrl.Result{}, err
+	}
+	for i := range imageMirrors.Items {
+		imageMirror := &imageMirrors.Items[i]
+		if desired[imageMirror.Name] || !metav1.IsControlledBy(imageMirror, &imageMirrorSet) {
+			continue
+		}
+		if err := r.Delete(ctx, imageMirror); client.IgnoreNotFound(err) != nil {
+			log.Error(err, "unable to delete ImageMirror", "name", imageMirror.Name)
+			return ctrl.Result{}, err
+		}
+		log.Info("Deleted ImageMirror", "name", imageMirror.Name)
+	}
+
+	setImageMirrorSetStatus(status, generation, mirrors)
+	if err := r.updateStatus(ctx, &imageMirrorSet, status); err != nil {
+		log.Error(err, "unable to update ImageMirrorSet status")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// GetParameters returns the parameters of each ImageMirror in imageMirrorSet,
+// those listed in its spec first, followed by those from its ConfigMap
+// ordered by name.
+func (r *ImageMirrorSetReconciler) GetParameters(ctx context.Context,
+	imageMirrorSet *slipwayk8sfacebookcomv1.ImageMirrorSet) ([]slipwayk8sfacebookcomv1.ImageMirrorSetParameters, error) {
+	parameters := append([]slipwayk8sfacebookcomv1.ImageMirrorSetParameters{}, imageMirrorSet.Spec.Parameters...)
+
+	generator := imageMirrorSet.Spec.ConfigMapGenerator
+	if generator == nil {
+		return parameters, nil
+	}
+
+	configMap := &corev1.ConfigMap{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: imageMirrorSet.Namespace, Name: generator.Name}, configMap); err != nil {
+		return nil, errors.Wrap(err, "unable to get ConfigMap")
+	}
+
+	names := make([]string, 0, len(configMap.Data))
+	for name := range configMap.Data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values, err := ParseParameters(configMap.Data[name])
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to ParseParameters for %s", name)
+		}
+		parameters = append(parameters, slipwayk8sfacebookcomv1.ImageMirrorSetParameters{Name: name, Values: values})
+	}
+	return parameters, nil
+}
+
+// syncImageMirror creates or updates the ImageMirror named name from the
+// template of imageMirrorSet and params, and returns it.
+func (r *ImageMirrorSetReconciler) syncImageMirror(ctx context.Context,
+	imageMirrorSet *slipwayk8sfacebookcomv1.ImageMirrorSet, name string,
+	params slipwayk8sfacebookcomv1.ImageMirrorSetParameters) (*slipwayk8sfacebookcomv1.ImageMirror, error) {
+	values := map[string]string{"name": params.Name}
+	for key, value := range params.Values {
+		values[key] = value
+	}
+
+	spec, err := RenderImageMirrorSpec(imageMirrorSet.Spec.Template.Spec, values)
+	if err != nil {
+		return nil, err
+	}
+
+	imageMirror := &slipwayk8sfacebookcomv1.ImageMirror{ObjectMeta: metav1.ObjectMeta{
+		Name:      name,
+		Namespace: imageMirrorSet.Namespace,
+	}}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, imageMirror, func() error {
+		// Never take over an ImageMirror which someone else created.
+		if imageMirror.ResourceVersion != "" && !metav1.IsControlledBy(imageMirror, imageMirrorSet) {
+			return errors.Errorf("ImageMirror %s already exists and is not part of this set", name)
+		}
+
+		if imageMirror.Labels == nil {
+			imageMirror.Labels = make(map[string]string)
+		}
+		for key, value := range imageMirrorSet.Spec.Template.Labels {
+			imageMirror.Labels[key] = value
+		}
+		imageMirror.Labels[slipwayk8sfacebookcomv1.ImageMirrorSetLabel] = string(imageMirrorSet.UID)
+		imageMirror.Spec = spec
+
+		return controllerutil.SetControllerReference(imageMirrorSet, imageMirror, r.Scheme)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to CreateOrUpdate")
+	}
+	return imageMirror, nil
+}
+
+// failedMirror summarizes an ImageMirror which could not be synced.
+func failedMirror(name, reason, message string) slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus {
+	return slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus{
+		Name:    name,
+		Ready:   slipwayk8sfacebookcomv1.ConditionFalse,
+		Reason:  reason,
+		Message: message,
+	}
+}
+
+// summarizeImageMirror returns the Ready condition and number of mirrored
+// tags of imageMirror. Its Ready condition is Unknown until it has been
+// synced since it was last changed.
+func summarizeImageMirror(imageMirror *slipwayk8sfacebookcomv1.ImageMirror) slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus {
+	summary := slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus{
+		Name:   imageMirror.Name,
+		Ready:  slipwayk8sfacebookcomv1.ConditionUnknown,
+		Reason: ReasonPending,
+	}
+	for _, image := range imageMirror.Status.Images {
+		summary.MirroredTags += image.MirroredTagCount
+	}
+
+	ready := slipwayk8sfacebookcomv1.FindCondition(imageMirror.Status.Conditions, slipwayk8sfacebookcomv1.ConditionReady)
+	if ready != nil && imageMirror.Status.ObservedGeneration == imageMirror.Generation {
+		summary.Ready = ready.Status
+		summary.Reason = ready.Reason
+		summary.Message = ready.Message
+	}
+	return summary
+}
+
+// setImageMirrorSetStatus records mirrors in status, and sets its Ready
+// condition to True iff every ImageMirror is ready.
+func setImageMirrorSetStatus(status *slipwayk8sfacebookcomv1.ImageMirrorSetStatus, generation int64,
+	mirrors []slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus) {
+	status.Mirrors = mirrors
+	status.ImageMirrors = int32(len(mirrors))
+	status.ReadyImageMirrors = 0
+	status.MirroredTags = 0
+
+	ready := slipwayk8sfacebookcomv1.ConditionTrue
+	var notReady []string
+	for _, mirror := range mirrors {
+		status.MirroredTags += mirror.MirroredTags
+		if mirror.Ready == slipwayk8sfacebookcomv1.ConditionTrue {
+			status.ReadyImageMirrors++
+			continue
+		}
+
+		if ready != slipwayk8sfacebookcomv1.ConditionFalse {
+			ready = mirror.Ready
+		}
+		notReady = append(notReady, mirror.Name+": "+mirror.Reason)
+	}
+
+	switch {
+	case len(mirrors) == 0:
+		setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionFalse, ReasonNoMirrors, "No parameters were given")
+	case ready == slipwayk8sfacebookcomv1.ConditionTrue:
+		setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			slipwayk8sfacebookcomv1.ConditionTrue, ReasonMirrorsReady,
+			fmt.Sprintf("%d ImageMirrors ready, %d tags mirrored", status.ReadyImageMirrors, status.MirroredTags))
+	default:
+		setCondition(&status.Conditions, generation, slipwayk8sfacebookcomv1.ConditionReady,
+			ready, ReasonMirrorsNotReady, strings.Join(notReady, "; "))
+	}
+}
+
+// updateStatus updates the status of imageMirrorSet to status, unless it is
+// unchanged. Otherwise every status update would trigger another, since the
+// set watches its own status.
+func (r *ImageMirrorSetReconciler) updateStatus(ctx context.Context,
+	imageMirrorSet *slipwayk8sfacebookcomv1.ImageMirrorSet, status *slipwayk8sfacebookcomv1.ImageMirrorSetStatus) error {
+	if equality.Semantic.DeepEqual(&imageMirrorSet.Status, status) {
+		return nil
+	}
+	imageMirrorSet.Status = *status
+	return r.Status().Update(ctx, imageMirrorSet)
+}
+
+// configMapNameIndex indexes ImageMirrorSets by the name of the ConfigMap
+// they read parameters from.
+const configMapNameIndex = ".spec.configMapGenerator.name"
+
+// imageMirrorSetConfigMapName returns the name of the ConfigMap referenced by
+// an ImageMirrorSet.
+func imageMirrorSetConfigMapName(obj runtime.Object) []string {
+	imageMirrorSet, ok := obj.(*slipwayk8sfacebookcomv1.ImageMirrorSet)
+	if !ok || imageMirrorSet.Spec.ConfigMapGenerator == nil {
+		return nil
+	}
+
+	return []string{imageMirrorSet.Spec.ConfigMapGenerator.Name}
+}
+
+// configMapToImageMirrorSets maps a ConfigMap to reconcile requests for
+// every ImageMirrorSet in its namespace which reads parameters from it.
+func (r *ImageMirrorSetReconciler) configMapToImageMirrorSets(obj handler.MapObject) []reconcile.Request {
+	var imageMirrorSets slipwayk8sfacebookcomv1.ImageMirrorSetList
+	if err := r.List(context.Background(), &imageMirrorSets,
+		client.InNamespace(obj.Meta.GetNamespace()),
+		client.MatchingFields{configMapNameIndex: obj.Meta.GetName()}); err != nil {
+		r.Log.Error(err, "unable to list ImageMirrorSets for ConfigMap",
+			"configmap", obj.Meta.GetNamespace()+"/"+obj.Meta.GetName())
+		return nil
+	}
+
+	requests := make([]reconcile.Request, 0, len(imageMirrorSets.Items))
+	for _, imageMirrorSet := range imageMirrorSets.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{
+			Namespace: imageMirrorSet.Namespace,
+			Name:      imageMirrorSet.Name,
+		}})
+	}
+	return requests
+}
+
+// SetupWithManager registers controller with manager and configures shared informer.
+func (r *ImageMirrorSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(&slipwayk8sfacebookcomv1.ImageMirrorSet{},
+		configMapNameIndex, imageMirrorSetConfigMapName); err != nil {
+		return err
+	}
+
+	// Owning the ImageMirrors means that changes to their status, such as
+	// becoming ready, are reflected in the status of the set.
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&slipwayk8sfacebookcomv1.ImageMirrorSet{}).
+		Owns(&slipwayk8sfacebookcomv1.ImageMirror{}).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(r.configMapToImageMirrorSets)}).
+		Complete(r)
+}
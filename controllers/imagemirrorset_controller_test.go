@@ -0,0 +1,175 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestSetImageMirrorSetStatus(t *testing.T) {
+	mirror := func(name string, ready slipwayk8sfacebookcomv1.ConditionStatus, tags int32) slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus {
+		return slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus{Name: name, Ready: ready, Reason: "Reason", MirroredTags: tags}
+	}
+
+	tests := []struct {
+		name          string
+		mirrors       []slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus
+		wantReady     slipwayk8sfacebookcomv1.ConditionStatus
+		wantReason    string
+		wantMessage   string
+		wantReadyNum  int32
+		wantTagsTotal int32
+	}{
+		{
+			name:       "no mirrors",
+			wantReady:  slipwayk8sfacebookcomv1.ConditionFalse,
+			wantReason: ReasonNoMirrors,
+		},
+		{
+			name: "all ready",
+			mirrors: []slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus{
+				mirror("a", slipwayk8sfacebookcomv1.ConditionTrue, 2),
+				mirror("b", slipwayk8sfacebookcomv1.ConditionTrue, 3),
+			},
+			wantReady:     slipwayk8sfacebookcomv1.ConditionTrue,
+			wantReason:    ReasonMirrorsReady,
+			wantMessage:   "2 ImageMirrors ready, 5 tags mirrored",
+			wantReadyNum:  2,
+			wantTagsTotal: 5,
+		},
+		{
+			name: "pending",
+			mirrors: []slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus{
+				mirror("a", slipwayk8sfacebookcomv1.ConditionTrue, 2),
+				mirror("b", slipwayk8sfacebookcomv1.ConditionUnknown, 0),
+			},
+			wantReady:     slipwayk8sfacebookcomv1.ConditionUnknown,
+			wantReason:    ReasonMirrorsNotReady,
+			wantMessage:   "b: Reason",
+			wantReadyNum:  1,
+			wantTagsTotal: 2,
+		},
+		{
+			name: "a failure outweighs pending mirrors",
+			mirrors: []slipwayk8sfacebookcomv1.ImageMirrorSetMirrorStatus{
+				mirror("a", slipwayk8sfacebookcomv1.ConditionUnknown, 0),
+				mirror("b", slipwayk8sfacebookcomv1.ConditionFalse, 1),
+				mirror("c", slipwayk8sfacebookcomv1.ConditionUnknown, 0),
+			},
+			wantReady:     slipwayk8sfacebookcomv1.ConditionFalse,
+			wantReason:    ReasonMirrorsNotReady,
+			wantMessage:   "a: Reason; b: Reason; c: Reason",
+			wantTagsTotal: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := &slipwayk8sfacebookcomv1.ImageMirrorSetStatus{ReadyImageMirrors: 7, MirroredTags: 7}
+			setImageMirrorSetStatus(status, 3, tt.mirrors)
+
+			if status.ImageMirrors != int32(len(tt.mirrors)) || status.ReadyImageMirrors != tt.wantReadyNum || status.MirroredTags != tt.wantTagsTotal {
+				t.Errorf("status counts %d mirrors, %d ready, %d tags, want %d, %d, %d",
+					status.ImageMirrors, status.ReadyImageMirrors, status.MirroredTags, len(tt.mirrors), tt.wantReadyNum, tt.wantTagsTotal)
+			}
+			ready := slipwayk8sfacebookcomv1.FindCondition(status.Conditions, slipwayk8sfacebookcomv1.ConditionReady)
+			if ready == nil {
+				t.Fatal("no Ready condition")
+			}
+			if ready.Status != tt.wantReady || ready.Reason != tt.wantReason || ready.ObservedGeneration != 3 {
+				t.Errorf("Ready = %+v, want %s/%s at generation 3", ready, tt.wantReady, tt.wantReason)
+			}
+			if tt.wantMessage != "" && ready.Message != tt.wantMessage {
+				t.Errorf("Ready message = %q, want %q", ready.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+// TestImageMirrorSetLongName checks that a set whose name is too long to be a
+// label value can still create, and later delete, its ImageMirrors.
+func TestImageMirrorSetLongName(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := slipwayk8sfacebookcomv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	imageMirrorSet := &slipwayk8sfacebookcomv1.ImageMirrorSet{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: strings.Repeat("s", 100), UID: types.UID("set-uid")},
+		Spec: slipwayk8sfacebookcomv1.ImageMirrorSetSpec{
+			Template: slipwayk8sfacebookcomv1.ImageMirrorTemplate{
+				Spec: slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "docker.io", ImageName: "$(name)"},
+			},
+			Parameters: []slipwayk8sfacebookcomv1.ImageMirrorSetParameters{{Name: "centos"}, {Name: "ubuntu"}},
+		},
+	}
+	c := fake.NewFakeClientWithScheme(scheme, imageMirrorSet)
+	r := &ImageMirrorSetReconciler{Client: c, Log: ctrl.Log, Scheme: scheme}
+	ctx := context.Background()
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: imageMirrorSet.Name}}
+
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	var imageMirrors slipwayk8sfacebookcomv1.ImageMirrorList
+	if err := c.List(ctx, &imageMirrors, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	if len(imageMirrors.Items) != 2 {
+		t.Fatalf("created %d ImageMirrors, want 2", len(imageMirrors.Items))
+	}
+	for _, imageMirror := range imageMirrors.Items {
+		value := imageMirror.Labels[slipwayk8sfacebookcomv1.ImageMirrorSetLabel]
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			t.Errorf("ImageMirror %s has an invalid label %q: %v", imageMirror.Name, value, errs)
+		}
+		if value != "set-uid" {
+			t.Errorf("ImageMirror %s is labelled %q, want the UID of the set", imageMirror.Name, value)
+		}
+		if wantImage := strings.TrimPrefix(imageMirror.Name, imageMirrorSet.Name+"-"); imageMirror.Spec.ImageName != wantImage {
+			t.Errorf("ImageMirror %s has imageName %q, want %q", imageMirror.Name, imageMirror.Spec.ImageName, wantImage)
+		}
+	}
+
+	if err := c.Get(ctx, req.NamespacedName, imageMirrorSet); err != nil {
+		t.Fatal(err)
+	}
+	imageMirrorSet.Spec.Parameters = imageMirrorSet.Spec.Parameters[:1]
+	if err := c.Update(ctx, imageMirrorSet); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.List(ctx, &imageMirrors, client.InNamespace("default")); err != nil {
+		t.Fatal(err)
+	}
+	if len(imageMirrors.Items) != 1 || imageMirrors.Items[0].Name != imageMirrorSet.Name+"-centos" {
+		t.Errorf("ImageMirrors after removing ubuntu = %d, want only %s-centos", len(imageMirrors.Items), imageMirrorSet.Name)
+	}
+}
@@ -0,0 +1,336 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// maxInventoryEntries is the most tags listed by one MirrorInventory, summed
+// over all of its lists. It keeps each object far below the size limit of
+// etcd, even if every tag has a long name and two digests.
+const maxInventoryEntries = 1000
+
+// maxRecentTags is the most recently copied tags of a destination which are
+// listed in status.
+const maxRecentTags = 10
+
+// Inventory is the full state of the tags of each image of a mirror, by
+// image name. It is stored in MirrorInventories rather than in status.
+type Inventory map[string]*slipwayk8sfacebookcomv1.ImageInventory
+
+// loadInventory reads the inventory of m from its MirrorInventories with c,
+// which should not be cached, since a shard missing from the cache would lose
+// track of its tags. Mirrors synced by earlier releases have none, so their
+// inventory is recovered from the tags recorded in their status.
+func loadInventory(ctx context.Context, c client.Reader, m mirrorObject) (Inventory, error) {
+	shards, err := listInventory(ctx, c, m)
+	if err != nil {
+		return nil, err
+	}
+	if len(shards) == 0 {
+		return statusInventory(m.Status), nil
+	}
+
+	sort.Slice(shards, func(i, j int) bool {
+		if shards[i].Image != shards[j].Image {
+			return shards[i].Image < shards[j].Image
+		}
+		return shards[i].Shard < shards[j].Shard
+	})
+
+	inventory := make(Inventory)
+	for _, shard := range shards {
+		image, ok := inventory[shard.Image]
+		if !ok {
+			image = &slipwayk8sfacebookcomv1.ImageInventory{}
+			inventory[shard.Image] = image
+		}
+		mergeInventory(image, shard.ImageInventory)
+	}
+	return inventory, nil
+}
+
+// listInventory returns the MirrorInventories controlled by m. Those left
+// behind by a deleted mirror of the same name are ignored until they are
+// garbage collected.
+func listInventory(ctx context.Context, c client.Reader, m mirrorObject) ([]slipwayk8sfacebookcomv1.MirrorInventory, error) {
+	var list slipwayk8sfacebookcomv1.MirrorInventoryList
+	if err := c.List(ctx, &list, client.InNamespace(m.InventoryNamespace),
+		client.MatchingLabels{inventoryLabel(m): string(m.Meta.UID)}); err != nil {
+		return nil, errors.Wrap(err, "unable to list MirrorInventories")
+	}
+
+	var shards []slipwayk8sfacebookcomv1.MirrorInventory
+	for _, shard := range list.Items {
+		if metav1.IsControlledBy(&shard, &m.Meta) {
+			shards = append(shards, shard)
+		}
+	}
+	return shards, nil
+}
+
+// statusInventory returns the inventory recorded in status by earlier
+// releases. Only the tags of each destination were needed to sync it.
+func statusInventory(status *slipwayk8sfacebookcomv1.ImageMirrorStatus) Inventory {
+	inventory := make(Inventory)
+	for _, image := range status.Images {
+		var destinations []slipwayk8sfacebookcomv1.DestinationInventory
+		for _, destination := range image.Destinations {
+			if len(destination.Tags) == 0 && len(destination.CreatedTags) == 0 {
+				continue
+			}
+			var mirroredTags []string
+			for _, tag := range destination.Tags {
+				mirroredTags = append(mirroredTags, tag.Tag)
+			}
+			destinations = append(destinations, slipwayk8sfacebookcomv1.DestinationInventory{
+				Repo:         destination.Repo,
+				MirroredTags: mirroredTags,
+				Tags:         destination.Tags,
+				CreatedTags:  destination.CreatedTags,
+			})
+		}
+		if len(destinations) > 0 {
+			inventory[image.Name] = &slipwayk8sfacebookcomv1.ImageInventory{Destinations: destinations}
+		}
+	}
+	return inventory
+}
+
+// mergeInventory appends the lists of shard to those of image.
+func mergeInventory(image *slipwayk8sfacebookcomv1.ImageInventory, shard slipwayk8sfacebookcomv1.ImageInventory) {
+	image.MirroredTags = append(image.MirroredTags, shard.MirroredTags...)
+	image.SelectedTags = append(image.SelectedTags, shard.SelectedTags...)
+	image.SkippedTags = append(image.SkippedTags, shard.SkippedTags...)
+	for _, destination := range shard.Destinations {
+		d := inventoryDestination(image, destination.Repo)
+		d.MirroredTags = append(d.MirroredTags, destination.MirroredTags...)
+		d.Tags = append(d.Tags, destination.Tags...)
+		d.CreatedTags = append(d.CreatedTags, destination.CreatedTags...)
+	}
+}
+
+// inventoryDestination returns the inventory of the destination with repo in
+// image, adding it if there is none.
+func inventoryDestination(image *slipwayk8sfacebookcomv1.ImageInventory, repo string) *slipwayk8sfacebookcomv1.DestinationInventory {
+	if d := image.FindDestination(repo); d != nil {
+		return d
+	}
+	image.Destinations = append(image.Destinations, slipwayk8sfacebookcomv1.DestinationInventory{Repo: repo})
+	return &image.Destinations[len(image.Destinations)-1]
+}
+
+// newInventory returns the inventory of each image in result. Images which
+// could not be synced at all keep their previous inventory, like their
+// status. Destinations which could not be synced have already carried over
+// their previous tags in result.
+func newInventory(previous Inventory, result MirrorResult) Inventory {
+	inventory := make(Inventory, len(result.Images))
+	for _, image := range result.Images {
+		if image.Err != nil {
+			if p, ok := previous[image.Name]; ok {
+				inventory[image.Name] = p
+			}
+			continue
+		}
+
+		i := &slipwayk8sfacebookcomv1.ImageInventory{
+			MirroredTags: image.MirroredTags,
+			SelectedTags: image.SelectedTags,
+			SkippedTags:  image.SkippedTags,
+		}
+		for _, destination := range image.Destinations {
+			i.Destinations = append(i.Destinations, slipwayk8sfacebookcomv1.DestinationInventory{
+				Repo:         destination.Repo,
+				MirroredTags: destination.MirroredTags,
+				Tags:         destination.Tags,
+				CreatedTags:  destination.CreatedTags,
+			})
+		}
+		inventory[image.Name] = i
+	}
+	return inventory
+}
+
+// splitInventory splits image into shards of at most max entries, keeping
+// the order of every list.
+func splitInventory(image slipwayk8sfacebookcomv1.ImageInventory, max int) []slipwayk8sfacebookcomv1.ImageInventory {
+	shards := []slipwayk8sfacebookcomv1.ImageInventory{{}}
+	entries := 0
+
+	// next returns the shard to which the next entry is added, starting a
+	// new one when the last is full.
+	next := func() *slipwayk8sfacebookcomv1.ImageInventory {
+		if entries == max {
+			shards = append(shards, slipwayk8sfacebookcomv1.ImageInventory{})
+			entries = 0
+		}
+		entries++
+		return &shards[len(shards)-1]
+	}
+
+	for _, tag := range image.MirroredTags {
+		shard := next()
+		shard.MirroredTags = append(shard.MirroredTags, tag)
+	}
+	for _, tag := range image.SelectedTags {
+		shard := next()
+		shard.SelectedTags = append(shard.SelectedTags, tag)
+	}
+	for _, skipped := range image.SkippedTags {
+		shard := next()
+		shard.SkippedTags = append(shard.SkippedTags, skipped)
+	}
+	for _, destination := range image.Destinations {
+		for _, tag := range destination.MirroredTags {
+			d := inventoryDestination(next(), destination.Repo)
+			d.MirroredTags = append(d.MirroredTags, tag)
+		}
+		for _, status := range destination.Tags {
+			d := inventoryDestination(next(), destination.Repo)
+			d.Tags = append(d.Tags, status)
+		}
+		for _, tag := range destination.CreatedTags {
+			d := inventoryDestination(next(), destination.Repo)
+			d.CreatedTags = append(d.CreatedTags, tag)
+		}
+	}
+	return shards
+}
+
+// writeInventory replaces the MirrorInventories of m with inventory, and
+// deletes those of images which are no longer mirrored. Shards which have
+// not changed are not written.
+func writeInventory(ctx context.Context, c client.Client, m mirrorObject, inventory Inventory) error {
+	shards, err := listInventory(ctx, m.InventoryReader, m)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]*slipwayk8sfacebookcomv1.MirrorInventory, len(shards))
+	for i := range shards {
+		existing[shards[i].Name] = &shards[i]
+	}
+
+	imageNames := make([]string, 0, len(inventory))
+	for imageName := range inventory {
+		imageNames = append(imageNames, imageName)
+	}
+	sort.Strings(imageNames)
+
+	for _, imageName := range imageNames {
+		for i, shard := range splitInventory(*inventory[imageName], maxInventoryEntries) {
+			name := inventoryName(m, imageName, i)
+			if current, ok := existing[name]; ok {
+				delete(existing, name)
+				if current.Image == imageName && current.Shard == int32(i) &&
+					equality.Semantic.DeepEqual(current.ImageInventory, shard) {
+					continue
+				}
+				current.Image = imageName
+				current.Shard = int32(i)
+				current.ImageInventory = shard
+				if err := c.Update(ctx, current); err != nil {
+					return errors.Wrap(err, "unable to update MirrorInventory")
+				}
+				continue
+			}
+
+			if err := c.Create(ctx, &slipwayk8sfacebookcomv1.MirrorInventory{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            name,
+					Namespace:       m.InventoryNamespace,
+					Labels:          map[string]string{inventoryLabel(m): string(m.Meta.UID)},
+					OwnerReferences: []metav1.OwnerReference{inventoryOwner(m)},
+				},
+				Image:          imageName,
+				Shard:          int32(i),
+				ImageInventory: shard,
+			}); err != nil {
+				return errors.Wrap(err, "unable to create MirrorInventory")
+			}
+		}
+	}
+
+	for _, stale := range existing {
+		if err := c.Delete(ctx, stale); client.IgnoreNotFound(err) != nil {
+			return errors.Wrap(err, "unable to delete MirrorInventory")
+		}
+	}
+	return nil
+}
+
+// inventoryLabel returns the label which identifies m on its
+// MirrorInventories. Its value is the UID of m, since names may be too long
+// for a label value.
+func inventoryLabel(m mirrorObject) string {
+	if m.Kind == "ClusterImageMirror" {
+		return slipwayk8sfacebookcomv1.ClusterImageMirrorLabel
+	}
+	return slipwayk8sfacebookcomv1.ImageMirrorLabel
+}
+
+// inventoryOwner returns a reference to m as the controller of its
+// MirrorInventories, so that they are deleted along with it.
+func inventoryOwner(m mirrorObject) metav1.OwnerReference {
+	return *metav1.NewControllerRef(&m.Meta, slipwayk8sfacebookcomv1.GroupVersion.WithKind(m.Kind))
+}
+
+// inventoryName returns the name of a shard of the inventory of imageName.
+// Image names may contain slashes and be long, so they are hashed, along
+// with the kind of m, since the inventories of an ImageMirror and a
+// ClusterImageMirror with the same name may share a namespace.
+func inventoryName(m mirrorObject, imageName string, shard int) string {
+	sum := sha256.Sum256([]byte(m.Kind + "/" + imageName))
+	suffix := fmt.Sprintf("-%s-%d", hex.EncodeToString(sum[:])[:10], shard)
+
+	prefix := m.Meta.Name
+	if max := 253 - len(suffix); len(prefix) > max {
+		prefix = strings.TrimRight(prefix[:max], "-.")
+	}
+	return prefix + suffix
+}
+
+// recentTags returns the tags of tags which were copied most recently, newest
+// first.
+func recentTags(tags []slipwayk8sfacebookcomv1.TagStatus) []slipwayk8sfacebookcomv1.TagStatus {
+	var copied []slipwayk8sfacebookcomv1.TagStatus
+	for _, tag := range tags {
+		if tag.CopyTime != nil {
+			copied = append(copied, tag)
+		}
+	}
+	sort.SliceStable(copied, func(i, j int) bool {
+		return copied[j].CopyTime.Before(copied[i].CopyTime)
+	})
+	if len(copied) > maxRecentTags {
+		copied = copied[:maxRecentTags]
+	}
+	return copied
+}
@@ -0,0 +1,216 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// testImageInventory returns an inventory with n entries in each list, and
+// in each list of each of destinations.
+func testImageInventory(n int, destinations ...string) slipwayk8sfacebookcomv1.ImageInventory {
+	var image slipwayk8sfacebookcomv1.ImageInventory
+	for i := 0; i < n; i++ {
+		tag := fmt.Sprintf("v%d", i)
+		image.MirroredTags = append(image.MirroredTags, tag)
+		image.SelectedTags = append(image.SelectedTags, tag)
+		image.SkippedTags = append(image.SkippedTags, slipwayk8sfacebookcomv1.SkippedTag{
+			Tag: tag + "-rc", Reason: slipwayk8sfacebookcomv1.SkipReasonExcluded,
+		})
+	}
+	for _, repo := range destinations {
+		d := slipwayk8sfacebookcomv1.DestinationInventory{Repo: repo}
+		for i := 0; i < n; i++ {
+			tag := fmt.Sprintf("v%d", i)
+			d.MirroredTags = append(d.MirroredTags, tag)
+			d.Tags = append(d.Tags, slipwayk8sfacebookcomv1.TagStatus{Tag: tag, SourceDigest: "sha256:" + tag})
+			d.CreatedTags = append(d.CreatedTags, tag)
+		}
+		image.Destinations = append(image.Destinations, d)
+	}
+	return image
+}
+
+// inventoryEntries returns the number of entries listed by image.
+func inventoryEntries(image slipwayk8sfacebookcomv1.ImageInventory) int {
+	entries := len(image.MirroredTags) + len(image.SelectedTags) + len(image.SkippedTags)
+	for _, d := range image.Destinations {
+		entries += len(d.MirroredTags) + len(d.Tags) + len(d.CreatedTags)
+	}
+	return entries
+}
+
+func TestSplitInventoryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		image      slipwayk8sfacebookcomv1.ImageInventory
+		max        int
+		wantShards int
+	}{
+		{"empty", slipwayk8sfacebookcomv1.ImageInventory{}, 10, 1},
+		{"one shard", testImageInventory(3, "a/"), 100, 1},
+		{"exactly full", testImageInventory(2, "a/"), 12, 1},
+		{"one over", testImageInventory(2, "a/"), 11, 2},
+		{"destination split across shards", testImageInventory(5, "a/", "b/"), 7, 7},
+		{"one entry per shard", testImageInventory(2, "a/", "b/"), 1, 18},
+		{"no destinations", testImageInventory(4), 5, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shards := splitInventory(tt.image, tt.max)
+			if len(shards) != tt.wantShards {
+				t.Errorf("splitInventory() returned %d shards, want %d", len(shards), tt.wantShards)
+			}
+
+			merged := &slipwayk8sfacebookcomv1.ImageInventory{}
+			for i, shard := range shards {
+				if entries := inventoryEntries(shard); entries > tt.max {
+					t.Errorf("shard %d has %d entries, more than %d", i, entries, tt.max)
+				}
+				mergeInventory(merged, shard)
+			}
+			if !reflect.DeepEqual(*merged, tt.image) {
+				t.Errorf("merged shards = %+v, want %+v", *merged, tt.image)
+			}
+		})
+	}
+}
+
+func TestInventoryName(t *testing.T) {
+	mirror := func(kind, name string) mirrorObject {
+		return mirrorObject{Kind: kind, Meta: metav1.ObjectMeta{Name: name}}
+	}
+	long := strings.Repeat("a", 240) + "-" + strings.Repeat("b", 12)
+
+	tests := []struct {
+		name       string
+		m          mirrorObject
+		imageName  string
+		shard      int
+		wantPrefix string
+		wantLen    int
+	}{
+		{"short", mirror("ImageMirror", "centos"), "centos", 0, "centos-", 19},
+		{"image with slashes", mirror("ImageMirror", "cuda"), "nvidia/cuda", 3, "cuda-", 17},
+		{"long name", mirror("ImageMirror", long), "app", 12, strings.Repeat("a", 239) + "-", 253},
+		{"truncated at a dash", mirror("ClusterImageMirror", strings.Repeat("a", 238)+"-"+strings.Repeat("b", 14)), "app", 12, strings.Repeat("a", 238) + "-", 252},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := inventoryName(tt.m, tt.imageName, tt.shard)
+			if errs := validation.IsDNS1123Subdomain(got); len(errs) > 0 {
+				t.Errorf("inventoryName() = %q, which is invalid: %v", got, errs)
+			}
+			if !strings.HasPrefix(got, tt.wantPrefix) {
+				t.Errorf("inventoryName() = %q, want prefix %q", got, tt.wantPrefix)
+			}
+			if len(got) != tt.wantLen {
+				t.Errorf("inventoryName() = %q, want %d characters", got, tt.wantLen)
+			}
+			if suffix := fmt.Sprintf("-%d", tt.shard); !strings.HasSuffix(got, suffix) {
+				t.Errorf("inventoryName() = %q, want suffix %q", got, suffix)
+			}
+		})
+	}
+
+	names := map[string]string{}
+	for _, name := range []struct {
+		m         mirrorObject
+		imageName string
+		shard     int
+	}{
+		{mirror("ImageMirror", "app"), "app", 0},
+		{mirror("ImageMirror", "app"), "app", 1},
+		{mirror("ImageMirror", "app"), "other", 0},
+		{mirror("ClusterImageMirror", "app"), "app", 0},
+		{mirror("ImageMirror", long), "app", 0},
+		{mirror("ImageMirror", long+"c"), "other", 0},
+	} {
+		key := fmt.Sprintf("%s %s %s %d", name.m.Kind, name.m.Meta.Name, name.imageName, name.shard)
+		got := inventoryName(name.m, name.imageName, name.shard)
+		if other, ok := names[got]; ok {
+			t.Errorf("inventoryName() = %q for both %s and %s", got, other, key)
+		}
+		names[got] = key
+	}
+}
+
+func TestWriteAndLoadInventory(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := slipwayk8sfacebookcomv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewFakeClientWithScheme(scheme)
+	ctx := context.Background()
+
+	// The name of the mirror is too long to be a label value.
+	name := strings.Repeat("m", 100)
+	status := &slipwayk8sfacebookcomv1.ImageMirrorStatus{}
+	m := mirrorObject{
+		Kind:               "ImageMirror",
+		Meta:               metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID("uid-1")},
+		Status:             status,
+		InventoryNamespace: "default",
+		InventoryReader:    c,
+	}
+	// A deleted mirror of the same name may leave its shards behind.
+	old := m
+	old.Meta.UID = types.UID("uid-0")
+
+	app, other := testImageInventory(3, "a/"), testImageInventory(1)
+	inventory := Inventory{"app": &app, "other": &other}
+	if err := writeInventory(ctx, c, old, Inventory{"stale": &other}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeInventory(ctx, c, m, inventory); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadInventory(ctx, c, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, inventory) {
+		t.Errorf("loadInventory() = %+v, want %+v", got, inventory)
+	}
+
+	var list slipwayk8sfacebookcomv1.MirrorInventoryList
+	if err := c.List(ctx, &list); err != nil {
+		t.Fatal(err)
+	}
+	for _, shard := range list.Items {
+		for key, value := range shard.Labels {
+			if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+				t.Errorf("MirrorInventory %s has an invalid %s label: %v", shard.Name, key, errs)
+			}
+		}
+	}
+}
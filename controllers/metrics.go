@@ -0,0 +1,190 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// mirrorLabels identify the ImageMirror or ClusterImageMirror a metric
+// describes. The namespace of a ClusterImageMirror is empty.
+var mirrorLabels = []string{"namespace", "name"}
+
+var (
+	tagsCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slipway_tags_copied_total",
+		Help: "Number of tags copied or resynced to a destination.",
+	}, mirrorLabels)
+
+	bytesCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slipway_bytes_copied_total",
+		Help: "Total size of the images copied or resynced to a destination, including blobs which already existed there.",
+	}, mirrorLabels)
+
+	pendingTags = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "slipway_pending_tags",
+		Help: "Number of selected tags which are not yet in every destination, summed over images.",
+	}, mirrorLabels)
+
+	copyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slipway_copy_duration_seconds",
+		Help:    "Time taken to copy or resync a tag to a destination.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, mirrorLabels)
+
+	registryRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "slipway_registry_request_duration_seconds",
+		Help: "Latency of requests to each registry.",
+	}, []string{"registry", "method"})
+
+	registryRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "slipway_registry_request_errors_total",
+		Help: "Number of failed requests to each registry, by HTTP status, or \"network\" if there was no response. " +
+			"Authentication challenges and existence checks are not counted.",
+	}, []string{"registry", "code"})
+
+	lastSuccessfulSync = newSyncAgeCollector()
+)
+
+func init() {
+	metrics.Registry.MustRegister(tagsCopied, bytesCopied, pendingTags, copyDuration,
+		registryRequestDuration, registryRequestErrors, lastSuccessfulSync)
+}
+
+// recordMirrorMetrics updates the metrics of the mirror key from the
+// result of a sync.
+func recordMirrorMetrics(key types.NamespacedName, result MirrorResult) {
+	pending := 0
+	for _, image := range result.Images {
+		pending += len(image.SelectedTags) - len(image.MirroredTags)
+		for _, destination := range image.Destinations {
+			tagsCopied.WithLabelValues(key.Namespace, key.Name).Add(float64(len(destination.CopiedTags)))
+			bytesCopied.WithLabelValues(key.Namespace, key.Name).Add(float64(destination.CopiedBytes))
+			for _, duration := range destination.CopyDurations {
+				copyDuration.WithLabelValues(key.Namespace, key.Name).Observe(duration.Seconds())
+			}
+		}
+	}
+	pendingTags.WithLabelValues(key.Namespace, key.Name).Set(float64(pending))
+}
+
+// recordLastSuccessfulSync remembers when the mirror key last synced
+// without error, as recorded in status.
+func recordLastSuccessfulSync(key types.NamespacedName, status slipwayk8sfacebookcomv1.ImageMirrorStatus) {
+	if status.LastSuccessfulSyncTime != nil {
+		lastSuccessfulSync.Set(key, status.LastSuccessfulSyncTime.Time)
+	}
+}
+
+// deleteMirrorMetrics forgets the mirror key, once it has been deleted.
+func deleteMirrorMetrics(key types.NamespacedName) {
+	tagsCopied.DeleteLabelValues(key.Namespace, key.Name)
+	bytesCopied.DeleteLabelValues(key.Namespace, key.Name)
+	pendingTags.DeleteLabelValues(key.Namespace, key.Name)
+	copyDuration.DeleteLabelValues(key.Namespace, key.Name)
+	lastSuccessfulSync.Delete(key)
+}
+
+// syncAgeCollector reports the seconds since each mirror last synced without
+// error, computed when the metrics are scraped.
+type syncAgeCollector struct {
+	desc *prometheus.Desc
+
+	mu   sync.Mutex
+	last map[types.NamespacedName]time.Time
+}
+
+func newSyncAgeCollector() *syncAgeCollector {
+	return &syncAgeCollector{
+		desc: prometheus.NewDesc("slipway_seconds_since_last_successful_sync",
+			"Seconds since the mirror last synced without error.", mirrorLabels, nil),
+		last: make(map[types.NamespacedName]time.Time),
+	}
+}
+
+// Set records that key last synced without error at t.
+func (c *syncAgeCollector) Set(key types.NamespacedName, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last[key] = t
+}
+
+// Delete forgets key.
+func (c *syncAgeCollector) Delete(key types.NamespacedName) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.last, key)
+}
+
+// Describe implements prometheus.Collector.
+func (c *syncAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector.
+func (c *syncAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, t := range c.last {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(t).Seconds(), key.Namespace, key.Name)
+	}
+}
+
+// registryTransport is used for every request to a registry, so that each
+// is traced, and their latency and errors are measured.
+var registryTransport http.RoundTripper = &tracingTransport{inner: meteredTransport}
+
+// meteredTransport measures requests to a registry.
+var meteredTransport http.RoundTripper = &metricsTransport{inner: http.DefaultTransport}
+
+// metricsTransport records the latency and errors of requests to each
+// registry.
+type metricsTransport struct {
+	inner http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.inner.RoundTrip(req)
+	registryRequestDuration.WithLabelValues(req.URL.Host, req.Method).Observe(time.Since(start).Seconds())
+
+	switch {
+	case err != nil:
+		registryRequestErrors.WithLabelValues(req.URL.Host, "network").Inc()
+	case resp.StatusCode < http.StatusBadRequest:
+	// Every session starts with an unauthenticated request to /v2/, which
+	// is expected to be challenged.
+	case resp.StatusCode == http.StatusUnauthorized && req.URL.Path == "/v2/":
+	// HEAD requests check whether a blob or manifest exists before it is
+	// written, so not finding one is expected.
+	case resp.StatusCode == http.StatusNotFound && req.Method == http.MethodHead:
+	default:
+		registryRequestErrors.WithLabelValues(req.URL.Host, strconv.Itoa(resp.StatusCode)).Inc()
+	}
+	return resp, err
+}
@@ -0,0 +1,214 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// sample is the value of a gathered counter or gauge, or the count and sum
+// of a gathered histogram.
+type sample struct {
+	value float64
+	count uint64
+	sum   float64
+}
+
+// findSample returns the sample of the metric name in g with exactly the
+// label values in labels, given as name, value pairs.
+func findSample(t *testing.T, g prometheus.Gatherer, name string, labels ...string) (sample, bool) {
+	t.Helper()
+	families, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, m := range family.GetMetric() {
+			if len(m.GetLabel())*2 != len(labels) {
+				continue
+			}
+			for i, label := range m.GetLabel() {
+				if label.GetName() != labels[2*i] || label.GetValue() != labels[2*i+1] {
+					continue metrics
+				}
+			}
+			return sample{
+				value: m.GetCounter().GetValue() + m.GetGauge().GetValue(),
+				count: m.GetHistogram().GetSampleCount(),
+				sum:   m.GetHistogram().GetSampleSum(),
+			}, true
+		}
+	}
+	return sample{}, false
+}
+
+func TestMetricsTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v2/":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/v2/app/manifests/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/v2/app/blobs/uploads/":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	closedHost := strings.TrimPrefix(closed.URL, "http://")
+
+	requests := []struct {
+		method string
+		url    string
+	}{
+		{http.MethodGet, server.URL + "/v2/"},
+		{http.MethodGet, server.URL + "/v2/app/manifests/v1"},
+		{http.MethodHead, server.URL + "/v2/app/manifests/missing"},
+		{http.MethodGet, server.URL + "/v2/app/manifests/missing"},
+		{http.MethodPost, server.URL + "/v2/app/blobs/uploads/"},
+		{http.MethodGet, server.URL + "/v2/app/tags/list"},
+		{http.MethodGet, closed.URL + "/v2/"},
+	}
+	transport := &metricsTransport{inner: http.DefaultTransport}
+	for _, r := range requests {
+		req, err := http.NewRequest(r.method, r.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := transport.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	errorTests := []struct {
+		host string
+		code string
+		want float64
+	}{
+		{host, "401", 0},
+		{host, "404", 1},
+		{host, "500", 1},
+		{host, "network", 0},
+		{closedHost, "network", 1},
+	}
+	for _, tt := range errorTests {
+		if got := testutil.ToFloat64(registryRequestErrors.WithLabelValues(tt.host, tt.code)); got != tt.want {
+			t.Errorf("%s errors for %s = %v, want %v", tt.code, tt.host, got, tt.want)
+		}
+	}
+
+	durationTests := []struct {
+		host   string
+		method string
+		want   uint64
+	}{
+		{host, http.MethodGet, 4},
+		{host, http.MethodHead, 1},
+		{host, http.MethodPost, 1},
+		{closedHost, http.MethodGet, 1},
+	}
+	for _, tt := range durationTests {
+		got, ok := findSample(t, metrics.Registry, "slipway_registry_request_duration_seconds", "method", tt.method, "registry", tt.host)
+		if !ok || got.count != tt.want {
+			t.Errorf("%s requests to %s measured %d times, want %d", tt.method, tt.host, got.count, tt.want)
+		}
+	}
+}
+
+func TestRecordMirrorMetrics(t *testing.T) {
+	keys := []types.NamespacedName{
+		{Namespace: "metrics-test", Name: "app"},
+		// A ClusterImageMirror has no namespace.
+		{Name: "metrics-test"},
+	}
+
+	for _, key := range keys {
+		t.Run(key.String(), func(t *testing.T) {
+			result := MirrorResult{Images: []ImageResult{{
+				SelectedTags: []string{"v1", "v2", "v3"},
+				MirroredTags: []string{"v1"},
+				Destinations: []DestinationResult{
+					{
+						CopiedTags:    []slipwayk8sfacebookcomv1.TagStatus{{Tag: "v2"}, {Tag: "v3"}},
+						CopiedBytes:   300,
+						CopyDurations: []time.Duration{time.Second, 3 * time.Second},
+					},
+					{
+						CopiedTags:    []slipwayk8sfacebookcomv1.TagStatus{{Tag: "v2"}},
+						CopiedBytes:   100,
+						CopyDurations: []time.Duration{2 * time.Second},
+					},
+				},
+			}}}
+			recordMirrorMetrics(key, result)
+			recordLastSuccessfulSync(key, slipwayk8sfacebookcomv1.ImageMirrorStatus{
+				LastSuccessfulSyncTime: &metav1.Time{Time: time.Now().Add(-90 * time.Second)},
+			})
+
+			counterTests := []struct {
+				name      string
+				collector prometheus.Collector
+				want      float64
+			}{
+				{"tags copied", tagsCopied.WithLabelValues(key.Namespace, key.Name), 3},
+				{"bytes copied", bytesCopied.WithLabelValues(key.Namespace, key.Name), 400},
+				{"pending tags", pendingTags.WithLabelValues(key.Namespace, key.Name), 2},
+			}
+			for _, tt := range counterTests {
+				if got := testutil.ToFloat64(tt.collector); got != tt.want {
+					t.Errorf("%s = %v, want %v", tt.name, got, tt.want)
+				}
+			}
+
+			labels := []string{"name", key.Name, "namespace", key.Namespace}
+			duration, ok := findSample(t, metrics.Registry, "slipway_copy_duration_seconds", labels...)
+			if !ok || duration.count != 3 || duration.sum != 6 {
+				t.Errorf("copy durations = %+v, want 3 totalling 6s", duration)
+			}
+			age, ok := findSample(t, metrics.Registry, "slipway_seconds_since_last_successful_sync", labels...)
+			if !ok || age.value < 90 || age.value > 120 {
+				t.Errorf("seconds since last successful sync = %+v, want about 90", age)
+			}
+
+			deleteMirrorMetrics(key)
+			for _, name := range []string{"slipway_copy_duration_seconds", "slipway_seconds_since_last_successful_sync", "slipway_tags_copied_total"} {
+				if _, ok := findSample(t, metrics.Registry, name, labels...); ok {
+					t.Errorf("%s is still reported after deleteMirrorMetrics", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// NotificationReceiverPath is the path at which NotificationReceiver accepts
+// notifications.
+const NotificationReceiverPath = "/notifications"
+
+// NotificationQueueSize is the number of events which may be waiting for
+// each controller. Notifications which would overflow it are refused, so
+// that the registry retries them later.
+const NotificationQueueSize = 100
+
+// errNotificationQueueFull is returned by send when an event cannot be queued.
+var errNotificationQueueFull = errors.New("too many notifications are waiting")
+
+// maxNotificationSize limits the size of a notification, since it is read
+// into memory before it is parsed.
+const maxNotificationSize = 1 << 20
+
+// PushedRepository is a repository to which an image was pushed.
+type PushedRepository struct {
+	// Registry is the normalized name of the registry, or empty if the
+	// notification did not say.
+	Registry string
+	// Repository is the name of the repository within the registry.
+	Repository string
+}
+
+// notification is the union of the Docker Distribution notification envelope
+// and a Harbor webhook payload. Only the fields naming the pushed
+// repositories are decoded.
+type notification struct {
+	Events []struct {
+		Action string `json:"action"`
+		Target struct {
+			Repository string `json:"repository"`
+		} `json:"target"`
+		Request struct {
+			Host string `json:"host"`
+		} `json:"request"`
+	} `json:"events"`
+
+	Type      string `json:"type"`
+	EventData struct {
+		Resources []struct {
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+// ParseNotification returns the repositories pushed to according to a Docker
+// Distribution notification or a Harbor webhook payload. Other events, such
+// as pulls and deletes, are ignored.
+func ParseNotification(data []byte) ([]PushedRepository, error) {
+	var n notification
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, errors.Wrap(err, "unable to Unmarshal notification")
+	}
+
+	var repos []PushedRepository
+	for _, e := range n.Events {
+		if e.Action != "push" || e.Target.Repository == "" {
+			continue
+		}
+		repos = append(repos, PushedRepository{
+			Registry:   normalizeRegistry(e.Request.Host),
+			Repository: e.Target.Repository,
+		})
+	}
+
+	// Harbor 2 sends PUSH_ARTIFACT, and earlier releases send pushImage.
+	if n.Type == "PUSH_ARTIFACT" || n.Type == "pushImage" {
+		for _, resource := range n.EventData.Resources {
+			ref, err := name.ParseReference(resource.ResourceURL, name.WeakValidation)
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to ParseReference resource_url")
+			}
+			repos = append(repos, PushedRepository{
+				Registry:   ref.Context().RegistryStr(),
+				Repository: ref.Context().RepositoryStr(),
+			})
+		}
+		if len(n.EventData.Resources) == 0 && n.EventData.Repository.RepoFullName != "" {
+			repos = append(repos, PushedRepository{Repository: n.EventData.Repository.RepoFullName})
+		}
+	}
+
+	return repos, nil
+}
+
+// normalizeRegistry returns the name of registry as it is normalized in
+// image references, or empty if it is empty or invalid.
+func normalizeRegistry(registry string) string {
+	if registry == "" {
+		return ""
+	}
+	r, err := name.NewRegistry(registry, name.WeakValidation)
+	if err != nil {
+		return ""
+	}
+	return r.RegistryStr()
+}
+
+// MirrorsRepository returns true if spec mirrors the image at repo.
+func MirrorsRepository(spec slipwayk8sfacebookcomv1.ImageMirrorSpec, repo PushedRepository) bool {
+	registry, prefix, err := repositoryPrefix(spec.SourceRepo)
+	if err != nil {
+		return false
+	}
+	if repo.Registry != "" && repo.Registry != registry.RegistryStr() {
+		return false
+	}
+	if !strings.HasPrefix(repo.Repository, prefix) || len(repo.Repository) == len(prefix) {
+		return false
+	}
+	imageName := strings.TrimPrefix(repo.Repository, prefix)
+
+	imageNames := spec.AllImageNames()
+	if spec.ImageNamePattern != "" {
+		pattern, err := ParsePattern(spec.ImageNamePattern)
+		if err != nil || !pattern.Matches(imageName) {
+			return false
+		}
+		// Images discovered from the catalog match on the pattern alone.
+		if len(imageNames) == 0 {
+			return true
+		}
+	}
+
+	for _, n := range imageNames {
+		if n == imageName {
+			return true
+		}
+	}
+	return false
+}
+
+// NotificationReceiver is an HTTP server which accepts push notifications
+// from registries, and triggers a sync of the ImageMirrors and
+// ClusterImageMirrors whose source was pushed to. Notifications must carry
+// Secret in their Authorization header, optionally as a bearer token.
+//
+// The receiver runs on every replica, but only the leader runs the
+// controllers, so the others refuse notifications with 503 Service
+// Unavailable until they are elected.
+type NotificationReceiver struct {
+	Client client.Client
+	Log    logr.Logger
+	Addr   string
+	Secret string
+
+	// ImageMirrors and ClusterImageMirrors receive an event for each mirror
+	// to be synced. They are watched by the corresponding controllers.
+	ImageMirrors        chan<- event.GenericEvent
+	ClusterImageMirrors chan<- event.GenericEvent
+
+	// elected is set to 1 while this replica is the leader.
+	elected int32
+}
+
+// ServeHTTP handles a notification.
+func (r *NotificationReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !r.authorized(req) {
+		r.Log.Info("Rejected unauthorized notification", "remoteAddr", req.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if atomic.LoadInt32(&r.elected) == 0 {
+		http.Error(w, "not the leader", http.StatusServiceUnavailable)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, maxNotificationSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	repos, err := ParseNotification(data)
+	if err != nil {
+		r.Log.Info("Rejected invalid notification", "error", err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.trigger(req.Context(), repos); err == errNotificationQueueFull {
+		r.Log.Info("Refused notification", "reason", err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		r.Log.Error(err, "unable to trigger mirrors")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// authorized returns true if req carries the shared secret. Without a secret
+// nothing is authorized, rather than any request without a token.
+func (r *NotificationReceiver) authorized(req *http.Request) bool {
+	if r.Secret == "" {
+		return false
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(r.Secret)) == 1
+}
+
+// trigger sends an event for every mirror of repos which is not suspended.
+func (r *NotificationReceiver) trigger(ctx context.Context, repos []PushedRepository) error {
+	if len(repos) == 0 {
+		return nil
+	}
+
+	var imageMirrors slipwayk8sfacebookcomv1.ImageMirrorList
+	if err := r.Client.List(ctx, &imageMirrors); err != nil {
+		return errors.Wrap(err, "unable to list ImageMirrors")
+	}
+	for i := range imageMirrors.Items {
+		imageMirror := &imageMirrors.Items[i]
+		if !imageMirror.Spec.Suspend && mirrorsAny(imageMirror.Spec, repos) {
+			r.Log.Info("Triggering ImageMirror", "imagemirror", imageMirror.Namespace+"/"+imageMirror.Name)
+			if err := send(r.ImageMirrors, event.GenericEvent{Meta: imageMirror, Object: imageMirror}); err != nil {
+				return err
+			}
+		}
+	}
+
+	var clusterImageMirrors slipwayk8sfacebookcomv1.ClusterImageMirrorList
+	if err := r.Client.List(ctx, &clusterImageMirrors); err != nil {
+		return errors.Wrap(err, "unable to list ClusterImageMirrors")
+	}
+	for i := range clusterImageMirrors.Items {
+		clusterImageMirror := &clusterImageMirrors.Items[i]
+		if !clusterImageMirror.Spec.Suspend && mirrorsAny(clusterImageMirror.Spec.ImageMirrorSpec, repos) {
+			r.Log.Info("Triggering ClusterImageMirror", "clusterimagemirror", clusterImageMirror.Name)
+			if err := send(r.ClusterImageMirrors, event.GenericEvent{Meta: clusterImageMirror, Object: clusterImageMirror}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mirrorsAny returns true if spec mirrors any of repos.
+func mirrorsAny(spec slipwayk8sfacebookcomv1.ImageMirrorSpec, repos []PushedRepository) bool {
+	for _, repo := range repos {
+		if MirrorsRepository(spec, repo) {
+			return true
+		}
+	}
+	return false
+}
+
+// send queues e on events without waiting, and returns
+// errNotificationQueueFull if events is full.
+func send(events chan<- event.GenericEvent, e event.GenericEvent) error {
+	select {
+	case events <- e:
+		return nil
+	default:
+		return errNotificationQueueFull
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. The receiver
+// runs on every replica, so that registries are answered rather than refused
+// a connection.
+func (r *NotificationReceiver) NeedLeaderElection() bool {
+	return false
+}
+
+// Elected returns a manager.Runnable, which requires leader election, that
+// lets the receiver accept notifications while it runs.
+func (r *NotificationReceiver) Elected() manager.Runnable {
+	return manager.RunnableFunc(func(stop <-chan struct{}) error {
+		atomic.StoreInt32(&r.elected, 1)
+		<-stop
+		atomic.StoreInt32(&r.elected, 0)
+		return nil
+	})
+}
+
+// Start serves notifications at Addr until stop is closed. It implements
+// manager.Runnable.
+func (r *NotificationReceiver) Start(stop <-chan struct{}) error {
+	if r.Secret == "" {
+		return errors.New("a shared secret is required to receive notifications")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(NotificationReceiverPath, r)
+	server := &http.Server{Addr: r.Addr, Handler: mux}
+
+	errs := make(chan error, 1)
+	go func() {
+		r.Log.Info("Receiving notifications", "addr", r.Addr, "path", NotificationReceiverPath)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return server.Shutdown(ctx)
+	case err := <-errs:
+		return errors.Wrap(err, "unable to ListenAndServe")
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestParseNotification(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    []PushedRepository
+		wantErr bool
+	}{
+		{
+			name: "distribution push",
+			payload: `{"events": [{
+				"action": "push",
+				"target": {"repository": "nvidia/cuda", "tag": "10.2"},
+				"request": {"host": "registry.example.com:5000"}
+			}]}`,
+			want: []PushedRepository{{Registry: "registry.example.com:5000", Repository: "nvidia/cuda"}},
+		},
+		{
+			name: "distribution push from docker hub",
+			payload: `{"events": [{
+				"action": "push",
+				"target": {"repository": "library/nginx"},
+				"request": {"host": "docker.io"}
+			}]}`,
+			want: []PushedRepository{{Registry: "index.docker.io", Repository: "library/nginx"}},
+		},
+		{
+			name:    "distribution push without host",
+			payload: `{"events": [{"action": "push", "target": {"repository": "app"}}]}`,
+			want:    []PushedRepository{{Repository: "app"}},
+		},
+		{
+			name: "distribution pulls and deletes are ignored",
+			payload: `{"events": [
+				{"action": "pull", "target": {"repository": "a"}},
+				{"action": "delete", "target": {"repository": "b"}},
+				{"action": "push", "target": {"repository": "c"}, "request": {"host": "r.example.com"}},
+				{"action": "push", "target": {}}
+			]}`,
+			want: []PushedRepository{{Registry: "r.example.com", Repository: "c"}},
+		},
+		{
+			name: "harbor 2 push",
+			payload: `{"type": "PUSH_ARTIFACT", "event_data": {
+				"resources": [{"resource_url": "harbor.example.com/library/app:v1"}],
+				"repository": {"repo_full_name": "library/app"}
+			}}`,
+			want: []PushedRepository{{Registry: "harbor.example.com", Repository: "library/app"}},
+		},
+		{
+			name: "harbor 1 push",
+			payload: `{"type": "pushImage", "event_data": {
+				"resources": [
+					{"resource_url": "harbor.example.com:8443/team/a:1"},
+					{"resource_url": "harbor.example.com:8443/team/b@sha256:` + strings.Repeat("0", 64) + `"}
+				]
+			}}`,
+			want: []PushedRepository{
+				{Registry: "harbor.example.com:8443", Repository: "team/a"},
+				{Registry: "harbor.example.com:8443", Repository: "team/b"},
+			},
+		},
+		{
+			name:    "harbor push without resources",
+			payload: `{"type": "PUSH_ARTIFACT", "event_data": {"repository": {"repo_full_name": "library/app"}}}`,
+			want:    []PushedRepository{{Repository: "library/app"}},
+		},
+		{
+			name: "harbor pulls are ignored",
+			payload: `{"type": "PULL_ARTIFACT", "event_data": {
+				"resources": [{"resource_url": "harbor.example.com/library/app:v1"}]
+			}}`,
+		},
+		{
+			name:    "harbor invalid resource_url",
+			payload: `{"type": "PUSH_ARTIFACT", "event_data": {"resources": [{"resource_url": "Not A Reference"}]}}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			payload: `{"events": [`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNotification([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNotification() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseNotification() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMirrorsRepository(t *testing.T) {
+	tests := []struct {
+		name string
+		spec slipwayk8sfacebookcomv1.ImageMirrorSpec
+		repo PushedRepository
+		want bool
+	}{
+		{
+			"image name",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageName: "app"},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/app"},
+			true,
+		},
+		{
+			"unknown registry",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageName: "app"},
+			PushedRepository{Repository: "team/app"},
+			true,
+		},
+		{
+			"other registry",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageName: "app"},
+			PushedRepository{Registry: "other.example.com", Repository: "team/app"},
+			false,
+		},
+		{
+			"other image",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageName: "app"},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/other"},
+			false,
+		},
+		{
+			"prefix is not a path element",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageName: "app"},
+			PushedRepository{Registry: "registry.example.com", Repository: "teamapp"},
+			false,
+		},
+		{
+			"source repository itself",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageNamePattern: "glob:*"},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/"},
+			false,
+		},
+		{
+			"docker hub organization",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "nvidia", ImageName: "cuda"},
+			PushedRepository{Registry: "index.docker.io", Repository: "nvidia/cuda"},
+			true,
+		},
+		{
+			"docker hub library",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "docker.io", ImageName: "nginx"},
+			PushedRepository{Registry: "index.docker.io", Repository: "library/nginx"},
+			true,
+		},
+		{
+			"image names",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageName: "a", ImageNames: []string{"b", "c"}},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/c"},
+			true,
+		},
+		{
+			"pattern without image names",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageNamePattern: "glob:cuda-*"},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/cuda-base"},
+			true,
+		},
+		{
+			"pattern does not match",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageNamePattern: "glob:cuda-*"},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/app"},
+			false,
+		},
+		{
+			"pattern filters image names",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageNames: []string{"cuda-base", "app"}, ImageNamePattern: "glob:cuda-*"},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/app"},
+			false,
+		},
+		{
+			"pattern matches an unlisted image",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageNames: []string{"cuda-base"}, ImageNamePattern: "glob:cuda-*"},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/cuda-devel"},
+			false,
+		},
+		{
+			"invalid pattern",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageNamePattern: "regex:("},
+			PushedRepository{Registry: "registry.example.com", Repository: "team/app"},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MirrorsRepository(tt.spec, tt.repo); got != tt.want {
+				t.Errorf("MirrorsRepository() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotificationReceiverServeHTTP(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := slipwayk8sfacebookcomv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	mirror := func(name string) *slipwayk8sfacebookcomv1.ImageMirror {
+		return &slipwayk8sfacebookcomv1.ImageMirror{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+			Spec:       slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "registry.example.com/team", ImageName: "app"},
+		}
+	}
+	const push = `{"events": [{"action": "push", "target": {"repository": "team/app"}}]}`
+
+	tests := []struct {
+		name       string
+		notElected bool
+		queueSize  int
+		secret     string
+		auth       string
+		payload    string
+		wantStatus int
+		wantEvents int
+	}{
+		{"accepted", false, 2, "secret", "Bearer secret", push, http.StatusAccepted, 2},
+		{"plain secret", false, 2, "secret", "secret", push, http.StatusAccepted, 2},
+		{"unauthorized", false, 2, "secret", "Bearer wrong", push, http.StatusUnauthorized, 0},
+		{"no secret", false, 2, "", "", push, http.StatusUnauthorized, 0},
+		{"no secret with a token", false, 2, "", "Bearer ", push, http.StatusUnauthorized, 0},
+		{"not the leader", true, 2, "secret", "Bearer secret", push, http.StatusServiceUnavailable, 0},
+		{"queue full", false, 1, "secret", "Bearer secret", push, http.StatusServiceUnavailable, 1},
+		{"invalid", false, 2, "secret", "Bearer secret", `{`, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make(chan event.GenericEvent, tt.queueSize)
+			r := &NotificationReceiver{
+				Client:              fake.NewFakeClientWithScheme(scheme, mirror("a"), mirror("b")),
+				Log:                 ctrl.Log,
+				Secret:              tt.secret,
+				ImageMirrors:        events,
+				ClusterImageMirrors: make(chan event.GenericEvent, tt.queueSize),
+			}
+			if !tt.notElected {
+				r.elected = 1
+			}
+
+			req := httptest.NewRequest(http.MethodPost, NotificationReceiverPath, strings.NewReader(tt.payload))
+			req.Header.Set("Authorization", tt.auth)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("ServeHTTP() status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if len(events) != tt.wantEvents {
+				t.Errorf("ServeHTTP() queued %d events, want %d", len(events), tt.wantEvents)
+			}
+		})
+	}
+}
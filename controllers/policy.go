@@ -2,9 +2,12 @@ package controllers
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Masterminds/semver/v3"
+	"github.com/pkg/errors"
 	"github.com/ryanuber/go-glob"
 	// This dependency was copied into the operator to avoid client-go
 	// dependency conflicts between flux and kubebuilder. This may or
@@ -17,6 +20,8 @@ const (
 	semverPrefix    = "semver:"
 	regexpPrefix    = "regexp:"
 	regexpAltPrefix = "regex:"
+	calverPrefix    = "calver:"
+	numericPrefix   = "numeric:"
 )
 
 var (
@@ -48,15 +53,62 @@ type SemverPattern struct {
 	constraints *semver.Constraints
 }
 
-// RegexpPattern matches by regular expression.
+// RegexpPattern matches by regular expression. If the expression has a
+// named capture group called semver, number or string, tags are ordered by
+// the value it captures, interpreted accordingly.
 type RegexpPattern struct {
 	pattern string // pattern without prefix
 	regexp  *regexp.Regexp
+	order   string // name of the capture group to order by, if any
+}
+
+// CalverPattern matches calendar versions with the given layout, e.g.
+// YYYY.0M.0D, and orders them by date.
+// See https://calver.org/
+type CalverPattern struct {
+	pattern string // pattern without prefix
+	regexp  *regexp.Regexp
+}
+
+// NumericPattern matches tags of the form given by a glob, in which #
+// stands for an integer (e.g. build-#), and orders them by that integer.
+type NumericPattern struct {
+	pattern string // pattern without prefix
+	regexp  *regexp.Regexp
+}
+
+// ParsePattern instantiates a Pattern like NewPattern, but returns an error
+// if the pattern is invalid rather than a Pattern which matches nothing.
+func ParsePattern(pattern string) (Pattern, error) {
+	switch {
+	case strings.HasPrefix(pattern, semverPrefix):
+		if _, err := semver.NewConstraint(strings.TrimPrefix(pattern, semverPrefix)); err != nil {
+			return nil, errors.Wrapf(err, "invalid semver pattern %q", pattern)
+		}
+	case strings.HasPrefix(pattern, regexpPrefix):
+		if _, err := regexp.Compile(strings.TrimPrefix(pattern, regexpPrefix)); err != nil {
+			return nil, errors.Wrapf(err, "invalid regexp pattern %q", pattern)
+		}
+	case strings.HasPrefix(pattern, regexpAltPrefix):
+		if _, err := regexp.Compile(strings.TrimPrefix(pattern, regexpAltPrefix)); err != nil {
+			return nil, errors.Wrapf(err, "invalid regexp pattern %q", pattern)
+		}
+	case strings.HasPrefix(pattern, calverPrefix):
+		if _, err := calverRegexp(strings.TrimSpace(strings.TrimPrefix(pattern, calverPrefix))); err != nil {
+			return nil, errors.Wrapf(err, "invalid calver pattern %q", pattern)
+		}
+	case strings.HasPrefix(pattern, numericPrefix):
+		if _, err := numericRegexp(strings.TrimSpace(strings.TrimPrefix(pattern, numericPrefix))); err != nil {
+			return nil, errors.Wrapf(err, "invalid numeric pattern %q", pattern)
+		}
+	}
+
+	return NewPattern(pattern), nil
 }
 
 // NewPattern instantiates a Pattern according to the prefix
 // it finds. The prefix can be either `glob:` (default if omitted),
-// `semver:` or `regexp:`.
+// `semver:`, `regexp:`, `calver:` or `numeric:`.
 func NewPattern(pattern string) Pattern {
 	switch {
 	case strings.HasPrefix(pattern, semverPrefix):
@@ -66,11 +118,19 @@ func NewPattern(pattern string) Pattern {
 	case strings.HasPrefix(pattern, regexpPrefix):
 		pattern = strings.TrimPrefix(pattern, regexpPrefix)
 		r, _ := regexp.Compile(pattern)
-		return RegexpPattern{pattern, r}
+		return RegexpPattern{pattern, r, regexpOrder(r)}
 	case strings.HasPrefix(pattern, regexpAltPrefix):
 		pattern = strings.TrimPrefix(pattern, regexpAltPrefix)
 		r, _ := regexp.Compile(pattern)
-		return RegexpPattern{pattern, r}
+		return RegexpPattern{pattern, r, regexpOrder(r)}
+	case strings.HasPrefix(pattern, calverPrefix):
+		pattern = strings.TrimSpace(strings.TrimPrefix(pattern, calverPrefix))
+		r, _ := calverRegexp(pattern)
+		return CalverPattern{pattern, r}
+	case strings.HasPrefix(pattern, numericPrefix):
+		pattern = strings.TrimSpace(strings.TrimPrefix(pattern, numericPrefix))
+		r, _ := numericRegexp(pattern)
+		return NumericPattern{pattern, r}
 	default:
 		return GlobPattern(strings.TrimPrefix(pattern, globPrefix))
 	}
@@ -102,8 +162,9 @@ func (s SemverPattern) Matches(tag string) bool {
 		return false
 	}
 	if s.constraints == nil {
-		// Invalid constraints match anything
-		return true
+		// Invalid constraints match nothing, rather than mirroring
+		// every tag in the repository.
+		return false
 	}
 	return s.constraints.Check(v)
 }
@@ -126,8 +187,9 @@ func (s SemverPattern) RequiresTimestamp() bool {
 
 func (r RegexpPattern) Matches(tag string) bool {
 	if r.regexp == nil {
-		// Invalid regexp match anything
-		return true
+		// Invalid regexp match nothing, rather than mirroring every
+		// tag in the repository.
+		return false
 	}
 	return r.regexp.MatchString(tag)
 }
@@ -137,7 +199,42 @@ func (r RegexpPattern) String() string {
 }
 
 func (r RegexpPattern) Newer(a, b *Info) bool {
-	return NewerByCreated(a, b)
+	if r.order == "" || r.regexp == nil {
+		return NewerByCreated(a, b)
+	}
+
+	av, aok := r.capture(a.ID.Tag)
+	bv, bok := r.capture(b.ID.Tag)
+	switch {
+	case aok && bok:
+		var cmp int
+		switch r.order {
+		case "semver":
+			cmp = compareSemver(av, bv)
+		case "number":
+			cmp = compareNumeric(av, bv)
+		default:
+			cmp = strings.Compare(av, bv)
+		}
+		if cmp != 0 {
+			return cmp > 0
+		}
+	case aok:
+		return true
+	case bok:
+		return false
+	}
+	return a.ID.String() < b.ID.String()
+}
+
+// capture returns the value of the ordering capture group in tag.
+func (r RegexpPattern) capture(tag string) (string, bool) {
+	match := r.regexp.FindStringSubmatch(tag)
+	if match == nil {
+		return "", false
+	}
+	value := match[subexpIndex(r.regexp, r.order)]
+	return value, value != ""
 }
 
 func (r RegexpPattern) Valid() bool {
@@ -145,5 +242,284 @@ func (r RegexpPattern) Valid() bool {
 }
 
 func (r RegexpPattern) RequiresTimestamp() bool {
+	return r.order == ""
+}
+
+// regexpOrder returns the name of the capture group of r which orders tags,
+// or "" if there is none.
+func regexpOrder(r *regexp.Regexp) string {
+	if r == nil {
+		return ""
+	}
+	for _, order := range []string{"semver", "number", "string"} {
+		if subexpIndex(r, order) >= 0 {
+			return order
+		}
+	}
+	return ""
+}
+
+// subexpIndex returns the index of the first capture group of r called
+// name, or -1 if there is none.
+func subexpIndex(r *regexp.Regexp, name string) int {
+	for i, subexp := range r.SubexpNames() {
+		if i > 0 && subexp == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// calverTokens are the calendar version fields supported in a layout, in
+// the order in which they are matched, so that longer tokens win.
+var calverTokens = []struct {
+	token, group, expr string
+}{
+	{"YYYY", "year", `\d{4}`},
+	{"MICRO", "micro", `\d+`},
+	{"YY", "shortyear", `[1-9]\d*`},
+	{"0Y", "shortyear", `\d{2,}`},
+	{"MM", "month", `[1-9]\d?`},
+	{"0M", "month", `\d{2}`},
+	{"DD", "day", `[1-9]\d?`},
+	{"0D", "day", `\d{2}`},
+}
+
+// calverRegexp compiles a calver layout such as YYYY.0M.0D into an anchored
+// regular expression with a named group for each field. Characters which are
+// not part of a token must match literally.
+func calverRegexp(layout string) (*regexp.Regexp, error) {
+	if layout == "" {
+		return nil, errors.New("layout must not be empty")
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	seen := make(map[string]bool)
+	for rest := layout; rest != ""; {
+		matched := false
+		for _, t := range calverTokens {
+			if strings.HasPrefix(rest, t.token) {
+				if seen[t.group] || (t.group == "year" && seen["shortyear"]) || (t.group == "shortyear" && seen["year"]) {
+					return nil, errors.Errorf("layout must not repeat %s", t.token)
+				}
+				seen[t.group] = true
+				expr.WriteString("(?P<" + t.group + ">" + t.expr + ")")
+				rest = rest[len(t.token):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			expr.WriteString(regexp.QuoteMeta(rest[:1]))
+			rest = rest[1:]
+		}
+	}
+	expr.WriteString("$")
+
+	if !seen["year"] && !seen["shortyear"] {
+		return nil, errors.New("layout must include a year (YYYY, YY or 0Y)")
+	}
+	return regexp.Compile(expr.String())
+}
+
+func (c CalverPattern) Matches(tag string) bool {
+	_, _, ok := c.parse(tag)
+	return ok
+}
+
+// parse returns the date and micro version of tag, and whether it matches
+// the layout and is a valid date.
+func (c CalverPattern) parse(tag string) (time.Time, int64, bool) {
+	if c.regexp == nil {
+		return time.Time{}, 0, false
+	}
+	match := c.regexp.FindStringSubmatch(tag)
+	if match == nil {
+		return time.Time{}, 0, false
+	}
+
+	year, month, day, micro := int64(0), int64(1), int64(1), int64(0)
+	for i, group := range c.regexp.SubexpNames() {
+		if group == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(match[i], 10, 64)
+		if err != nil {
+			return time.Time{}, 0, false
+		}
+		switch group {
+		case "year":
+			year = value
+		case "shortyear":
+			year = 2000 + value
+		case "month":
+			month = value
+		case "day":
+			day = value
+		case "micro":
+			micro = value
+		}
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, 0, false
+	}
+	date := time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, time.UTC)
+	if date.Day() != int(day) {
+		// e.g. February 30th.
+		return time.Time{}, 0, false
+	}
+	return date, micro, true
+}
+
+func (c CalverPattern) String() string {
+	return calverPrefix + c.pattern
+}
+
+func (c CalverPattern) Newer(a, b *Info) bool {
+	at, amicro, aok := c.parse(a.ID.Tag)
+	bt, bmicro, bok := c.parse(b.ID.Tag)
+	switch {
+	case aok && bok:
+		if !at.Equal(bt) {
+			return at.After(bt)
+		}
+		if amicro != bmicro {
+			return amicro > bmicro
+		}
+	case aok:
+		return true
+	case bok:
+		return false
+	}
+	return a.ID.String() < b.ID.String()
+}
+
+func (c CalverPattern) Valid() bool {
+	return c.regexp != nil
+}
+
+func (c CalverPattern) RequiresTimestamp() bool {
+	return false
+}
+
+// numericRegexp compiles a numeric pattern, a glob in which exactly one #
+// stands for an integer and which defaults to # if empty, into an anchored
+// regular expression.
+func numericRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		pattern = "#"
+	}
+	if strings.Count(pattern, "#") != 1 {
+		return nil, errors.New("pattern must include exactly one #")
+	}
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '#':
+			expr.WriteString(`(\d+)`)
+		case '*':
+			// Lazily, so that a * before the # does not take all but
+			// the last of its digits.
+			expr.WriteString(".*?")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+func (n NumericPattern) Matches(tag string) bool {
+	_, ok := n.number(tag)
+	return ok
+}
+
+// number returns the digits of tag which stand for # in the pattern.
+func (n NumericPattern) number(tag string) (string, bool) {
+	if n.regexp == nil {
+		return "", false
+	}
+	match := n.regexp.FindStringSubmatch(tag)
+	if match == nil {
+		return "", false
+	}
+	return match[1], true
+}
+
+func (n NumericPattern) String() string {
+	return numericPrefix + n.pattern
+}
+
+func (n NumericPattern) Newer(a, b *Info) bool {
+	an, aok := n.number(a.ID.Tag)
+	bn, bok := n.number(b.ID.Tag)
+	switch {
+	case aok && bok:
+		if cmp := compareNumeric(an, bn); cmp != 0 {
+			return cmp > 0
+		}
+	case aok:
+		return true
+	case bok:
+		return false
+	}
+	return a.ID.String() < b.ID.String()
+}
+
+func (n NumericPattern) Valid() bool {
+	return n.regexp != nil
+}
+
+func (n NumericPattern) RequiresTimestamp() bool {
+	return false
+}
+
+// compareNumeric compares two strings of decimal digits by value, without
+// limiting their size. Strings which are not numbers compare lexically.
+func compareNumeric(a, b string) int {
+	if !isDigits(a) || !isDigits(b) {
+		return strings.Compare(a, b)
+	}
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		if len(a) > len(b) {
+			return 1
+		}
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
 	return true
 }
+
+// compareSemver compares two semantic versions, which may be prefixed with
+// v. Invalid versions are older than valid ones.
+func compareSemver(a, b string) int {
+	av, aerr := semver.NewVersion(a)
+	bv, berr := semver.NewVersion(b)
+	switch {
+	case aerr == nil && berr == nil:
+		return av.Compare(bv)
+	case aerr == nil:
+		return 1
+	case berr == nil:
+		return -1
+	}
+	return strings.Compare(a, b)
+}
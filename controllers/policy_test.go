@@ -0,0 +1,272 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+// newestFirst orders tags by the Newer function of pattern.
+func newestFirst(pattern Pattern, tags []string) []string {
+	infos := make([]Info, 0, len(tags))
+	for _, tag := range tags {
+		infos = append(infos, Info{ID: Ref{Name: Name{Image: "app"}, Tag: tag}})
+	}
+	Sort(infos, pattern.Newer)
+
+	ordered := make([]string, 0, len(infos))
+	for _, info := range infos {
+		ordered = append(ordered, info.ID.Tag)
+	}
+	return ordered
+}
+
+// matching returns the tags which pattern matches.
+func matching(pattern Pattern, tags []string) []string {
+	matched := []string{}
+	for _, tag := range tags {
+		if pattern.Matches(tag) {
+			matched = append(matched, tag)
+		}
+	}
+	return matched
+}
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{"", false},
+		{"latest", false},
+		{"glob:v1.*", false},
+		{"semver:>=1.0 <2", false},
+		{"semver:not a constraint", true},
+		{"regexp:^v(?P<semver>.*)$", false},
+		{"regex:^v\\d+$", false},
+		{"regexp:(", true},
+		{"regex:[", true},
+		{"calver:YYYY.0M.0D", false},
+		{"calver:YY.MM.MICRO", false},
+		{"calver:0Y0M0D-MICRO", false},
+		{"calver:", true},
+		{"calver:  ", true},
+		{"calver:MM.DD", true},
+		{"calver:YYYY.0M.YY", true},
+		{"calver:YYYY.MM.0M", true},
+		{"numeric:", false},
+		{"numeric:build-#", false},
+		{"numeric:*#", false},
+		{"numeric:?#-*", false},
+		{"numeric:build", true},
+		{"numeric:#.#", true},
+	}
+
+	for _, tt := range tests {
+		p, err := ParsePattern(tt.pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePattern(%q) error = %v, wantErr %v", tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if err == nil && !p.Valid() {
+			t.Errorf("ParsePattern(%q) = %v, which is not Valid", tt.pattern, p)
+		}
+	}
+}
+
+func TestNumericPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		tags    []string
+		want    []string // matching tags, newest first
+	}{
+		{"numeric:", []string{"1", "10", "9", "v2", "007"}, []string{"10", "9", "007", "1"}},
+		{"numeric:build-#", []string{"build-2", "build-10", "build-1", "build-x", "build-3-rc"}, []string{"build-10", "build-2", "build-1"}},
+		{"numeric:*#", []string{"build9", "build123", "build10"}, []string{"build123", "build10", "build9"}},
+		{"numeric:*-#", []string{"v1-20", "v2-3", "v10-100", "v1-"}, []string{"v10-100", "v1-20", "v2-3"}},
+		{"numeric:#*", []string{"12-alpine", "9", "100-slim", "alpine"}, []string{"100-slim", "12-alpine", "9"}},
+		{"numeric:r?#", []string{"ra1", "rb22", "r3", "rab4"}, []string{"rb22", "ra1"}},
+		{"numeric:#", []string{"123456789012345678901234567890", "99999999999999999999"}, []string{"123456789012345678901234567890", "99999999999999999999"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			p := NewPattern(tt.pattern)
+			if got := newestFirst(p, matching(p, tt.tags)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s orders %v as %v, want %v", tt.pattern, tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNumericPatternNonMatchingTagsAreOldest(t *testing.T) {
+	p := NewPattern("numeric:build-#")
+	got := newestFirst(p, []string{"latest", "build-1", "build-2", "edge"})
+	want := []string{"build-2", "build-1", "edge", "latest"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newestFirst() = %v, want %v", got, want)
+	}
+}
+
+func TestCalverPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		tags    []string
+		want    []string // matching tags, newest first
+	}{
+		{
+			"calver:YYYY.0M.0D",
+			[]string{"2020.01.02", "2019.12.31", "2020.1.2", "2020.02.30", "2020.13.01", "2020.06.15", "v2020.06.16"},
+			[]string{"2020.06.15", "2020.01.02", "2019.12.31"},
+		},
+		{
+			"calver:YY.MM.MICRO",
+			[]string{"20.6.0", "20.6.10", "20.6.2", "20.12.0", "19.12.99", "20.06.1"},
+			[]string{"20.12.0", "20.6.10", "20.6.2", "20.6.0", "19.12.99"},
+		},
+		{
+			"calver:0Y0M0D-MICRO",
+			[]string{"200615-1", "200615-12", "191231-3", "20061-1"},
+			[]string{"200615-12", "200615-1", "191231-3"},
+		},
+		{
+			"calver:release-YYYY.MM",
+			[]string{"release-2020.6", "release-2020.10", "release-2020.06", "release-2021.1"},
+			[]string{"release-2021.1", "release-2020.10", "release-2020.6"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			p := NewPattern(tt.pattern)
+			if got := newestFirst(p, matching(p, tt.tags)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s orders %v as %v, want %v", tt.pattern, tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalverPatternEmptyLayoutMatchesNothing(t *testing.T) {
+	p := NewPattern("calver:")
+	if p.Valid() || p.Matches("2020.01.02") {
+		t.Errorf("calver: with an empty layout is valid or matches, want neither")
+	}
+}
+
+func TestRegexpPatternOrder(t *testing.T) {
+	tests := []struct {
+		pattern string
+		tags    []string
+		want    []string // matching tags, newest first
+	}{
+		{
+			`regexp:^v(?P<semver>[0-9.]+)-alpine$`,
+			[]string{"v1.2.0-alpine", "v1.10.0-alpine", "v1.9.3-alpine", "v2.0.0", "v1.2.0"},
+			[]string{"v1.10.0-alpine", "v1.9.3-alpine", "v1.2.0-alpine"},
+		},
+		{
+			`regexp:^build-(?P<number>\d+)(-.*)?$`,
+			[]string{"build-9", "build-10-debug", "build-100", "build-x"},
+			[]string{"build-100", "build-10-debug", "build-9"},
+		},
+		{
+			`regex:^(?P<string>[a-z]+)-stable$`,
+			[]string{"bionic-stable", "focal-stable", "artful-stable", "focal"},
+			[]string{"focal-stable", "bionic-stable", "artful-stable"},
+		},
+		{
+			// number takes precedence over string, wherever they are.
+			`regexp:^(?P<string>[a-z]+)-(?P<number>\d+)$`,
+			[]string{"a-10", "b-2", "a-9"},
+			[]string{"a-10", "a-9", "b-2"},
+		},
+		{
+			// An optional group which did not capture is oldest.
+			`regexp:^app(-(?P<number>\d+))?$`,
+			[]string{"app", "app-2", "app-11"},
+			[]string{"app-11", "app-2", "app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			p := NewPattern(tt.pattern)
+			if p.RequiresTimestamp() {
+				t.Errorf("%s requires timestamps, want it ordered by its capture group", tt.pattern)
+			}
+			if got := newestFirst(p, matching(p, tt.tags)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s orders %v as %v, want %v", tt.pattern, tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegexpPatternWithoutOrderRequiresTimestamp(t *testing.T) {
+	if !NewPattern(`regexp:^v(\d+)$`).RequiresTimestamp() {
+		t.Errorf("a regexp without an ordering capture group should order by timestamp")
+	}
+}
+
+func TestCompareNumeric(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1", "1", 0},
+		{"2", "10", -1},
+		{"10", "2", 1},
+		{"007", "7", 0},
+		{"0", "00", 0},
+		{"010", "9", 1},
+		{"123456789012345678901234567890", "123456789012345678901234567891", -1},
+		{"99999999999999999999", "100000000000000000000", -1},
+		{"a", "b", -1},
+		{"10", "x", -1},
+		{"", "1", -1},
+	}
+
+	for _, tt := range tests {
+		if got := compareNumeric(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareNumeric(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestCompareSemver(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0", 0},
+		{"1.10.0", "1.9.0", 1},
+		{"1.0.0", "1.0.0-rc1", 1},
+		{"1.0.0-rc2", "1.0.0-rc1", 1},
+		{"1.2", "1.2.0", 0},
+		{"2", "10", -1},
+		{"1.0.0", "latest", 1},
+		{"latest", "1.0.0", -1},
+		{"latest", "edge", 1},
+	}
+
+	for _, tt := range tests {
+		if got := compareSemver(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareSemver(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
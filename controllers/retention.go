@@ -0,0 +1,133 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// NewestTags returns the n newest of tags, newest first, ordered by the
+// Newer function of pattern. If the pattern orders by timestamp, createdAt
+// is called to look up the creation time of each tag; tags whose creation
+// time cannot be determined are treated as the oldest.
+func NewestTags(tags []string, pattern Pattern, n int, imageName string,
+	createdAt func(tag string) (time.Time, error)) []string {
+	infos := make([]Info, 0, len(tags))
+	for _, tag := range tags {
+		info := Info{ID: Ref{Name: Name{Image: imageName}, Tag: tag}}
+		if pattern.RequiresTimestamp() {
+			if created, err := createdAt(tag); err == nil {
+				info.CreatedAt = created
+			}
+		}
+		infos = append(infos, info)
+	}
+
+	Sort(infos, pattern.Newer)
+	if n < len(infos) {
+		infos = infos[:n]
+	}
+
+	newest := make([]string, 0, len(infos))
+	for _, info := range infos {
+		newest = append(newest, info.ID.Tag)
+	}
+	return newest
+}
+
+// RetainedTags returns the tags which are kept by retention, given the tags
+// which match the pattern, and whether tags outside of them are deleted.
+func RetainedTags(retention *slipwayk8sfacebookcomv1.Retention, filteredTags []string, pattern Pattern,
+	imageName string, createdAt func(tag string) (time.Time, error)) ([]string, bool) {
+	if retention == nil {
+		return filteredTags, false
+	}
+
+	switch retention.Policy {
+	case slipwayk8sfacebookcomv1.RetentionDeleteUnmatched:
+		return filteredTags, true
+	case slipwayk8sfacebookcomv1.RetentionKeepLatest:
+		return NewestTags(filteredTags, pattern, int(retention.Keep), imageName, createdAt), true
+	default:
+		return filteredTags, false
+	}
+}
+
+// prune deletes the tags slipway created in the destination which are not
+// in keep, which are source tags, or lists them if dryRun is set. Tags which
+// could not be deleted are retried with their own exponential backoff.
+func (m *destinationMirror) prune(ctx context.Context, keep []string, dryRun bool, now time.Time) {
+	kept := make(map[string]bool, len(keep))
+	for _, tag := range keep {
+		kept[m.destTag(tag)] = true
+	}
+
+	created := []string{}
+	for _, tag := range m.created {
+		if kept[tag] {
+			created = append(created, tag)
+			continue
+		}
+
+		if dryRun {
+			m.log.Info("Would prune tag", "tag", tag)
+			m.result.PrunableTags = append(m.result.PrunableTags, tag)
+			created = append(created, tag)
+			continue
+		}
+
+		failed, hasFailed := m.pruneFailures[tag]
+		if hasFailed && now.Before(failed.NextRetryTime.Time) {
+			m.result.FailedPrunes = append(m.result.FailedPrunes, failed)
+			created = append(created, tag)
+			continue
+		}
+
+		if err := m.deleteTag(ctx, tag); err != nil {
+			m.log.Error(err, "unable to prune tag", "tag", tag)
+			m.result.FailedPrunes = append(m.result.FailedPrunes, NewFailedTag(failed, tag, err, now))
+			created = append(created, tag)
+			continue
+		}
+
+		m.log.Info("Pruned tag", "tag", tag)
+		m.result.PrunedTags = append(m.result.PrunedTags, tag)
+	}
+
+	m.created = created
+}
+
+// deleteTag deletes tag from the destination. The tag itself is deleted,
+// rather than the manifest it refers to, so that other tags which refer to
+// the same manifest are left alone.
+func (m *destinationMirror) deleteTag(ctx context.Context, tag string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteTag", repositoryKey.String(m.destName), tagKey.String(tag))
+	defer func() { endSpan(ctx, span, err) }()
+
+	ref, err := m.ref(tag)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(remote.Delete(ref, withTraceContext(ctx, m.options)...), "unable to Delete")
+}
@@ -0,0 +1,287 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/pkg/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestRetainedTags(t *testing.T) {
+	tags := []string{"build-1", "build-3", "build-2"}
+	noTimestamps := func(string) (time.Time, error) { return time.Time{}, errors.New("no creation time") }
+
+	tests := []struct {
+		name      string
+		retention *slipwayk8sfacebookcomv1.Retention
+		want      []string
+		wantPrune bool
+	}{
+		{"none", nil, tags, false},
+		{"keep all", &slipwayk8sfacebookcomv1.Retention{Policy: slipwayk8sfacebookcomv1.RetentionKeepAll}, tags, false},
+		{"delete unmatched", &slipwayk8sfacebookcomv1.Retention{Policy: slipwayk8sfacebookcomv1.RetentionDeleteUnmatched}, tags, true},
+		{"keep latest", &slipwayk8sfacebookcomv1.Retention{Policy: slipwayk8sfacebookcomv1.RetentionKeepLatest, Keep: 2}, []string{"build-3", "build-2"}, true},
+		{"keep more than there are", &slipwayk8sfacebookcomv1.Retention{Policy: slipwayk8sfacebookcomv1.RetentionKeepLatest, Keep: 5}, []string{"build-3", "build-2", "build-1"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, prune := RetainedTags(tt.retention, tags, NewPattern("numeric:build-#"), "app", noTimestamps)
+			if !reflect.DeepEqual(got, tt.want) || prune != tt.wantPrune {
+				t.Errorf("RetainedTags() = %v, %v, want %v, %v", got, prune, tt.want, tt.wantPrune)
+			}
+		})
+	}
+}
+
+func TestMirrorImageNeverPrunesWithoutSourceTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		sourceTags  []string // nil if the source does not exist
+		wantErr     error
+		wantCreated []string
+	}{
+		{"missing source", nil, ErrRepositoryNotFound, []string{"v1", "v2"}},
+		{"empty source", []string{}, nil, []string{"v1", "v2"}},
+		{"source without v2", []string{"v1"}, nil, []string{"v1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			img, err := random.Image(256, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.sourceTags != nil {
+				r.tags["src/app"] = map[string]bool{}
+			}
+			for _, tag := range tt.sourceTags {
+				r.PushImage("src/app", tag, img)
+			}
+			for _, tag := range []string{"v1", "v2"} {
+				r.PushImage("dst/app", tag, img)
+			}
+			r.Requests()
+
+			imageMirror := testImageMirror(r)
+			imageMirror.Spec.Retention = &slipwayk8sfacebookcomv1.Retention{
+				Policy: slipwayk8sfacebookcomv1.RetentionDeleteUnmatched,
+			}
+			inventory := Inventory{"app": {
+				Destinations: []slipwayk8sfacebookcomv1.DestinationInventory{{
+					Repo:        imageMirror.Spec.DestRepo,
+					CreatedTags: []string{"v1", "v2"},
+				}},
+			}}
+
+			result := mirrorImage(context.Background(), ctrl.Log, imageMirror, inventory, "app", SecretData{}, noSecrets)
+			if !errors.Is(result.Err, tt.wantErr) {
+				t.Fatalf("mirrorImage() error = %v, want %v", result.Err, tt.wantErr)
+			}
+			if got := r.Tags("dst/app"); !reflect.DeepEqual(got, tt.wantCreated) {
+				t.Errorf("destination tags = %v, want %v", got, tt.wantCreated)
+			}
+			if result.Err != nil {
+				if got := countRequests(r.Requests(), "DELETE "); got != 0 {
+					t.Errorf("sent %d DELETE requests, want none", got)
+				}
+				return
+			}
+			if got := result.Destinations[0].CreatedTags; !reflect.DeepEqual(got, tt.wantCreated) {
+				t.Errorf("CreatedTags = %v, want %v", got, tt.wantCreated)
+			}
+		})
+	}
+}
+
+func TestNewestTags(t *testing.T) {
+	base := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	created := map[string]time.Time{
+		"a":   base.Add(2 * time.Hour),
+		"b":   base,
+		"c":   base.Add(time.Hour),
+		"d":   base.Add(time.Hour),
+		"old": base.Add(-time.Hour),
+	}
+	createdAt := func(tag string) (time.Time, error) {
+		if at, ok := created[tag]; ok {
+			return at, nil
+		}
+		return time.Time{}, errors.New("no creation time")
+	}
+
+	tests := []struct {
+		name    string
+		tags    []string
+		pattern string
+		n       int
+		want    []string
+	}{
+		{"semver", []string{"1.0.0", "1.10.0", "1.2.0", "1.9.1"}, "semver: >=1.0", 3, []string{"1.10.0", "1.9.1", "1.2.0"}},
+		{"semver ties", []string{"1.9", "1.10", "1.10.0"}, "semver: >=1.0", 2, []string{"1.10.0", "1.10"}},
+		{"numeric", []string{"build-9", "build-10", "build-2"}, "numeric:build-#", 2, []string{"build-10", "build-9"}},
+		{"regex capture", []string{"r9-x", "r10-x", "r2-x"}, "regex:^r(?P<number>[0-9]+)-x$", 1, []string{"r10-x"}},
+		{"created", []string{"b", "a", "c"}, "glob:*", 2, []string{"a", "c"}},
+		{"created ties by name", []string{"d", "c", "b"}, "glob:*", 2, []string{"c", "d"}},
+		{"missing created time is oldest", []string{"unknown", "old", "b"}, "glob:*", 3, []string{"b", "old", "unknown"}},
+		{"more than there are", []string{"b", "a"}, "glob:*", 5, []string{"a", "b"}},
+		{"none", []string{"b", "a"}, "glob:*", 0, []string{}},
+		{"no tags", nil, "glob:*", 3, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern := NewPattern(tt.pattern)
+			lookups := 0
+			got := NewestTags(tt.tags, pattern, tt.n, "app", func(tag string) (time.Time, error) {
+				lookups++
+				return createdAt(tag)
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewestTags() = %v, want %v", got, tt.want)
+			}
+			if !pattern.RequiresTimestamp() && lookups > 0 {
+				t.Errorf("NewestTags() looked up %d creation times for a %s pattern", lookups, tt.pattern)
+			}
+		})
+	}
+}
+
+// TestMirrorImageLatestAndRetention checks that latest limits which tags are
+// copied, while retention alone decides which created tags are pruned.
+func TestMirrorImageLatestAndRetention(t *testing.T) {
+	tests := []struct {
+		name         string
+		latest       int32
+		keep         int32
+		wantSelected []string
+		wantSkipped  map[string]slipwayk8sfacebookcomv1.SkipReason
+		wantPruned   []string
+	}{
+		{
+			name:         "retention keeps fewer",
+			latest:       3,
+			keep:         2,
+			wantSelected: []string{"build-4", "build-5"},
+			wantSkipped: map[string]slipwayk8sfacebookcomv1.SkipReason{
+				"build-1": slipwayk8sfacebookcomv1.SkipReasonNotLatest,
+				"build-2": slipwayk8sfacebookcomv1.SkipReasonNotLatest,
+				"build-3": slipwayk8sfacebookcomv1.SkipReasonNotRetained,
+			},
+			wantPruned: []string{"build-1", "build-3"},
+		},
+		{
+			name:         "latest selects fewer",
+			latest:       2,
+			keep:         4,
+			wantSelected: []string{"build-4", "build-5"},
+			wantSkipped: map[string]slipwayk8sfacebookcomv1.SkipReason{
+				"build-1": slipwayk8sfacebookcomv1.SkipReasonNotLatest,
+				"build-2": slipwayk8sfacebookcomv1.SkipReasonNotLatest,
+				"build-3": slipwayk8sfacebookcomv1.SkipReasonNotLatest,
+			},
+			wantPruned: []string{"build-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRegistry(t)
+			for _, tag := range []string{"build-1", "build-2", "build-3", "build-4", "build-5"} {
+				img, err := random.Image(64, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r.PushImage("src/app", tag, img)
+				if tag == "build-1" || tag == "build-3" {
+					r.PushImage("dst/app", tag, img)
+				}
+			}
+
+			imageMirror := testImageMirror(r)
+			imageMirror.Spec.Pattern = "numeric:build-#"
+			imageMirror.Spec.Latest = &tt.latest
+			imageMirror.Spec.Retention = &slipwayk8sfacebookcomv1.Retention{
+				Policy: slipwayk8sfacebookcomv1.RetentionKeepLatest,
+				Keep:   tt.keep,
+			}
+			inventory := Inventory{"app": {
+				Destinations: []slipwayk8sfacebookcomv1.DestinationInventory{{
+					Repo:        imageMirror.Spec.DestRepo,
+					CreatedTags: []string{"build-1", "build-3"},
+				}},
+			}}
+
+			result := mirrorImage(context.Background(), ctrl.Log, imageMirror, inventory, "app", SecretData{}, noSecrets)
+			if result.Err != nil {
+				t.Fatalf("mirrorImage() = %v", result.Err)
+			}
+			selected := append([]string{}, result.SelectedTags...)
+			sort.Strings(selected)
+			if !reflect.DeepEqual(selected, tt.wantSelected) {
+				t.Errorf("SelectedTags = %v, want %v", selected, tt.wantSelected)
+			}
+			skipped := make(map[string]slipwayk8sfacebookcomv1.SkipReason)
+			for _, s := range result.SkippedTags {
+				skipped[s.Tag] = s.Reason
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("SkippedTags = %v, want %v", skipped, tt.wantSkipped)
+			}
+
+			destination := result.Destinations[0]
+			if destination.Err != nil {
+				t.Fatalf("destination error = %v", destination.Err)
+			}
+			pruned := append([]string{}, destination.PrunedTags...)
+			sort.Strings(pruned)
+			if !reflect.DeepEqual(pruned, tt.wantPruned) {
+				t.Errorf("PrunedTags = %v, want %v", pruned, tt.wantPruned)
+			}
+			want := append([]string{}, tt.wantSelected...)
+			for _, tag := range []string{"build-1", "build-3"} {
+				if !containsString(tt.wantPruned, tag) {
+					want = append(want, tag)
+				}
+			}
+			sort.Strings(want)
+			if got := r.Tags("dst/app"); !reflect.DeepEqual(got, want) {
+				t.Errorf("destination tags = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// containsString returns true if s is one of list.
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"regexp"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// TagRewriter renames source tags as described by a TagTemplate. The zero
+// value leaves tags unchanged.
+type TagRewriter struct {
+	prefix      string
+	suffix      string
+	regexp      *regexp.Regexp
+	replacement string
+}
+
+// NewTagRewriter returns the TagRewriter described by template, which may be
+// nil, and an error if its regular expression is invalid.
+func NewTagRewriter(template *slipwayk8sfacebookcomv1.TagTemplate) (TagRewriter, error) {
+	var r TagRewriter
+	if template == nil {
+		return r, nil
+	}
+
+	r.prefix = template.Prefix
+	r.suffix = template.Suffix
+	r.replacement = template.Replacement
+	if template.Regex != "" {
+		re, err := regexp.Compile(template.Regex)
+		if err != nil {
+			return r, errors.Wrap(err, "unable to Compile regex")
+		}
+		r.regexp = re
+	}
+	return r, nil
+}
+
+// Rewrite returns the name of tag in the destinations.
+func (r TagRewriter) Rewrite(tag string) string {
+	if r.regexp != nil {
+		tag = r.regexp.ReplaceAllString(tag, r.replacement)
+	}
+	return r.prefix + tag + r.suffix
+}
+
+// RewriteAll returns the destination name of each of tags which can be
+// mirrored, and the tags which were skipped because their destination name
+// is invalid, or the same as that of an earlier tag.
+func (r TagRewriter) RewriteAll(tags []string) (rewritten map[string]string, skipped []slipwayk8sfacebookcomv1.SkippedTag) {
+	rewritten = make(map[string]string, len(tags))
+	sourceOf := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		destTag := r.Rewrite(tag)
+		if err := ValidateTag(destTag); err != nil {
+			skipped = append(skipped, slipwayk8sfacebookcomv1.SkippedTag{
+				Tag:     tag,
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag,
+				Message: "rewritten to " + destTag + ": " + err.Error(),
+			})
+			continue
+		}
+
+		if other, ok := sourceOf[destTag]; ok {
+			skipped = append(skipped, slipwayk8sfacebookcomv1.SkippedTag{
+				Tag:     tag,
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag,
+				Message: "rewritten to " + destTag + ", as is " + other,
+			})
+			continue
+		}
+
+		sourceOf[destTag] = tag
+		rewritten[tag] = destTag
+	}
+	return rewritten, skipped
+}
+
+// ValidateTag returns an error if tag is not a valid tag name.
+func ValidateTag(tag string) error {
+	if _, err := name.NewTag("example.com/image:"+tag, name.StrictValidation); err != nil {
+		return errors.New("must be a valid tag")
+	}
+	// Unlike registries, NewTag allows a tag to start with . or -.
+	if tag[0] == '.' || tag[0] == '-' {
+		return errors.New("must be a valid tag")
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestNewTagRewriter(t *testing.T) {
+	if _, err := NewTagRewriter(&slipwayk8sfacebookcomv1.TagTemplate{Regex: "("}); err == nil {
+		t.Errorf("NewTagRewriter() accepted an invalid regex")
+	}
+
+	r, err := NewTagRewriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Rewrite("v1.0"); got != "v1.0" {
+		t.Errorf("Rewrite() without a template = %q, want the tag unchanged", got)
+	}
+}
+
+func TestTagRewriterRewrite(t *testing.T) {
+	tests := []struct {
+		name     string
+		template slipwayk8sfacebookcomv1.TagTemplate
+		tag      string
+		want     string
+	}{
+		{"empty", slipwayk8sfacebookcomv1.TagTemplate{}, "v1.0", "v1.0"},
+		{"prefix and suffix", slipwayk8sfacebookcomv1.TagTemplate{Prefix: "upstream-", Suffix: "-mirror"}, "v1.0", "upstream-v1.0-mirror"},
+		{"numbered group", slipwayk8sfacebookcomv1.TagTemplate{Regex: "^v(.*)$", Replacement: "${1}"}, "v1.0", "1.0"},
+		{"named group", slipwayk8sfacebookcomv1.TagTemplate{Regex: "^(?P<version>.*)-alpine$", Replacement: "alpine-${version}"}, "3.12-alpine", "alpine-3.12"},
+		{"no match is left alone", slipwayk8sfacebookcomv1.TagTemplate{Regex: "^v(.*)$", Replacement: "${1}"}, "latest", "latest"},
+		{"every match is replaced", slipwayk8sfacebookcomv1.TagTemplate{Regex: "_", Replacement: "-"}, "a_b_c", "a-b-c"},
+		{
+			// The substitution does not see the prefix and suffix.
+			"substitution before prefix and suffix",
+			slipwayk8sfacebookcomv1.TagTemplate{Prefix: "v", Suffix: "-x", Regex: "^v(.*)-x$", Replacement: "${1}"},
+			"v1-x", "v1-x",
+		},
+		{
+			"prefix after substitution",
+			slipwayk8sfacebookcomv1.TagTemplate{Prefix: "mirror-", Regex: "^v", Replacement: ""},
+			"v2.0", "mirror-2.0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewTagRewriter(&tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Rewrite(tt.tag); got != tt.want {
+				t.Errorf("Rewrite(%q) = %q, want %q", tt.tag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagRewriterRewriteAll(t *testing.T) {
+	tests := []struct {
+		name          string
+		template      slipwayk8sfacebookcomv1.TagTemplate
+		tags          []string
+		wantRewritten map[string]string
+		wantSkipped   []slipwayk8sfacebookcomv1.SkippedTag
+	}{
+		{
+			name:          "unchanged",
+			tags:          []string{"v1", "latest"},
+			wantRewritten: map[string]string{"v1": "v1", "latest": "latest"},
+		},
+		{
+			name:          "renamed",
+			template:      slipwayk8sfacebookcomv1.TagTemplate{Prefix: "up-", Regex: "^v", Replacement: ""},
+			tags:          []string{"v1", "latest"},
+			wantRewritten: map[string]string{"v1": "up-1", "latest": "up-latest"},
+		},
+		{
+			name:          "collision keeps the first tag",
+			template:      slipwayk8sfacebookcomv1.TagTemplate{Regex: "^v", Replacement: ""},
+			tags:          []string{"v1.0", "1.0", "v2.0"},
+			wantRewritten: map[string]string{"v1.0": "1.0", "v2.0": "2.0"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{{
+				Tag:     "1.0",
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag,
+				Message: "rewritten to 1.0, as is v1.0",
+			}},
+		},
+		{
+			name:          "collision in the other order",
+			template:      slipwayk8sfacebookcomv1.TagTemplate{Regex: "^v", Replacement: ""},
+			tags:          []string{"1.0", "v1.0"},
+			wantRewritten: map[string]string{"1.0": "1.0"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{{
+				Tag:     "v1.0",
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag,
+				Message: "rewritten to 1.0, as is 1.0",
+			}},
+		},
+		{
+			name:          "many to one",
+			template:      slipwayk8sfacebookcomv1.TagTemplate{Regex: ".*", Replacement: "same"},
+			tags:          []string{"a", "b", "c"},
+			wantRewritten: map[string]string{"a": "same"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{
+				{Tag: "b", Reason: slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag, Message: "rewritten to same, as is a"},
+				{Tag: "c", Reason: slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag, Message: "rewritten to same, as is a"},
+			},
+		},
+		{
+			name:          "invalid names are skipped before collisions",
+			template:      slipwayk8sfacebookcomv1.TagTemplate{Regex: "^v", Replacement: "-"},
+			tags:          []string{"v1", "x1", "1", ".1"},
+			wantRewritten: map[string]string{"x1": "x1", "1": "1"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{{
+				Tag:     "v1",
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag,
+				Message: "rewritten to -1: must be a valid tag",
+			}, {
+				Tag:     ".1",
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag,
+				Message: "rewritten to .1: must be a valid tag",
+			}},
+		},
+		{
+			name:          "too long",
+			template:      slipwayk8sfacebookcomv1.TagTemplate{Prefix: strings.Repeat("p", 126)},
+			tags:          []string{"1", "10"},
+			wantRewritten: map[string]string{"1": strings.Repeat("p", 126) + "1"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{{
+				Tag:     "10",
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonInvalidDestTag,
+				Message: "rewritten to " + strings.Repeat("p", 126) + "10: must be a valid tag",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewTagRewriter(&tt.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewritten, skipped := r.RewriteAll(tt.tags)
+			if !reflect.DeepEqual(rewritten, tt.wantRewritten) {
+				t.Errorf("RewriteAll() rewrote %v, want %v", rewritten, tt.wantRewritten)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("RewriteAll() skipped %+v, want %+v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
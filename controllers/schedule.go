@@ -0,0 +1,87 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// DefaultInterval is how often an ImageMirror is resynced when neither an
+// interval nor a schedule is specified.
+const DefaultInterval = time.Hour
+
+// ParseSchedule parses a standard five field cron expression, e.g.
+// "0 */6 * * *", together with an IANA time zone name. An empty timeZone is
+// interpreted as UTC.
+func ParseSchedule(schedule, timeZone string) (cron.Schedule, *time.Location, error) {
+	sched, err := cron.ParseStandard(schedule)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "invalid schedule %q", schedule)
+	}
+
+	loc := time.UTC
+	if timeZone != "" {
+		loc, err = time.LoadLocation(timeZone)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "invalid time zone %q", timeZone)
+		}
+	}
+
+	return sched, loc, nil
+}
+
+// NextSyncTime returns the time after now at which the ImageMirror described
+// by spec should next be synced. A schedule takes precedence over an interval.
+func NextSyncTime(spec slipwayk8sfacebookcomv1.ImageMirrorSpec, now time.Time) (time.Time, error) {
+	if spec.Schedule != "" {
+		sched, loc, err := ParseSchedule(spec.Schedule, spec.TimeZone)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return sched.Next(now.In(loc)), nil
+	}
+
+	if spec.Interval != nil && spec.Interval.Duration > 0 {
+		return now.Add(spec.Interval.Duration), nil
+	}
+
+	return now.Add(DefaultInterval), nil
+}
+
+// RequeueTime returns when a mirror synced at now should be reconciled again,
+// given its nextSyncTime and the earliest retryTime of its failed tags, which
+// is zero if none failed. Failed tags are retried on their own backoff, which
+// may be sooner than the next scheduled sync, and destinations which could
+// not be synced at all are retried within a minute, as if the whole mirror
+// had failed.
+func RequeueTime(nextSyncTime, retryTime time.Time, destinationFailed bool, now time.Time) time.Time {
+	requeueTime := nextSyncTime
+	if !retryTime.IsZero() && retryTime.Before(requeueTime) {
+		requeueTime = retryTime
+	}
+	if destinationFailed {
+		if retryTime := now.Add(time.Minute); retryTime.Before(requeueTime) {
+			requeueTime = retryTime
+		}
+	}
+	return requeueTime
+}
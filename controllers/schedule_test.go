@@ -0,0 +1,138 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		name     string
+		schedule string
+		timeZone string
+		wantLoc  string
+		wantErr  bool
+	}{
+		{"every six hours", "0 */6 * * *", "", "UTC", false},
+		{"descriptor", "@daily", "", "UTC", false},
+		{"time zone", "0 9 * * 1-5", "Europe/London", "Europe/London", false},
+		{"empty", "", "", "", true},
+		{"seconds field", "0 0 */6 * * *", "", "", true},
+		{"out of range", "0 25 * * *", "", "", true},
+		{"invalid time zone", "0 9 * * *", "Mars/Olympus_Mons", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched, loc, err := ParseSchedule(tt.schedule, tt.timeZone)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSchedule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if sched == nil || loc.String() != tt.wantLoc {
+				t.Errorf("ParseSchedule() = %v, %v, want a schedule in %s", sched, loc, tt.wantLoc)
+			}
+		})
+	}
+}
+
+func TestNextSyncTime(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC)
+	interval := func(d time.Duration) *metav1.Duration { return &metav1.Duration{Duration: d} }
+
+	tests := []struct {
+		name    string
+		spec    slipwayk8sfacebookcomv1.ImageMirrorSpec
+		want    time.Time
+		wantErr bool
+	}{
+		{"default", slipwayk8sfacebookcomv1.ImageMirrorSpec{}, now.Add(DefaultInterval), false},
+		{"interval", slipwayk8sfacebookcomv1.ImageMirrorSpec{Interval: interval(10 * time.Minute)}, now.Add(10 * time.Minute), false},
+		{"zero interval", slipwayk8sfacebookcomv1.ImageMirrorSpec{Interval: interval(0)}, now.Add(DefaultInterval), false},
+		{"schedule", slipwayk8sfacebookcomv1.ImageMirrorSpec{Schedule: "0 */6 * * *"}, time.Date(2020, 6, 1, 18, 0, 0, 0, time.UTC), false},
+		{
+			"schedule takes precedence over interval",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{Schedule: "0 */6 * * *", Interval: interval(time.Minute)},
+			time.Date(2020, 6, 1, 18, 0, 0, 0, time.UTC),
+			false,
+		},
+		{
+			// 9:00 in New York is 13:00 UTC in summer.
+			"time zone",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{Schedule: "0 9 * * *", TimeZone: "America/New_York"},
+			time.Date(2020, 6, 1, 13, 0, 0, 0, time.UTC),
+			false,
+		},
+		{
+			// 9:00 in Tokyo has already passed, so the next is tomorrow.
+			"time zone tomorrow",
+			slipwayk8sfacebookcomv1.ImageMirrorSpec{Schedule: "0 9 * * *", TimeZone: "Asia/Tokyo"},
+			time.Date(2020, 6, 2, 0, 0, 0, 0, time.UTC),
+			false,
+		},
+		{"invalid schedule", slipwayk8sfacebookcomv1.ImageMirrorSpec{Schedule: "hourly", Interval: interval(time.Minute)}, time.Time{}, true},
+		{"invalid time zone", slipwayk8sfacebookcomv1.ImageMirrorSpec{Schedule: "@hourly", TimeZone: "Nowhere"}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NextSyncTime(tt.spec, now)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NextSyncTime() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("NextSyncTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequeueTime(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 30, 0, 0, time.UTC)
+	nextSync := now.Add(6 * time.Hour)
+
+	tests := []struct {
+		name              string
+		nextSyncTime      time.Time
+		retryTime         time.Time
+		destinationFailed bool
+		want              time.Time
+	}{
+		{"nothing failed", nextSync, time.Time{}, false, nextSync},
+		{"tag retried before the schedule", nextSync, now.Add(4 * time.Minute), false, now.Add(4 * time.Minute)},
+		{"tag backoff beyond the schedule", nextSync, now.Add(8 * time.Hour), false, nextSync},
+		{"destination failed", nextSync, time.Time{}, true, now.Add(time.Minute)},
+		{"destination failed and tag retried sooner", nextSync, now.Add(30 * time.Second), true, now.Add(30 * time.Second)},
+		{"destination failed before a sooner sync", now.Add(30 * time.Second), time.Time{}, true, now.Add(30 * time.Second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RequeueTime(tt.nextSyncTime, tt.retryTime, tt.destinationFailed, now); !got.Equal(tt.want) {
+				t.Errorf("RequeueTime() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// Selector selects source tags which match any of Include, or are listed in
+// Tags, unless they match one of Exclude. Literal Tags are never excluded.
+type Selector struct {
+	Include []Pattern
+	Exclude []Pattern
+	Tags    []string
+}
+
+// NewSelector returns the Selector described by the Pattern, Include,
+// Exclude and Tags of spec, and an error if any pattern is invalid.
+func NewSelector(spec slipwayk8sfacebookcomv1.ImageMirrorSpec) (Selector, error) {
+	var selector Selector
+
+	includes := spec.Include
+	if spec.Pattern != "" {
+		includes = append([]string{spec.Pattern}, includes...)
+	}
+	for _, include := range includes {
+		p, err := ParsePattern(include)
+		if err != nil {
+			return selector, errors.Wrap(err, "unable to ParsePattern include")
+		}
+		selector.Include = append(selector.Include, p)
+	}
+
+	for _, exclude := range spec.Exclude {
+		p, err := ParsePattern(exclude)
+		if err != nil {
+			return selector, errors.Wrap(err, "unable to ParsePattern exclude")
+		}
+		selector.Exclude = append(selector.Exclude, p)
+	}
+
+	selector.Tags = spec.Tags
+	return selector, nil
+}
+
+// Ordering returns the pattern whose Newer function orders the selected
+// tags, which is the first include, or PatternAll if there is none.
+func (s Selector) Ordering() Pattern {
+	if len(s.Include) > 0 {
+		return s.Include[0]
+	}
+	return PatternAll
+}
+
+// Select returns the selected tags, in the order given, and the tags which
+// were not selected together with the rule which excluded each of them.
+func (s Selector) Select(tags []string) (selected []string, skipped []slipwayk8sfacebookcomv1.SkippedTag) {
+	literal := make(map[string]bool, len(s.Tags))
+	for _, tag := range s.Tags {
+		literal[tag] = true
+	}
+
+	selected = []string{}
+	for _, tag := range tags {
+		if literal[tag] {
+			selected = append(selected, tag)
+			continue
+		}
+
+		if !s.included(tag) {
+			skipped = append(skipped, slipwayk8sfacebookcomv1.SkippedTag{
+				Tag:    tag,
+				Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded,
+			})
+			continue
+		}
+
+		if exclude := s.excludedBy(tag); exclude != nil {
+			skipped = append(skipped, slipwayk8sfacebookcomv1.SkippedTag{
+				Tag:     tag,
+				Reason:  slipwayk8sfacebookcomv1.SkipReasonExcluded,
+				Message: "excluded by " + exclude.String(),
+			})
+			continue
+		}
+
+		selected = append(selected, tag)
+	}
+
+	return selected, skipped
+}
+
+func (s Selector) included(tag string) bool {
+	for _, p := range s.Include {
+		if p.Matches(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Selector) excludedBy(tag string) Pattern {
+	for _, p := range s.Exclude {
+		if p.Matches(tag) {
+			return p
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestNewSelector(t *testing.T) {
+	tests := []struct {
+		name         string
+		spec         slipwayk8sfacebookcomv1.ImageMirrorSpec
+		wantOrdering string
+		wantErr      bool
+	}{
+		{"nothing", slipwayk8sfacebookcomv1.ImageMirrorSpec{}, PatternAll.String(), false},
+		{"pattern orders", slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: "semver:>=1.0", Include: []string{"glob:*"}}, "semver:>=1.0", false},
+		{"first include orders", slipwayk8sfacebookcomv1.ImageMirrorSpec{Include: []string{"numeric:build-#", "glob:*"}}, "numeric:build-#", false},
+		{"invalid pattern", slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: "semver:not a constraint"}, "", true},
+		{"invalid include", slipwayk8sfacebookcomv1.ImageMirrorSpec{Include: []string{"regex:("}}, "", true},
+		{"invalid exclude", slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: "glob:*", Exclude: []string{"numeric:#-#"}}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := NewSelector(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSelector() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := selector.Ordering().String(); got != tt.wantOrdering {
+				t.Errorf("Ordering() = %q, want %q", got, tt.wantOrdering)
+			}
+		})
+	}
+}
+
+func TestSelectorSelect(t *testing.T) {
+	tags := []string{"latest", "v1.0.0", "v1.1.0-rc1", "v1.1.0", "v2.0.0", "nightly"}
+
+	tests := []struct {
+		name         string
+		spec         slipwayk8sfacebookcomv1.ImageMirrorSpec
+		wantSelected []string
+		wantSkipped  []slipwayk8sfacebookcomv1.SkippedTag
+	}{
+		{
+			name:         "nothing selects nothing",
+			spec:         slipwayk8sfacebookcomv1.ImageMirrorSpec{},
+			wantSelected: []string{},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{
+				{Tag: "latest", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.1.0-rc1", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.1.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v2.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "nightly", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+			},
+		},
+		{
+			name:         "pattern",
+			spec:         slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: "semver:~1"},
+			wantSelected: []string{"v1.0.0", "v1.1.0"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{
+				{Tag: "latest", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.1.0-rc1", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v2.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "nightly", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+			},
+		},
+		{
+			name: "pattern or include, unless excluded",
+			spec: slipwayk8sfacebookcomv1.ImageMirrorSpec{
+				Pattern: "glob:v1.*",
+				Include: []string{"glob:v2.*", "glob:nightly"},
+				Exclude: []string{"glob:*-rc*", "glob:v1.0.*"},
+			},
+			wantSelected: []string{"v1.1.0", "v2.0.0", "nightly"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{
+				{Tag: "latest", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonExcluded, Message: "excluded by glob:v1.0.*"},
+				{Tag: "v1.1.0-rc1", Reason: slipwayk8sfacebookcomv1.SkipReasonExcluded, Message: "excluded by glob:*-rc*"},
+			},
+		},
+		{
+			name: "first matching exclude is reported",
+			spec: slipwayk8sfacebookcomv1.ImageMirrorSpec{
+				Pattern: "glob:*",
+				Exclude: []string{"regex:^v1", "glob:*-rc*"},
+			},
+			wantSelected: []string{"latest", "v2.0.0", "nightly"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{
+				{Tag: "v1.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonExcluded, Message: "excluded by regexp:^v1"},
+				{Tag: "v1.1.0-rc1", Reason: slipwayk8sfacebookcomv1.SkipReasonExcluded, Message: "excluded by regexp:^v1"},
+				{Tag: "v1.1.0", Reason: slipwayk8sfacebookcomv1.SkipReasonExcluded, Message: "excluded by regexp:^v1"},
+			},
+		},
+		{
+			name: "literal tags are never excluded",
+			spec: slipwayk8sfacebookcomv1.ImageMirrorSpec{
+				Pattern: "semver:>=2",
+				Exclude: []string{"glob:*"},
+				Tags:    []string{"latest", "v1.1.0-rc1", "missing"},
+			},
+			wantSelected: []string{"latest", "v1.1.0-rc1"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{
+				{Tag: "v1.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.1.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v2.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonExcluded, Message: "excluded by glob:*"},
+				{Tag: "nightly", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+			},
+		},
+		{
+			name:         "literal tags only",
+			spec:         slipwayk8sfacebookcomv1.ImageMirrorSpec{Tags: []string{"nightly", "latest"}},
+			wantSelected: []string{"latest", "nightly"},
+			wantSkipped: []slipwayk8sfacebookcomv1.SkippedTag{
+				{Tag: "v1.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.1.0-rc1", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v1.1.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+				{Tag: "v2.0.0", Reason: slipwayk8sfacebookcomv1.SkipReasonNotIncluded},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := NewSelector(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selected, skipped := selector.Select(tags)
+			if !reflect.DeepEqual(selected, tt.wantSelected) {
+				t.Errorf("Select() selected %v, want %v", selected, tt.wantSelected)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("Select() skipped %+v, want %+v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+// TestSelectorLatest checks that latest limits the selected tags, ordered by
+// the first include, after exclusions, as mirrorImage applies them.
+func TestSelectorLatest(t *testing.T) {
+	tags := []string{"build-9", "build-10", "build-11-rc", "build-8", "build-12", "latest"}
+	noTimestamps := func(string) (time.Time, error) { return time.Time{}, errors.New("no creation time") }
+
+	tests := []struct {
+		name   string
+		spec   slipwayk8sfacebookcomv1.ImageMirrorSpec
+		latest int
+		want   []string
+	}{
+		{"newest two", slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: "numeric:build-#"}, 2, []string{"build-12", "build-10"}},
+		{"after excluding the newest", slipwayk8sfacebookcomv1.ImageMirrorSpec{
+			Include: []string{"numeric:build-#*"},
+			Exclude: []string{"glob:*-rc", "glob:build-12"},
+		}, 2, []string{"build-10", "build-9"}},
+		{"literal tags are limited too", slipwayk8sfacebookcomv1.ImageMirrorSpec{
+			Pattern: "numeric:build-#",
+			Tags:    []string{"latest"},
+		}, 3, []string{"build-12", "build-10", "build-9"}},
+		{"more than there are", slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: "numeric:build-#"}, 10, []string{"build-12", "build-10", "build-9", "build-8"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			selector, err := NewSelector(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selected, _ := selector.Select(tags)
+			if got := NewestTags(selected, selector.Ordering(), tt.latest, "app", noTimestamps); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("NewestTags() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+// parameterRef matches a reference to a parameter, e.g. $(image).
+var parameterRef = regexp.MustCompile(`\$\(([A-Za-z0-9_.-]+)\)`)
+
+// RenderImageMirrorSpec returns template with every reference to a parameter
+// in values, of the form $(key), replaced by its value. References to other
+// parameters are left alone, as are regex replacements such as ${1}.
+func RenderImageMirrorSpec(template slipwayk8sfacebookcomv1.ImageMirrorSpec,
+	values map[string]string) (slipwayk8sfacebookcomv1.ImageMirrorSpec, error) {
+	var spec slipwayk8sfacebookcomv1.ImageMirrorSpec
+
+	raw, err := json.Marshal(template)
+	if err != nil {
+		return spec, errors.Wrap(err, "unable to Marshal template")
+	}
+
+	// Every string in the template is quoted, so each value is escaped in
+	// the same way before it is substituted.
+	rendered := parameterRef.ReplaceAllFunc(raw, func(ref []byte) []byte {
+		value, ok := values[string(parameterRef.FindSubmatch(ref)[1])]
+		if !ok {
+			return ref
+		}
+		quoted, _ := json.Marshal(value)
+		return quoted[1 : len(quoted)-1]
+	})
+
+	if err := json.Unmarshal(rendered, &spec); err != nil {
+		return spec, errors.Wrap(err, "unable to Unmarshal rendered template")
+	}
+	return spec, nil
+}
+
+// ParseParameters parses parameters given as key=value lines, as in an env
+// file. Blank lines and lines starting with # are ignored.
+func ParseParameters(data string) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, errors.Errorf("line %d: expected key=value", i+1)
+		}
+		values[strings.TrimSpace(line[:eq])] = strings.TrimSpace(line[eq+1:])
+	}
+	return values, nil
+}
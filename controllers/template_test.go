@@ -0,0 +1,99 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"testing"
+
+	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
+)
+
+func TestRenderImageMirrorSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		template slipwayk8sfacebookcomv1.ImageMirrorSpec
+		values   map[string]string
+		want     slipwayk8sfacebookcomv1.ImageMirrorSpec
+	}{
+		{
+			name:     "parameters",
+			template: slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "docker.io", ImageName: "$(name)", Pattern: "$(pattern)"},
+			values:   map[string]string{"name": "centos", "pattern": "semver: ~7"},
+			want:     slipwayk8sfacebookcomv1.ImageMirrorSpec{SourceRepo: "docker.io", ImageName: "centos", Pattern: "semver: ~7"},
+		},
+		{
+			name:     "within strings and lists",
+			template: slipwayk8sfacebookcomv1.ImageMirrorSpec{DestRepo: "registry.example.com/$(team)/", Tags: []string{"$(tag)", "$(tag)-slim"}},
+			values:   map[string]string{"team": "base", "tag": "7"},
+			want:     slipwayk8sfacebookcomv1.ImageMirrorSpec{DestRepo: "registry.example.com/base/", Tags: []string{"7", "7-slim"}},
+		},
+		{
+			name:     "undefined parameters and replacements are left alone",
+			template: slipwayk8sfacebookcomv1.ImageMirrorSpec{ImageName: "$(name)", Pattern: "$(pattern)", TagTemplate: &slipwayk8sfacebookcomv1.TagTemplate{Replacement: "${1}"}},
+			values:   map[string]string{"name": "app"},
+			want:     slipwayk8sfacebookcomv1.ImageMirrorSpec{ImageName: "app", Pattern: "$(pattern)", TagTemplate: &slipwayk8sfacebookcomv1.TagTemplate{Replacement: "${1}"}},
+		},
+		{
+			name:     "values are escaped",
+			template: slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: "$(pattern)"},
+			values:   map[string]string{"pattern": `regex:^"v\d+"$`},
+			want:     slipwayk8sfacebookcomv1.ImageMirrorSpec{Pattern: `regex:^"v\d+"$`},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RenderImageMirrorSpec(tt.template, tt.values)
+			if err != nil {
+				t.Fatalf("RenderImageMirrorSpec() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("RenderImageMirrorSpec() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"key=value lines", "pattern=semver: ~7\nlatest = 3\n", map[string]string{"pattern": "semver: ~7", "latest": "3"}, false},
+		{"comments and blank lines", "# base images\n\n  image=centos  \n", map[string]string{"image": "centos"}, false},
+		{"value with =", "include=regex:^a=b$", map[string]string{"include": "regex:^a=b$"}, false},
+		{"empty value", "pattern=", map[string]string{"pattern": ""}, false},
+		{"missing =", "image=centos\npattern", nil, true},
+		{"missing key", "=centos", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseParameters(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseParameters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+)
+
+// tracerName names the tracer which creates every span of slipway.
+const tracerName = "github.com/davidewatson/slipway"
+
+// Attributes of the spans of registry operations.
+var (
+	repositoryKey = kv.Key("slipway.repository")
+	tagKey        = kv.Key("slipway.tag")
+	digestKey     = kv.Key("slipway.digest")
+	bytesKey      = kv.Key("slipway.bytes")
+)
+
+// TracingOptions configures the export of traces.
+type TracingOptions struct {
+	// Endpoint is the host:port of an OTLP gRPC collector. Tracing is
+	// disabled if it is empty.
+	Endpoint string
+	// Insecure connects to Endpoint without TLS.
+	Insecure bool
+	// SamplingRatio is the fraction of reconciles which are traced.
+	SamplingRatio float64
+}
+
+// SetupTracing exports traces as described by options, and returns a
+// function which flushes and stops the exporter. If no endpoint is
+// configured, spans are not recorded at all.
+func SetupTracing(options TracingOptions) (func(), error) {
+	if options.Endpoint == "" {
+		return func() {}, nil
+	}
+
+	exporterOptions := []otlp.ExporterOption{otlp.WithAddress(options.Endpoint)}
+	if options.Insecure {
+		exporterOptions = append(exporterOptions, otlp.WithInsecure())
+	} else {
+		exporterOptions = append(exporterOptions, otlp.WithTLSCredentials(credentials.NewClientTLSFromCert(nil, "")))
+	}
+	exporter, err := otlp.NewExporter(exporterOptions...)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to NewExporter")
+	}
+
+	// The sampling decision depends only on the trace ID, so the spans of
+	// a reconcile are either all sampled or all dropped.
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.ProbabilitySampler(options.SamplingRatio)}),
+		sdktrace.WithResource(sdkresource.New(kv.String("service.name", "slipway"))))
+	if err != nil {
+		_ = exporter.Stop()
+		return nil, errors.Wrap(err, "unable to NewProvider")
+	}
+
+	processor, err := sdktrace.NewBatchSpanProcessor(exporter)
+	if err != nil {
+		_ = exporter.Stop()
+		return nil, errors.Wrap(err, "unable to NewBatchSpanProcessor")
+	}
+	provider.RegisterSpanProcessor(processor)
+	global.SetTraceProvider(provider)
+
+	// Unregistering the processor flushes the spans which are queued.
+	return func() {
+		provider.UnregisterSpanProcessor(processor)
+		_ = exporter.Stop()
+	}, nil
+}
+
+// startSpan starts a span named name as a child of any span in ctx.
+func startSpan(ctx context.Context, name string, attrs ...kv.KeyValue) (context.Context, trace.Span) {
+	return global.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span, and ends it.
+func endSpan(ctx context.Context, span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(ctx, err, trace.WithErrorStatus(codes.Unknown))
+	}
+	span.End()
+}
+
+// withTraceContext returns options whose registry requests are traced as
+// children of the span in ctx. go-containerregistry does not pass a context
+// to most requests, so it is bound to the transport instead.
+func withTraceContext(ctx context.Context, options []remote.Option) []remote.Option {
+	return append(options[:len(options):len(options)],
+		remote.WithTransport(&tracingTransport{ctx: ctx, inner: meteredTransport}))
+}
+
+// tracingTransport records a span for every request to a registry. The span
+// is a child of any span in the context of the request, or else of any span
+// in ctx. It ends when the response headers are received, so it includes the
+// upload of a blob, but not its download. Uploads are streamed, so the bytes
+// sent are counted as they are read.
+type tracingTransport struct {
+	ctx   context.Context
+	inner http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() && t.ctx != nil {
+		ctx = t.ctx
+	}
+
+	ctx, span := startSpan(ctx, "HTTP "+req.Method,
+		kv.String("http.method", req.Method),
+		kv.String("http.host", req.URL.Host),
+		kv.String("http.target", req.URL.Path))
+
+	req = req.WithContext(ctx)
+	var body *countingReadCloser
+	if req.Body != nil && req.Body != http.NoBody {
+		body = &countingReadCloser{ReadCloser: req.Body}
+		req.Body = body
+	}
+
+	resp, err := t.inner.RoundTrip(req)
+	if body != nil {
+		span.SetAttributes(bytesKey.Int64(atomic.LoadInt64(&body.n)))
+	}
+	if err == nil {
+		span.SetAttributes(kv.Int("http.status_code", resp.StatusCode),
+			kv.Int64("http.response_content_length", resp.ContentLength))
+	}
+	endSpan(ctx, span, err)
+	return resp, err
+}
+
+// countingReadCloser counts the bytes read from a request body. The body may
+// still be read by the transport after the response arrives, so the count is
+// updated atomically. n comes first so that it is 64-bit aligned.
+type countingReadCloser struct {
+	n int64
+	io.ReadCloser
+}
+
+// Read implements io.Reader.
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,231 @@
+/*
+Copyright (c) 2020 Facebook, Inc. and its affiliates.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"go.opentelemetry.io/otel/api/global"
+	"go.opentelemetry.io/otel/api/kv"
+	"go.opentelemetry.io/otel/api/trace"
+	export "go.opentelemetry.io/otel/sdk/export/trace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"google.golang.org/grpc/codes"
+)
+
+// spanRecorder is an in-memory exporter of the spans which have ended.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*export.SpanData
+}
+
+// ExportSpan implements export.SpanSyncer.
+func (r *spanRecorder) ExportSpan(_ context.Context, span *export.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Spans returns the spans named name.
+func (r *spanRecorder) Spans(name string) []*export.SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var spans []*export.SpanData
+	for _, span := range r.spans {
+		if span.Name == name {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
+
+// recordSpans samples every span until t ends, and returns the recorder they
+// are exported to.
+func recordSpans(t *testing.T) *spanRecorder {
+	r := &spanRecorder{}
+	provider, err := sdktrace.NewProvider(
+		sdktrace.WithConfig(sdktrace.Config{DefaultSampler: sdktrace.AlwaysSample()}),
+		sdktrace.WithSyncer(r))
+	if err != nil {
+		t.Fatal(err)
+	}
+	global.SetTraceProvider(provider)
+	t.Cleanup(func() { global.SetTraceProvider(trace.NoopProvider{}) })
+	return r
+}
+
+// spanAttribute returns the value of the attribute key of span, or "" if it
+// has none.
+func spanAttribute(span *export.SpanData, key kv.Key) string {
+	for _, attr := range span.Attributes {
+		if attr.Key == key {
+			return attr.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracingTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			w.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name           string
+		method         string
+		url            string
+		body           string
+		requestParent  bool
+		transportCtx   bool
+		wantParent     string
+		wantStatusCode string
+		wantBytes      string
+		wantErr        bool
+	}{
+		{"no parent", http.MethodGet, server.URL + "/v2/", "", false, false, "", "200", "", false},
+		{"parent from request", http.MethodGet, server.URL + "/v2/", "", true, false, "Request", "200", "", false},
+		{"parent from transport", http.MethodGet, server.URL + "/v2/", "", false, true, "Transport", "200", "", false},
+		{"request takes precedence", http.MethodGet, server.URL + "/v2/", "", true, true, "Request", "200", "", false},
+		{"upload", http.MethodPost, server.URL + "/v2/app/blobs/uploads/", "layer", false, true, "Transport", "202", "5", false},
+		{"network error", http.MethodGet, closed.URL + "/v2/", "", false, true, "Transport", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := recordSpans(t)
+			parents := make(map[string]trace.SpanContext)
+
+			transport := &tracingTransport{inner: http.DefaultTransport}
+			if tt.transportCtx {
+				ctx, span := startSpan(context.Background(), "Transport")
+				defer span.End()
+				transport.ctx = ctx
+				parents["Transport"] = span.SpanContext()
+			}
+			req, err := http.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.body == "" {
+				req.Body = http.NoBody
+			}
+			if tt.requestParent {
+				ctx, span := startSpan(context.Background(), "Request")
+				defer span.End()
+				req = req.WithContext(ctx)
+				parents["Request"] = span.SpanContext()
+			}
+
+			resp, err := transport.RoundTrip(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("RoundTrip() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			spans := recorder.Spans("HTTP " + tt.method)
+			if len(spans) != 1 {
+				t.Fatalf("recorded %d spans, want 1", len(spans))
+			}
+			span := spans[0]
+			if parent, ok := parents[tt.wantParent]; ok {
+				if span.SpanContext.TraceID != parent.TraceID || span.ParentSpanID != parent.SpanID {
+					t.Errorf("span is a child of %s in %s, want a child of %s", span.ParentSpanID, span.SpanContext.TraceID, tt.wantParent)
+				}
+			} else if span.ParentSpanID.IsValid() {
+				t.Errorf("span is a child of %s, want a root span", span.ParentSpanID)
+			}
+
+			host := strings.TrimPrefix(tt.url, "http://")
+			host = host[:strings.Index(host, "/")]
+			attributes := map[kv.Key]string{
+				"http.method":      tt.method,
+				"http.host":        host,
+				"http.target":      strings.TrimPrefix(tt.url, "http://"+host),
+				"http.status_code": tt.wantStatusCode,
+				bytesKey:           tt.wantBytes,
+			}
+			for key, want := range attributes {
+				if got := spanAttribute(span, key); got != want {
+					t.Errorf("attribute %s = %q, want %q", key, got, want)
+				}
+			}
+			wantCode := codes.OK
+			if tt.wantErr {
+				wantCode = codes.Unknown
+			}
+			if span.StatusCode != wantCode {
+				t.Errorf("status = %v, want %v", span.StatusCode, wantCode)
+			}
+		})
+	}
+}
+
+// TestWithTraceContext checks that the requests go-containerregistry makes,
+// without passing on a context, are traced as children of the span in the
+// context bound to its options.
+func TestWithTraceContext(t *testing.T) {
+	r := newTestRegistry(t)
+	img, err := random.Image(64, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.PushImage("src/app", "v1", img)
+	recorder := recordSpans(t)
+
+	ctx, span := startSpan(context.Background(), "MirrorTag", tagKey.String("v1"))
+	ref, err := name.ParseReference(r.Host() + "/src/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	image, err := remote.Image(ref, withTraceContext(ctx, nil)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := image.RawConfigFile(); err != nil {
+		t.Fatal(err)
+	}
+	span.End()
+
+	parent := span.SpanContext()
+	requests := recorder.Spans("HTTP GET")
+	if len(requests) < 2 {
+		t.Fatalf("recorded %d requests, want at least the manifest and config", len(requests))
+	}
+	for _, request := range requests {
+		if request.SpanContext.TraceID != parent.TraceID || request.ParentSpanID != parent.SpanID {
+			t.Errorf("request for %s is not a child of MirrorTag", spanAttribute(request, "http.target"))
+		}
+	}
+	if spans := recorder.Spans("MirrorTag"); len(spans) != 1 || spanAttribute(spans[0], tagKey) != "v1" {
+		t.Errorf("MirrorTag spans = %v, want one for v1", spans)
+	}
+}
@@ -24,6 +24,7 @@ import (
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	slipwayk8sfacebookcomv1 "github.com/davidewatson/slipway/api/v1"
@@ -46,14 +47,33 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var notificationAddr string
+	var inventoryNamespace string
+	var tracing controllers.TracingOptions
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&notificationAddr, "notification-addr", "",
+		"The address the registry notification endpoint binds to. "+
+			"Notifications are disabled if empty, or if the shared secret in NOTIFICATION_SECRET is not set.")
+	flag.StringVar(&inventoryNamespace, "cluster-inventory-namespace", "slipway-system",
+		"The namespace of the MirrorInventories which list the tags of each ClusterImageMirror.")
+	flag.StringVar(&tracing.Endpoint, "otlp-endpoint", "",
+		"The host:port of an OTLP gRPC collector to export traces to. Tracing is disabled if empty.")
+	flag.BoolVar(&tracing.Insecure, "otlp-insecure", false, "Connect to the OTLP collector without TLS.")
+	flag.Float64Var(&tracing.SamplingRatio, "trace-sampling-ratio", 1, "The fraction of reconciles which are traced.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
+	stopTracing, err := controllers.SetupTracing(tracing)
+	if err != nil {
+		setupLog.Error(err, "unable to setup tracing")
+		os.Exit(1)
+	}
+	defer stopTracing()
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -66,14 +86,81 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Registry notifications trigger the mirrors of the pushed repositories
+	// through their controllers.
+	var imageMirrorNotifications, clusterImageMirrorNotifications chan event.GenericEvent
+	notificationSecret := os.Getenv("NOTIFICATION_SECRET")
+	if notificationAddr != "" && notificationSecret == "" {
+		setupLog.Info("not receiving notifications, since NOTIFICATION_SECRET is not set")
+	} else if notificationAddr != "" {
+		imageMirrorNotifications = make(chan event.GenericEvent, controllers.NotificationQueueSize)
+		clusterImageMirrorNotifications = make(chan event.GenericEvent, controllers.NotificationQueueSize)
+		receiver := &controllers.NotificationReceiver{
+			Client:              mgr.GetClient(),
+			Log:                 ctrl.Log.WithName("notifications"),
+			Addr:                notificationAddr,
+			Secret:              notificationSecret,
+			ImageMirrors:        imageMirrorNotifications,
+			ClusterImageMirrors: clusterImageMirrorNotifications,
+		}
+		if err = mgr.Add(receiver); err == nil {
+			err = mgr.Add(receiver.Elected())
+		}
+		if err != nil {
+			setupLog.Error(err, "unable to add notification receiver")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controllers.ImageMirrorReconciler{
+		Client:        mgr.GetClient(),
+		Log:           ctrl.Log.WithName("controllers").WithName("ImageMirror"),
+		Scheme:        mgr.GetScheme(),
+		Recorder:      mgr.GetEventRecorderFor("imagemirror-controller"),
+		APIReader:     mgr.GetAPIReader(),
+		Notifications: imageMirrorNotifications,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ImageMirror")
+		os.Exit(1)
+	}
+	if err = (&controllers.ClusterImageMirrorReconciler{
+		Client:             mgr.GetClient(),
+		Log:                ctrl.Log.WithName("controllers").WithName("ClusterImageMirror"),
+		Scheme:             mgr.GetScheme(),
+		Recorder:           mgr.GetEventRecorderFor("clusterimagemirror-controller"),
+		InventoryNamespace: inventoryNamespace,
+		APIReader:          mgr.GetAPIReader(),
+		Notifications:      clusterImageMirrorNotifications,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ClusterImageMirror")
+		os.Exit(1)
+	}
+	if err = (&controllers.ImageMirrorSetReconciler{
 		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("ImageMirror"),
+		Log:    ctrl.Log.WithName("controllers").WithName("ImageMirrorSet"),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "ImageMirror")
+		setupLog.Error(err, "unable to create controller", "controller", "ImageMirrorSet")
 		os.Exit(1)
 	}
+	// The webhook server needs serving certificates, so allow it to be
+	// disabled when running the manager outside of the cluster.
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = (&controllers.ImageMirrorValidator{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("ImageMirror"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ImageMirror")
+			os.Exit(1)
+		}
+		if err = (&controllers.ClusterImageMirrorValidator{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("ClusterImageMirror"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ClusterImageMirror")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")